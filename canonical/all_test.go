@@ -0,0 +1,136 @@
+package canonical
+
+import (
+	"testing"
+)
+
+// The example of RFC 6376 section 3.4.5
+var (
+	exampleHeaders = []Header{{"A", " X"}, {"B ", " Y\t\r\n\tZ  "}}
+	exampleBody    = []byte(" C \r\nD \t E\r\n\r\n\r\n")
+)
+
+func TestRFCExample(t *testing.T) {
+	relaxed := CanonicalHeader(Relaxed, exampleHeaders[0]) + CanonicalHeader(Relaxed, exampleHeaders[1])
+	if relaxed != "a:X\r\nb:Y Z\r\n" {
+		t.Logf("Unexpected relaxed headers %q", relaxed)
+		t.Fail()
+	}
+
+	simple := CanonicalHeader(Simple, exampleHeaders[0]) + CanonicalHeader(Simple, exampleHeaders[1])
+	if simple != "A: X\r\nB : Y\t\r\n\tZ  \r\n" {
+		t.Logf("Unexpected simple headers %q", simple)
+		t.Fail()
+	}
+
+	if body := string(CanonicalBody(Relaxed, exampleBody)); body != " C\r\nD E\r\n" {
+		t.Logf("Unexpected relaxed body %q", body)
+		t.Fail()
+	}
+
+	if body := string(CanonicalBody(Simple, exampleBody)); body != " C \r\nD \t E\r\n" {
+		t.Logf("Unexpected simple body %q", body)
+		t.Fail()
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	if body := string(CanonicalBody(Simple, nil)); body != "\r\n" {
+		t.Logf("Unexpected simple empty body %q", body)
+		t.Fail()
+	}
+
+	if body := string(CanonicalBody(Relaxed, []byte("\r\n\r\n"))); body != "" {
+		t.Logf("Unexpected relaxed empty body %q", body)
+		t.Fail()
+	}
+}
+
+func TestParseCanonicalization(t *testing.T) {
+	cases := map[string]Canonicalization{
+		"":               {Simple, Simple},
+		"relaxed":        {Relaxed, Simple},
+		"relaxed/simple": {Relaxed, Simple},
+		"simple/relaxed": {Simple, Relaxed},
+	}
+
+	for encoded, expected := range cases {
+		if err, c := ParseCanonicalization(encoded); err != nil || c != expected {
+			t.Log("Unexpected parse of", encoded, err, c)
+			t.Fail()
+		}
+	}
+
+	if err, _ := ParseCanonicalization("relaxed/loose"); err == nil {
+		t.Log("Unknown algorithm was accepted")
+		t.Fail()
+	}
+}
+
+func TestSelectHeaders(t *testing.T) {
+	headers := []Header{
+		{"Received", " first"},
+		{"From", " alice@example.com"},
+		{"Received", " second"},
+		{"Subject", " hi"},
+	}
+
+	selected := SelectHeaders(headers, []string{"received", "from", "Received", "Received", "subject"})
+
+	// Bottom up for repeated names, and nothing for the third Received
+	expected := []string{" second", " alice@example.com", " first", " hi"}
+	if len(selected) != len(expected) {
+		t.Fatal("Unexpected selection", selected)
+	}
+
+	for i, h := range selected {
+		if h.Value != expected[i] {
+			t.Log("Unexpected selection", selected)
+			t.Fail()
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	signature := Header{"KeyForge-Signature", " h=from:subject:subject; bh=abc; b="}
+	names := []string{"from", "subject", "subject"}
+
+	headers := []Header{{"From", " alice@example.com"}, {"Subject", " hi"}}
+	digest := Digest(Relaxed, headers, names, signature)
+
+	// Refolding and case changes survive relaxed, but not simple
+	rewrapped := []Header{{"from", "  alice@example.com "}, {"SUBJECT", "\r\n hi"}}
+	if Digest(Relaxed, rewrapped, names, signature) != digest {
+		t.Log("Relaxed digest changed with whitespace")
+		t.Fail()
+	}
+
+	if Digest(Simple, rewrapped, names, signature) == Digest(Simple, headers, names, signature) {
+		t.Log("Simple digest ignored whitespace")
+		t.Fail()
+	}
+
+	// Over-signing: a second Subject added later changes the digest
+	added := append(headers, Header{"Subject", " urgent"})
+	if Digest(Relaxed, added, names, signature) == digest {
+		t.Log("Added header did not change the digest")
+		t.Fail()
+	}
+}
+
+func TestBodyLength(t *testing.T) {
+	body := []byte("signed part\r\n")
+
+	_, full := BodyHash(Simple, body, -1)
+	_, limited := BodyHash(Simple, append(body, "appended by a list\r\n"...), int64(len(body)))
+
+	if full != limited {
+		t.Log("Appended text changed the hash of the signed length")
+		t.Fail()
+	}
+
+	if err, _ := BodyHash(Simple, body, 100); err == nil {
+		t.Log("Signed length longer than the body was accepted")
+		t.Fail()
+	}
+}
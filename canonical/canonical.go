@@ -0,0 +1,238 @@
+/*
+Package canonical turns a mail message into the digest KeyForge signs, using
+the header and body canonicalization of DKIM (RFC 6376 section 3.4), so that
+the usual rewriting done by relays does not break verification.
+
+The digest covers the signature header itself, as in DKIM: the selected
+headers are hashed in h= order, followed by the signature header with an
+empty b= value. The body is covered through the bh= tag of that header.
+*/
+package canonical
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// A canonicalization algorithm, for headers or the body
+type Algorithm int
+
+const (
+	Simple Algorithm = iota
+	Relaxed
+)
+
+func (a Algorithm) String() string {
+	if a == Relaxed {
+		return "relaxed"
+	}
+	return "simple"
+}
+
+func parseAlgorithm(s string) (error, Algorithm) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "simple":
+		return nil, Simple
+	case "relaxed":
+		return nil, Relaxed
+	}
+	return errors.New("Unknown canonicalization " + s), Simple
+}
+
+// The algorithms for headers and for the body, as in the c= tag
+type Canonicalization struct {
+	Header Algorithm
+	Body   Algorithm
+}
+
+// Encodes as <header>/<body>, e.g. relaxed/simple
+func (c Canonicalization) String() string {
+	return c.Header.String() + "/" + c.Body.String()
+}
+
+// Parses a c= tag. A missing body algorithm is simple, and an empty tag is
+// simple/simple.
+func ParseCanonicalization(c string) (error, Canonicalization) {
+	var result Canonicalization
+	if strings.TrimSpace(c) == "" {
+		return nil, result
+	}
+
+	parts := strings.SplitN(c, "/", 2)
+
+	err, header := parseAlgorithm(parts[0])
+	if err != nil {
+		return err, result
+	}
+	result.Header = header
+
+	if len(parts) == 2 {
+		err, body := parseAlgorithm(parts[1])
+		if err != nil {
+			return err, result
+		}
+		result.Body = body
+	}
+
+	return nil, result
+}
+
+/*
+Header is one header field of a message. Value is everything after the colon,
+exactly as received: the leading space and any folding (CRLF followed by
+whitespace) included. Simple canonicalization depends on it being verbatim.
+*/
+type Header struct {
+	Name  string
+	Value string
+}
+
+func isWSP(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// Replaces every run of spaces and tabs in s with a single space
+func compressWSP(s string) string {
+	var b strings.Builder
+	inWSP := false
+
+	for i := 0; i < len(s); i++ {
+		if isWSP(s[i]) {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			b.WriteByte(' ')
+			inWSP = false
+		}
+		b.WriteByte(s[i])
+	}
+
+	if inWSP {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
+
+// The canonical form of h, including its trailing CRLF
+func CanonicalHeader(alg Algorithm, h Header) string {
+	if alg == Simple {
+		return h.Name + ":" + h.Value + "\r\n"
+	}
+
+	// Unfold, then compress and trim whitespace
+	value := strings.Replace(h.Value, "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	value = strings.Trim(compressWSP(value), " ")
+
+	return strings.ToLower(strings.TrimRight(h.Name, " \t")) + ":" + value + "\r\n"
+}
+
+/*
+SelectHeaders picks the headers covered by an h= list, in its order. Each name
+takes the last instance of that header not yet picked, working up from the
+bottom of the message. A name listed more often than the header occurs
+contributes nothing for the extra listings, which is how a signature forbids
+such headers being added later (over-signing).
+*/
+func SelectHeaders(headers []Header, names []string) []Header {
+	used := make([]bool, len(headers))
+	selected := make([]Header, 0, len(names))
+
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(strings.TrimSpace(headers[i].Name), strings.TrimSpace(name)) {
+				used[i] = true
+				selected = append(selected, headers[i])
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// Splits body into lines, without their line endings. Bare LFs end a line as
+// CRLF does.
+func splitLines(body []byte) [][]byte {
+	lines := bytes.Split(body, []byte("\n"))
+	for i, line := range lines {
+		lines[i] = bytes.TrimSuffix(line, []byte("\r"))
+	}
+
+	// A final line ending does not start another line
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+// The canonical form of body
+func CanonicalBody(alg Algorithm, body []byte) []byte {
+	lines := splitLines(body)
+
+	if alg == Relaxed {
+		for i, line := range lines {
+			lines[i] = bytes.TrimRight([]byte(compressWSP(string(line))), " ")
+		}
+	}
+
+	// Empty lines at the end are ignored
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	var b bytes.Buffer
+	for _, line := range lines {
+		b.Write(line)
+		b.WriteString("\r\n")
+	}
+
+	// An empty body is a single CRLF under simple, and nothing under relaxed
+	if b.Len() == 0 && alg == Simple {
+		b.WriteString("\r\n")
+	}
+
+	return b.Bytes()
+}
+
+// BodyHash computes bh=, the b64 sha256 of the canonical body. With a length
+// of zero or more only that many octets are hashed (the l= tag), and the
+// canonical body must be at least that long.
+func BodyHash(alg Algorithm, body []byte, length int64) (error, string) {
+	canonical := CanonicalBody(alg, body)
+
+	if length >= 0 {
+		if length > int64(len(canonical)) {
+			return errors.New("Body is shorter than its signed length"), ""
+		}
+		canonical = canonical[:length]
+	}
+
+	sum := sha256.Sum256(canonical)
+	return nil, base64.StdEncoding.EncodeToString(sum[:])
+}
+
+/*
+Digest is what Server.Sign and Server.Verify are given: the hex sha256 of the
+headers selected by names, canonicalized, followed by signature. signature is
+the signature header with an empty b= value, and is hashed without its
+trailing CRLF.
+*/
+func Digest(alg Algorithm, headers []Header, names []string, signature Header) string {
+	hash := sha256.New()
+
+	for _, h := range SelectHeaders(headers, names) {
+		hash.Write([]byte(CanonicalHeader(alg, h)))
+	}
+
+	hash.Write([]byte(strings.TrimSuffix(CanonicalHeader(alg, signature), "\r\n")))
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/keyserver"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// The expiry information a keyforge-server would publish for leaves that
+// began before cutoff
+func expiryDocument(h *hibs.GSHIBE, tree *utils.TimeTree, cutoff time.Time) utils.ExpiryDocument {
+	doc := utils.ExpiryDocument{Version: utils.ExpiryVersion, Tree: tree.String(), Expired: cutoff}
+
+	start := time.Date(cutoff.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, path := range tree.Cover(start, cutoff) {
+		doc.Nodes = append(doc.Nodes, utils.NodeSecret{
+			Path:      path,
+			Secret:    h.ExportNodePrivate(path),
+			Ancestors: h.ExportAncestorParams(path),
+		})
+	}
+
+	return doc
+}
+
+func TestForge(t *testing.T) {
+	var h hibs.GSHIBE
+	h.Setup()
+
+	_, tree := utils.NewTimeTree(5*time.Minute, []int{24, 12})
+	cutoff := time.Date(2020, time.March, 2, 13, 30, 0, 0, time.UTC)
+
+	err, forger := NewForger(h.ExportPublic(), expiryDocument(&h, tree, cutoff))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// A day, an hour and a leaf disclosed on their own
+	for _, when := range []time.Time{
+		time.Date(2020, time.February, 10, 8, 0, 0, 0, time.UTC),
+		time.Date(2020, time.March, 2, 12, 40, 0, 0, time.UTC),
+		time.Date(2020, time.March, 2, 13, 25, 0, 0, time.UTC),
+	} {
+		err, forgery := forger.Forge(hash, when)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !forger.HIBE.Verify(forgery.Sig, hash, forgery.Path) {
+			t.Log("Forgery for", when, "failed to verify")
+			t.Fail()
+		}
+
+		// What a recipient reassembles from DNS and the signature header
+		day, _ := tree.Leaf(when)
+		published := make([]string, 0)
+		for i := 1; i <= 3; i++ {
+			published = append(published, h.ExtractPath(tree.Path(day, 0)[:i]).Params())
+		}
+
+		parts := strings.Split(forgery.Signature, ",")
+		err, sig := hibs.GSSigFromPublic(parts[0], append(published, parts[1:]...))
+		if err != nil || !h.Verify(*sig, hash, forgery.Path) {
+			t.Log("Forgery for", when, "does not verify as sent", forgery.Signature)
+			t.Fail()
+		}
+	}
+
+	// Leaves that have not begun cannot be forged
+	if err, _ := forger.Forge(hash, cutoff); err == nil {
+		t.Log("Forged a leaf that has not expired")
+		t.Fail()
+	}
+}
+
+func TestNodesOutsideTree(t *testing.T) {
+	var h hibs.GSHIBE
+	h.Setup()
+
+	_, tree := utils.NewTimeTree(5*time.Minute, []int{24, 12})
+	cutoff := time.Date(2020, time.March, 2, 13, 30, 0, 0, time.UTC)
+
+	for _, path := range [][]string{
+		{},
+		nil,
+		{"2020", "03", "02", "13", "05", "00"},
+		{"2020", "13"},
+	} {
+		doc := expiryDocument(&h, tree, cutoff)
+		doc.Nodes = append(doc.Nodes, utils.NodeSecret{Path: path, Secret: doc.Nodes[0].Secret})
+
+		if err, _ := NewForger(h.ExportPublic(), doc); err == nil {
+			t.Log("Accepted an expiry document with a node at", path)
+			t.Fail()
+		}
+	}
+}
+
+func TestLookupPublic(t *testing.T) {
+	resolver := keyserver.NewStaticResolver()
+	resolver.Set("mail.example.com", "tree=x,public=legacy,EOM")
+	resolver.Set("k2.mail.example.com", "tree=x,", "public=second,EOM")
+
+	for _, test := range []struct {
+		selector, keyID, public string
+	}{
+		{"mail", "", "legacy"},
+		{"mail", "k2", "second"},
+		{"MAIL", "k2", "second"},
+		{"mail", "k3", ""},
+		{pubKeyFile, "", ""},
+	} {
+		err, pk := lookupPublic(resolver, test.selector, "example.com", test.keyID)
+		if pk != test.public || (err == nil) != (test.public != "") {
+			t.Log("Looking up", test.keyID, "under", test.selector, "gave", pk, err, "rather than", test.public)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// Signs for expired leaves of someone else's tree, using only their public
+// key and published expiry information
+type Forger struct {
+	HIBE     *hibs.GSHIBE // public parameters only
+	Tree     *utils.TimeTree
+	Document utils.ExpiryDocument
+}
+
+// A forged signature, in the form keyforge-server produces
+type Forgery struct {
+	Signature string     // b64 signature point, then the sub-day Q values
+	Expiry    string     // <day in UnixDate>,<leaf>
+	Path      []string   // the leaf signed for
+	Sig       hibs.GSSig // the signature, with every Q value
+}
+
+func NewForger(public string, doc utils.ExpiryDocument) (error, *Forger) {
+	if doc.Version != utils.ExpiryVersion {
+		return errors.New("Unsupported expiry document version " + strconv.Itoa(doc.Version)), nil
+	}
+
+	err, tree := utils.ParseTimeTree(doc.Tree)
+	if err != nil {
+		return err, nil
+	}
+
+	// Forge takes the last ID of a covering node's path and extracts below it,
+	// so every node must lie within the tree
+	for _, node := range doc.Nodes {
+		if err, _, _ := tree.Span(node.Path); err != nil {
+			return errors.New("Expiry document has a node outside the tree: " + err.Error()), nil
+		}
+	}
+
+	var h hibs.GSHIBE
+	if err := h.SetupPublicFromString(public); err != nil {
+		return err, nil
+	}
+
+	return nil, &Forger{&h, tree, doc}
+}
+
+// Signs hash for the leaf containing when, which must have expired
+func (f *Forger) Forge(hash string, when time.Time) (error, *Forgery) {
+	day, leaf := f.Tree.Leaf(when)
+	path := f.Tree.Path(day, leaf)
+
+	node := f.Document.Covering(path)
+	if node == nil {
+		return errors.New("No published secret covers " + strings.Join(path, "/") + ", it has not expired"), nil
+	}
+
+	err, ancestors := hibs.QValuesFromStrings(node.Ancestors)
+	if err != nil {
+		return err, nil
+	}
+
+	err, entity := f.HIBE.NodeFromPrivate(node.Path[len(node.Path)-1], node.Secret, ancestors)
+	if err != nil {
+		return err, nil
+	}
+
+	entity = f.HIBE.ExtractBelow(entity, path[len(node.Path):])
+	sig := f.HIBE.SignWith(hash, entity)
+
+	signature, qvalues := sig.Export(f.Tree.SubLevels())
+
+	return nil, &Forgery{
+		Signature: strings.Join(append([]string{signature}, qvalues...), ","),
+		Expiry:    day.Format(time.UnixDate) + "," + strconv.Itoa(leaf),
+		Path:      path,
+		Sig:       sig,
+	}
+}
+
+// Reads an expiry document from a file, or from an http(s) URL such as a
+// keyforge-server's /expire
+func ReadExpiry(source string) (error, utils.ExpiryDocument) {
+	var doc utils.ExpiryDocument
+	var body io.ReadCloser
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return err, doc
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return errors.New("Fetching " + source + ": " + resp.Status), doc
+		}
+
+		body = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return err, doc
+		}
+
+		body = file
+	}
+
+	defer body.Close()
+
+	err := json.NewDecoder(body).Decode(&doc)
+	return err, doc
+}
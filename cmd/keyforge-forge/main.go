@@ -0,0 +1,133 @@
+/*
+keyforge-forge
+
+keyforge-forge signs an arbitrary message hash for a domain whose signing key
+has expired, using nothing but the domain's public key and the expiry
+information its keyforge-server publishes. A signature that verifies is
+therefore no proof that the domain's owner made it, which is the deniability
+KeyForge promises.
+
+The forged signature is checked with the same verification a recipient does,
+and printed in the form keyforge-server produces.
+
+Example:
+
+	keyforge-forge -domain example.com -expiry https://mail.example.com:8081/expire \
+		-time 2020-03-02T12:30:00Z < message
+
+The public key is looked up at <selector>.<domain>, through -nameserver when
+given, e.g. -selector mail -nameserver udp://127.0.0.1:53.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/keyforgery/KeyForge/keyserver"
+)
+
+const (
+	pubKeyFile = "_KeyForge"
+)
+
+var (
+	domain     = flag.String("domain", "", "Domain whose public key is looked up at <selector>.<domain>, or <key ID>.<selector>.<domain> for the expiry information of a key with one")
+	selector   = flag.String("selector", pubKeyFile, "Label the domain's KeyForge records live under")
+	nameserver = flag.String("nameserver", "", "Resolver to look the public key up with, as DNSResolver in the configuration: udp://host:port, tcp://host:port or host:port, default = the system resolver")
+	public     = flag.String("public", "", "b64 public key to use instead of looking it up")
+	expiry     = flag.String("expiry", "", "Expiry information, as a file or an http(s) URL")
+	hash       = flag.String("hash", "", "Hex sha256 sum to sign, default = the sum of standard input")
+	forgeAt    = flag.String("time", "", "RFC 3339 time within the leaf to sign for, default = the newest expired leaf")
+)
+
+func check(e error, message string) {
+	if e != nil {
+		fmt.Fprintln(os.Stderr, message, e)
+		os.Exit(1)
+	}
+}
+
+// Looks up the public key published for domain under selector with
+// resolver, of the generation keyID if it is not empty
+func lookupPublic(resolver keyserver.Resolver, selector, domain, keyID string) (error, string) {
+	name := selector + "." + domain
+	if keyID != "" {
+		name = keyID + "." + name
+	}
+
+	err, txts, _ := resolver.LookupTXT(name)
+	if err != nil {
+		return err, ""
+	}
+
+	record := strings.TrimSuffix(strings.Join(txts, ""), "EOM")
+	for _, pair := range strings.Split(record, ",") {
+		if strings.HasPrefix(pair, "public=") {
+			return nil, strings.TrimPrefix(pair, "public=")
+		}
+	}
+
+	return fmt.Errorf("no public key at %s", name), ""
+}
+
+func main() {
+	flag.Parse()
+
+	if *expiry == "" || (*domain == "" && *public == "") {
+		fmt.Fprintln(os.Stderr, "-expiry and one of -domain or -public are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err, doc := ReadExpiry(*expiry)
+	check(err, "fail! Cannot read the expiry information:")
+
+	pk := *public
+	if pk == "" {
+		err, resolver := keyserver.NewResolver(*nameserver)
+		check(err, "fail! Cannot use -nameserver:")
+
+		err, pk = lookupPublic(resolver, *selector, *domain, doc.KeyID)
+		check(err, "fail! Cannot look up the public key:")
+	}
+
+	err, forger := NewForger(pk, doc)
+	check(err, "fail! Cannot use the expiry information:")
+
+	sum := *hash
+	if sum == "" {
+		digest := sha256.New()
+		_, err := io.Copy(digest, os.Stdin)
+		check(err, "fail! Cannot read the message:")
+		sum = hex.EncodeToString(digest.Sum(nil))
+	}
+
+	// The newest leaf that has been disclosed
+	when := doc.Expired.Add(-forger.Tree.Epoch)
+	if *forgeAt != "" {
+		when, err = time.Parse(time.RFC3339, *forgeAt)
+		check(err, "fail! Cannot parse -time:")
+	}
+
+	err, forgery := forger.Forge(sum, when)
+	check(err, "fail! Cannot forge:")
+
+	fmt.Println("path:     ", strings.Join(forgery.Path, "/"))
+	fmt.Println("sha256:   ", sum)
+	fmt.Println("signature:", forgery.Signature)
+	fmt.Println("expiry:   ", forgery.Expiry)
+
+	if !forger.HIBE.Verify(forgery.Sig, sum, forgery.Path) {
+		fmt.Fprintln(os.Stderr, "fail! The forged signature does not verify")
+		os.Exit(1)
+	}
+
+	fmt.Println("verified:  true")
+}
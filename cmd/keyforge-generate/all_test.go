@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/keyserver"
+	"github.com/keyforgery/KeyForge/utils"
+	"github.com/miekg/dns"
+)
+
+// Replaces the records collected with the given ones, for the test's length
+func setRecords(t *testing.T, set ...TXTRecord) {
+	saved := records
+	records = set
+	t.Cleanup(func() { records = saved })
+}
+
+// Reads a zone fragment back as a nameserver would, with origin for relative
+// names
+func parseZone(t *testing.T, zone, origin string) []*dns.TXT {
+	parsed := make([]*dns.TXT, 0)
+
+	zp := dns.NewZoneParser(strings.NewReader(zone), origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		parsed = append(parsed, rr.(*dns.TXT))
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal("Cannot parse the zone", err, zone)
+	}
+
+	return parsed
+}
+
+// The value of a TXT record, as miekg/dns keeps it escaped
+func txtValue(rr *dns.TXT) string {
+	var b strings.Builder
+	value := strings.Join(rr.Txt, "")
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+func TestSplitCharacterStrings(t *testing.T) {
+	for length, count := range map[int]int{0: 1, 1: 1, 255: 1, 256: 2, 510: 2, 511: 3, 1478: 6} {
+		value := strings.Repeat("x", length)
+		parts := splitCharacterStrings(value)
+
+		if strings.Join(parts, "") != value || len(parts) != count {
+			t.Log("Split a value of", length, "bytes into", len(parts), "parts")
+			t.Fail()
+		}
+
+		for _, part := range parts {
+			if len(part) > maxCharacterString {
+				t.Log("Character-string of", len(part), "bytes")
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestFormatZone(t *testing.T) {
+	long := "public=" + strings.Repeat("ABCD", 100) + "EOM"
+	quoted := `a="b\c",EOM`
+
+	setRecords(t,
+		TXTRecord{"2020_0.k1._KeyForge", long},
+		TXTRecord{"k1._KeyForge", quoted},
+		TXTRecord{"2020.k1._KeyForge", "01=x,EOM"})
+
+	for _, origin := range []string{"", "example.com", "example.com."} {
+		zone := formatZone(origin, 300)
+
+		if strings.Contains(zone, "$ORIGIN") != (origin != "") {
+			t.Log("$ORIGIN with origin", origin, zone)
+			t.Fail()
+		}
+
+		parseOrigin := "example.com."
+		if origin != "" {
+			// The fragment's own $ORIGIN must be used
+			parseOrigin = "other.example."
+		}
+
+		parsed := parseZone(t, zone, parseOrigin)
+		if len(parsed) != 3 {
+			t.Fatal("Zone has", len(parsed), "records", zone)
+		}
+
+		// In name order, each whole once the character-strings are joined
+		for i, want := range []TXTRecord{
+			{"2020.k1._KeyForge", "01=x,EOM"},
+			{"2020_0.k1._KeyForge", long},
+			{"k1._KeyForge", quoted},
+		} {
+			rr := parsed[i]
+			if rr.Hdr.Name != want.Name+".example.com." || rr.Hdr.Ttl != 300 || txtValue(rr) != want.Value {
+				t.Log("Record", i, "with origin", origin, "is", rr.String(), "rather than", want)
+				t.Fail()
+			}
+		}
+
+		if len(parsed[1].Txt) != 2 {
+			t.Log("Record of", len(long), "bytes in", len(parsed[1].Txt), "character-strings")
+			t.Fail()
+		}
+	}
+
+	if !strings.Contains(formatZone("", 300), `"a=\"b\\c\",EOM"`) {
+		t.Log("Quotes and backslashes not escaped", formatZone("", 300))
+		t.Fail()
+	}
+}
+
+func TestWriteRecordJSON(t *testing.T) {
+	long := strings.Repeat("y", 300)
+	setRecords(t, TXTRecord{"k1._KeyForge", `x="\"`}, TXTRecord{"2020.k1._KeyForge", long})
+
+	for origin, suffix := range map[string]string{"": "", "example.com": ".example.com."} {
+		filename := filepath.Join(t.TempDir(), "records.json")
+		if err := writeRecordJSON(filename, origin, 60); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var list []jsonRecord
+		if err := json.Unmarshal(data, &list); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []jsonRecord{
+			{"2020.k1._KeyForge" + suffix, "TXT", 60, long, []string{long[:255], long[255:]}},
+			{"k1._KeyForge" + suffix, "TXT", 60, `x="\"`, []string{`x="\"`}},
+		}
+		if !reflect.DeepEqual(list, want) {
+			t.Log("With origin", origin, "wrote", string(data))
+			t.Fail()
+		}
+	}
+}
+
+// Points directory at an empty key directory, with an hourly tree, for the
+// test's length
+func setupKeyDir(t *testing.T) {
+	savedDirectory, savedTree, savedKeyID, savedRecords := directory, tree, keyID, records
+	t.Cleanup(func() { directory, tree, keyID, records = savedDirectory, savedTree, savedKeyID, savedRecords })
+
+	var err error
+	directory = t.TempDir()
+	if err, tree = utils.NewTimeTree(time.Hour, []int{24}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Writes generation id as keyforge-generate does, with records for the days
+// from from until until. Keys without a key ID have no generation file.
+func writeTestGeneration(t *testing.T, id string, activeFrom, from, until time.Time) {
+	var h hibs.GSHIBE
+	h.Setup()
+
+	keyID = id
+	dumpPublic(&h, from, from, until)
+	dumpPrivate(&h)
+
+	if id != "" {
+		if err := writeGeneration(id, activeFrom); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Every tag of every record generation id has written, by tree node
+func publishedTags(t *testing.T, id string) map[string]map[string]string {
+	files, err := ioutil.ReadDir(generationDir(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := map[string]bool{"": true}
+	for _, file := range files {
+		if name := strings.TrimSuffix(file.Name(), "."+recordFile(id, "")); name != file.Name() {
+			nodes[name[:strings.LastIndex(name, "_")]] = true
+		}
+	}
+
+	published := make(map[string]map[string]string)
+	for node := range nodes {
+		err, tags := readNodeRecord(id, node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		published[node] = tags
+	}
+
+	return published
+}
+
+func TestNextKeyID(t *testing.T) {
+	for _, test := range []struct {
+		entries []string // directories, but for those ending in _KeyForge
+		next    string
+	}{
+		{nil, "k1"},
+		{[]string{"_KeyForge"}, "k1"},
+		{[]string{"k1", "k2"}, "k3"},
+		{[]string{"k1", "k3"}, "k4"},
+		{[]string{"k3", "k10"}, "k11"},
+		{[]string{"k1.retired", "k2"}, "k3"},
+		{[]string{"k1", "k2.retired"}, "k3"},
+		{[]string{"k7.retired"}, "k8"},
+		{[]string{"k1", "k01", "kitchen", "k5.old", "k9._KeyForge"}, "k2"},
+	} {
+		setupKeyDir(t)
+
+		for _, entry := range test.entries {
+			var err error
+			if strings.HasSuffix(entry, pubKeyFile) {
+				err = ioutil.WriteFile(filepath.Join(directory, entry), []byte("EOM"), 0644)
+			} else {
+				err = os.Mkdir(filepath.Join(directory, entry), 0755)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err, next := nextKeyID(); err != nil || next != test.next {
+			t.Log("After", test.entries, "the next key ID is", next, "rather than", test.next, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestRetireGeneration(t *testing.T) {
+	setupKeyDir(t)
+
+	now := time.Now()
+	writeTestGeneration(t, "", time.Time{}, now, now)
+	writeTestGeneration(t, "k1", now.AddDate(0, 0, -30), now, now)
+	writeTestGeneration(t, "k2", now.AddDate(0, 0, -10), now, now)
+	writeTestGeneration(t, "k3", now.Add(-time.Hour), now, now)
+
+	_, existing := generations()
+	if !reflect.DeepEqual(existing, []string{"", "k1", "k2", "k3"}) {
+		t.Fatal("Generations", existing)
+	}
+
+	for _, test := range []struct {
+		id      string
+		retired bool
+	}{
+		{"", false},   // keys without a key ID
+		{"k4", false}, // no such generation
+		{"k3", false}, // the newest
+		{"k2", false}, // k3 has signed for an hour, its signatures still verify
+		{"k1", true},
+		{"k1", false}, // already retired
+	} {
+		_, existing := generations()
+		err := retireGeneration(test.id, existing)
+		if (err == nil) != test.retired {
+			t.Log("Retiring", test.id, "gave", err)
+			t.Fail()
+		}
+	}
+
+	_, existing = generations()
+	if !reflect.DeepEqual(existing, []string{"", "k2", "k3"}) {
+		t.Log("Generations after retiring k1", existing)
+		t.Fail()
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, "k1"+retiredSuffix, "private", "private")); err != nil {
+		t.Log("Retired keys were not kept", err)
+		t.Fail()
+	}
+
+	// The zone file no longer has k1
+	if err := collectRecords(existing); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if strings.Contains(record.Name, ".k1.") || strings.HasPrefix(record.Name, "k1.") {
+			t.Log("Retired record", record.Name, "collected")
+			t.Fail()
+		}
+	}
+
+	// Nor is its key ID given out again
+	if _, next := nextKeyID(); next != "k4" {
+		t.Log("Next key ID after retiring k1 is", next)
+		t.Fail()
+	}
+}
+
+func TestCheck(t *testing.T) {
+	config := utils.DefaultConfiguration()
+	config.Horizon.Duration = 40 * 24 * time.Hour
+	config.RenewBefore.Duration = 20 * 24 * time.Hour
+
+	now := time.Now()
+	from := now.AddDate(0, 0, -1)
+
+	for _, test := range []struct {
+		name             string
+		k1Until, k2Until time.Time // k2 not written when zero
+		status           int
+	}{
+		{"published ahead", now.AddDate(0, 0, 30), time.Time{}, 0},
+		{"ending within RenewBefore", now.AddDate(0, 0, 10), time.Time{}, 1},
+		{"ending today", now, time.Time{}, 1},
+		{"successor published ahead", now.AddDate(0, 0, 30), now.AddDate(0, 0, 30), 0},
+		{"successor ending within RenewBefore", now.AddDate(0, 0, 30), now.AddDate(0, 0, 10), 1},
+	} {
+		setupKeyDir(t)
+
+		writeTestGeneration(t, "k1", now.AddDate(0, 0, -7), from, test.k1Until)
+		if !test.k2Until.IsZero() {
+			// Not signed with yet, but it will be
+			writeTestGeneration(t, "k2", now.AddDate(0, 0, 2), from, test.k2Until)
+		}
+
+		before := publishedTags(t, "k1")
+
+		if err, status := checkStatus(config); err != nil || status != test.status {
+			t.Log(test.name+": -check exits", status, "rather than", test.status, err)
+			t.Fail()
+		}
+
+		// Checking changes nothing
+		if !reflect.DeepEqual(publishedTags(t, "k1"), before) {
+			t.Log(test.name + ": -check changed the records")
+			t.Fail()
+		}
+	}
+
+	// Nothing to check is an error
+	setupKeyDir(t)
+	if err, status := checkStatus(config); err == nil || status == 0 {
+		t.Log("-check passed without keys")
+		t.Fail()
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	setupKeyDir(t)
+
+	config := utils.DefaultConfiguration()
+	config.Horizon.Duration = 40 * 24 * time.Hour
+	config.RenewBefore.Duration = 20 * 24 * time.Hour
+
+	now := time.Now()
+	writeTestGeneration(t, "k1", now.AddDate(0, 0, -7), now.AddDate(0, 0, -1), now.AddDate(0, 0, 10))
+	before := publishedTags(t, "k1")
+
+	if err, changed := maintainOnce(config, false); err != nil || !changed {
+		t.Fatal("Records ending within RenewBefore were not written further", err)
+	}
+
+	// Published records are written again unchanged, only added to
+	after := publishedTags(t, "k1")
+	for node, tags := range before {
+		for tag, value := range tags {
+			if after[node][tag] != value {
+				t.Log("Record", node, "tag", tag, "changed from", value, "to", after[node][tag])
+				t.Fail()
+			}
+		}
+	}
+
+	if err, status := checkStatus(config); err != nil || status != 0 {
+		t.Log("Records not published Horizon ahead after -maintain", status, err)
+		t.Fail()
+	}
+
+	if _, err := os.Stat(filepath.Join(directory, pubKeyFile+".zone")); err != nil {
+		t.Log("Zone file not written", err)
+		t.Fail()
+	}
+
+	// With the records far enough ahead, nothing is touched
+	files, _ := filepath.Glob(filepath.Join(generationDir("k1"), "*"+pubKeyFile))
+	written := make(map[string]time.Time)
+	for _, file := range files {
+		info, _ := os.Stat(file)
+		written[file] = info.ModTime()
+	}
+
+	if err, changed := maintainOnce(config, false); err != nil || changed {
+		t.Log("Records published ahead were written again", err)
+		t.Fail()
+	}
+
+	for file, modTime := range written {
+		if info, err := os.Stat(file); err != nil || !info.ModTime().Equal(modTime) {
+			t.Log("Published record", file, "was rewritten", err)
+			t.Fail()
+		}
+	}
+}
+
+// Delegates the month of when from a new generation k1, and loads it the way
+// a signing host would: from the generation's directory without private/.
+// Returns the key server and the month's delegated key file.
+func delegatedServer(t *testing.T, when time.Time) (*keyserver.Server, string) {
+	setupKeyDir(t)
+
+	now := time.Now()
+	writeTestGeneration(t, "k1", now.AddDate(0, 0, -7), now.AddDate(0, 0, -1), now.AddDate(0, 0, 1))
+
+	month := when.UTC().Format("2006-01")
+	if err := writeDelegations([]string{month}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(generationDir("k1"), "private")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The records as published
+	zone := keyserver.NewStaticResolver()
+	_, ids := generations()
+	if err := collectRecords(ids); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		zone.Set(record.Name+".example.com", record.Value)
+	}
+
+	err, signers := keyserver.LoadSigners([]utils.SignerConfig{{Domain: "example.com", KeyDirectory: directory}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signers["example.com"].Delegated {
+		t.Fatal("Loaded the master secret rather than the delegated key")
+	}
+
+	return &keyserver.Server{Signers: signers, Cache: keyserver.NewDNSCache(zone, 0)}, filepath.Join(generationDir("k1"), delegatedDir, month+".json")
+}
+
+func TestDelegateMonth(t *testing.T) {
+	// Signatures made now are for the leaf an epoch ahead
+	s, file := delegatedServer(t, time.Now().Add(time.Hour))
+
+	info, err := os.Stat(file)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("Delegated key not written, or readable by others", err)
+	}
+
+	err, key := utils.ReadDelegatedKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Tree != tree.String() || key.NotBefore.Day() != 1 || !key.NotAfter.Equal(key.NotBefore.AddDate(0, 1, 0)) {
+		t.Log("Delegated key for", key.Node.Path, "with tree", key.Tree, "signs from", key.NotBefore, "until", key.NotAfter)
+		t.Fail()
+	}
+
+	var reply keyserver.SigReply
+	if err := s.Sign(&keyserver.SigArgs{Sha256: "delegated", SenderEmailAddress: "a@example.com"}, &reply); err != nil || !reply.Success {
+		t.Fatal("Signing with the delegated month failed", err, reply.Error)
+	}
+
+	var vreply keyserver.VerifyReply
+	s.Verify(keyserver.VerifyArgs{Sha256: "delegated", DNS: reply.DNS, Signature: reply.Sig, Path: reply.Path, QValues: reply.QValues}, &vreply)
+	if !vreply.Answer {
+		t.Log("Delegated signature does not verify against the published records", vreply)
+		t.Fail()
+	}
+
+	// Only the leaves between NotBefore and NotAfter can be signed for
+	h := s.Signers["example.com"].HIBE
+	for when, holds := range map[time.Time]bool{
+		key.NotBefore:                       true,
+		key.NotAfter.Add(-tree.Epoch):       true,
+		key.NotBefore.Add(-time.Nanosecond): false,
+		key.NotAfter:                        false,
+	} {
+		day, leaf := tree.Leaf(when)
+		if h.Holds(tree.Path(day, leaf)) != holds {
+			t.Log("Delegated key holds the leaf at", when, "is not", holds)
+			t.Fail()
+		}
+	}
+}
+
+func TestDelegateOtherMonth(t *testing.T) {
+	s, _ := delegatedServer(t, time.Now().AddDate(0, 2, 0))
+
+	var reply keyserver.SigReply
+	if err := s.Sign(&keyserver.SigArgs{Sha256: "delegated", SenderEmailAddress: "a@example.com"}, &reply); err != keyserver.ErrNoLeafKey || reply.Success {
+		t.Log("Signed outside the delegated month", err)
+		t.Fail()
+	}
+}
+
+func TestMaintainAcrossYears(t *testing.T) {
+	setupKeyDir(t)
+
+	config := utils.DefaultConfiguration()
+	config.Horizon.Duration = 40 * 24 * time.Hour
+
+	// Written late last year, with no records for this one
+	now := time.Now().UTC()
+	first := time.Date(now.Year()-1, time.December, 20, 0, 0, 0, 0, time.UTC)
+	writeTestGeneration(t, "k1", first, first, first.AddDate(0, 0, 7))
+
+	if err, rewritten := maintainGeneration(config, "k1", now, false); err != nil || !rewritten {
+		t.Fatal("Records were not written further", err)
+	}
+
+	_, base := readBaseRecord("k1")
+	if _, ok := base[utils.FormatYear(first.Year())]; ok && now.YearDay() > 1 {
+		t.Fatal("Rewritten records still cover last year", base)
+	}
+
+	err, signers := keyserver.LoadSigners([]utils.SignerConfig{{Domain: "example.com", KeyDirectory: directory}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := keyserver.ExpiryServer{Server: &keyserver.Server{Signers: signers}, Delay: keyserver.ExpiryDelay}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/expire", nil))
+
+	var doc utils.ExpiryDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(w.Code, err)
+	}
+
+	// Last year's leaves can still be forged
+	for _, when := range []time.Time{first, first.AddDate(0, 0, 7)} {
+		day, leaf := tree.Leaf(when)
+		if doc.Covering(tree.Path(day, leaf)) == nil {
+			t.Log("The expiry information no longer covers", when)
+			t.Fail()
+		}
+	}
+}
+
+func TestSelector(t *testing.T) {
+	setupKeyDir(t)
+
+	now := time.Now()
+	writeTestGeneration(t, "", time.Time{}, now, now)
+	writeTestGeneration(t, "k1", now, now, now)
+
+	saved := selector
+	selector = "mail"
+	defer func() { selector = saved }()
+
+	_, ids := generations()
+	if err := collectRecords(ids); err != nil {
+		t.Fatal(err)
+	}
+
+	year := utils.FormatYear(now.UTC().Year())
+	names := make(map[string]bool)
+	for _, record := range records {
+		names[record.Name] = true
+		if strings.Contains(record.Name, pubKeyFile) {
+			t.Log("Record published under the default selector", record.Name)
+			t.Fail()
+		}
+	}
+
+	for _, name := range []string{"mail", year + "_0.mail", "k1.mail", year + "_0.k1.mail"} {
+		if !names[name] {
+			t.Log("No record at", name, "in", names)
+			t.Fail()
+		}
+	}
+
+	// The files keep the names keyforge-server reads
+	if _, err := os.Stat(filepath.Join(generationDir("k1"), "k1."+pubKeyFile)); err != nil {
+		t.Log("Base record file renamed", err)
+		t.Fail()
+	}
+}
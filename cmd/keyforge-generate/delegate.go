@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// Where delegated keys are written, under the key directory
+const delegatedDir = "delegated"
+
+// Loads the master key and tree shape of the generation keyID, generated
+// earlier into directory
+func loadKeys() (error, *hibs.GSHIBE, *utils.TimeTree) {
+	sk, err := ioutil.ReadFile(path.Join(generationDir(keyID), "private", "private"))
+	if err != nil {
+		return err, nil, nil
+	}
+
+	err, tags := readBaseRecord(keyID)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	var h hibs.GSHIBE
+	if err := h.SetupPublicFromString(tags["public"]); err != nil {
+		return err, nil, nil
+	}
+	if err := h.SetupPrivateFromString(string(sk)); err != nil {
+		return err, nil, nil
+	}
+
+	err, tree := utils.ParseTimeTree(tags["tree"])
+	if err != nil {
+		return err, nil, nil
+	}
+
+	return nil, &h, tree
+}
+
+// Builds the delegated key for one month, given as YYYY-MM
+func delegateMonth(h *hibs.GSHIBE, tree *utils.TimeTree, month string) (error, *utils.DelegatedKey) {
+	start, err := time.Parse("2006-01", month)
+	if err != nil {
+		return errors.New("Months are given as YYYY-MM, not " + month), nil
+	}
+
+	nodePath := []string{utils.FormatYear(start.Year()), utils.FormatDig(int(start.Month()))}
+
+	err, notBefore, notAfter := tree.Span(nodePath)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &utils.DelegatedKey{
+		Version:   utils.DelegationVersion,
+		Tree:      tree.String(),
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+		Node: utils.NodeSecret{
+			Path:      nodePath,
+			Secret:    h.ExportNodePrivate(nodePath),
+			Ancestors: h.ExportAncestorParams(nodePath),
+		},
+	}
+}
+
+// Writes a delegated key for each month to the delegated directory of the
+// generation keyID
+func writeDelegations(months []string) error {
+	err, h, tree := loadKeys()
+	if err != nil {
+		return err
+	}
+
+	dir := path.Join(generationDir(keyID), delegatedDir)
+	os.MkdirAll(dir, 0700)
+
+	for _, month := range months {
+		month = strings.TrimSpace(month)
+
+		err, key := delegateMonth(h, tree, month)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(key, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		// Unlike the public records, this is a signing secret
+		fullpath := path.Join(dir, month+".json")
+		if err := ioutil.WriteFile(fullpath, data, 0600); err != nil {
+			return err
+		}
+
+		fmt.Println(fullpath, "signs from", key.NotBefore, "until", key.NotAfter)
+	}
+
+	return nil
+}
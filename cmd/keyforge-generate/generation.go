@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// Key ID of the generation being written or delegated from
+var keyID string
+
+// Added to the directory of a generation that is no longer published
+const retiredSuffix = ".retired"
+
+// Key IDs of the generations in directory, oldest first. Keys written before
+// there were generations are in directory itself, with the key ID "".
+func generations() (error, []string) {
+	ids := make([]string, 0)
+
+	if _, err := os.Stat(path.Join(directory, pubKeyFile)); err == nil {
+		ids = append(ids, "")
+	}
+
+	dirs, err := filepath.Glob(path.Join(directory, "k*"))
+	if err != nil {
+		return err, nil
+	}
+
+	numbered := make([]int, 0)
+	for _, dir := range dirs {
+		if err, n := utils.ParseKeyID(filepath.Base(dir)); err == nil {
+			numbered = append(numbered, n)
+		}
+	}
+	sort.Ints(numbered)
+
+	for _, n := range numbered {
+		ids = append(ids, utils.FormatKeyID(n))
+	}
+
+	return nil, ids
+}
+
+// The key ID after the newest in directory, retired or not, so no key ID is
+// ever given to two master keys
+func nextKeyID() (error, string) {
+	dirs, err := filepath.Glob(path.Join(directory, "k*"))
+	if err != nil {
+		return err, ""
+	}
+
+	newest := 0
+	for _, dir := range dirs {
+		if err, n := utils.ParseKeyID(strings.TrimSuffix(filepath.Base(dir), retiredSuffix)); err == nil && n > newest {
+			newest = n
+		}
+	}
+
+	return nil, utils.FormatKeyID(newest + 1)
+}
+
+// The directory generation id is in
+func generationDir(id string) string {
+	return path.Join(directory, id)
+}
+
+// The label the records are published under, see utils.Configuration.SelectorFor
+var selector = utils.DefaultSelector
+
+// The file of generation id holding the record for a tree node, or the base
+// record for "". Files are named as their records resolve under the domain
+// with the default selector, whatever the selector is, as keyforge-server
+// reads them by these names.
+func recordFile(id, node string) string {
+	name := pubKeyFile
+	if id != "" {
+		name = id + "." + name
+	}
+	if node != "" {
+		name = node + "." + name
+	}
+	return name
+}
+
+// The name the record in file is published under, relative to the domain
+func recordName(file string) string {
+	return strings.TrimSuffix(file, pubKeyFile) + selector
+}
+
+// Writes the generation file for a new generation id, signing from activeFrom
+func writeGeneration(id string, activeFrom time.Time) error {
+	return utils.WriteGeneration(path.Join(generationDir(id), utils.GenerationFile), &utils.Generation{
+		Version:    utils.GenerationVersion,
+		KeyID:      id,
+		Created:    time.Now().UTC(),
+		ActiveFrom: activeFrom.UTC(),
+	})
+}
+
+// Reads back the records of every generation still published, for the zone
+// file
+func collectRecords(ids []string) error {
+	records = nil
+
+	for _, id := range ids {
+		base := recordFile(id, "")
+
+		files, err := ioutil.ReadDir(generationDir(id))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			name := file.Name()
+			if file.IsDir() || name != base && !strings.HasSuffix(name, "."+base) {
+				continue
+			}
+
+			data, err := ioutil.ReadFile(path.Join(generationDir(id), name))
+			if err != nil {
+				return err
+			}
+			addRecord(recordName(name), string(data))
+		}
+	}
+
+	return nil
+}
+
+// Base record of generation id, as tag=value pairs
+func readBaseRecord(id string) (error, map[string]string) {
+	pk, err := ioutil.ReadFile(path.Join(generationDir(id), recordFile(id, "")))
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, parseTags(string(pk))
+}
+
+// Splits a record into its tag=value pairs
+func parseTags(record string) map[string]string {
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSuffix(record, "EOM"), ",") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		}
+	}
+	return tags
+}
+
+// When generation id is signed with from; keys without a key ID always are
+func activeFrom(id string) (error, time.Time) {
+	if id == "" {
+		return nil, time.Time{}
+	}
+
+	err, generation := utils.ReadGeneration(path.Join(generationDir(id), utils.GenerationFile))
+	if err != nil {
+		return err, time.Time{}
+	}
+	return nil, generation.ActiveFrom
+}
+
+/*
+Stops publishing generation id, by renaming its directory to <id>.retired so
+neither keyforge-server nor the zone file sees it. Signatures made with it
+must have expired first: those made just before its successor became active
+name a leaf one epoch ahead, which lasts another epoch.
+*/
+func retireGeneration(id string, existing []string) error {
+	if err, _ := utils.ParseKeyID(id); err != nil {
+		return errors.New("only generations with a key ID can be retired, remove the records of older keys by hand")
+	}
+
+	index := -1
+	for i, existingID := range existing {
+		if existingID == id {
+			index = i
+		}
+	}
+
+	switch {
+	case index < 0:
+		return errors.New("no generation " + id + " in " + directory)
+	case index == len(existing)-1:
+		return errors.New(id + " is the newest generation, create its successor with -rollover first")
+	}
+
+	err, successorActive := activeFrom(existing[index+1])
+	if err != nil {
+		return err
+	}
+
+	err, tags := readBaseRecord(id)
+	if err != nil {
+		return err
+	}
+
+	err, retiring := utils.ParseTimeTree(tags["tree"])
+	if err != nil {
+		return err
+	}
+
+	if expired := successorActive.Add(2 * retiring.Epoch); time.Now().Before(expired) {
+		return fmt.Errorf("signatures made with %s last until %s, retire it after then", id, expired.Format(time.RFC3339))
+	}
+
+	return os.Rename(generationDir(id), generationDir(id)+retiredSuffix)
+}
@@ -36,17 +36,38 @@ How we're going to do this:
 	- There will be 12 of these
 	== ~49*31 = 1478 bytes
 
+Each master key is a generation with its own key ID, k1, k2 and so on, written
+to its own directory under the key directory and published under
+<key ID>._KeyForge, e.g. 202003_0.k2._KeyForge. To replace the master key,
+-rollover writes the next generation while the older ones stay published:
+keyforge-server signs with it from -activate later, and signatures name the
+key ID they were made with, so those made before keep verifying. Once they
+have expired, -retire stops publishing the old generation.
+
+Files are named for the default selector, _KeyForge. In the zone file the
+records take the configured Selector instead, that of the signer whose KeyDir
+they are in, or -selector, e.g. 202003_0.k2.mail.
+
+Records are written Horizon ahead, a year unless configured otherwise. Left
+running with -maintain, keyforge-generate writes them again whenever the
+records of the keys in use end within RenewBefore, rewrites the zone file and
+runs PublishCommand, such as keyforge-publish, to publish them. -check reports
+how far ahead they are published, for monitoring, exiting 1 when they end
+within RenewBefore.
+
 */
 package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/keyforgery/KeyForge/crypto/hibs"
@@ -63,13 +84,69 @@ const (
 	finalHelp  = `
 Success! The keys have been written to the directories you've provided. Please upload 
 these keys directly to your DNS. The files themselves have
-been named corresponding to how they should be resolved; e.g. the file named _KeyForge should
-resolve to _KeyForge.yourdomain.com.
+been named corresponding to how they should be resolved; e.g. the file named k1._KeyForge should
+resolve to k1._KeyForge.yourdomain.com, or k1.<selector>.yourdomain.com with another selector.
+
+The same records are in _KeyForge.zone, with those of every generation still
+published, ready to $INCLUDE in your zone, or to push to your nameserver with
+keyforge-publish.
+
+To sign on hosts that should not hold the master secret, export delegated keys
+with -delegate and copy only those, with the generation's public records, to
+the hosts' key directories.
+`
+	delegateHelp = `
+Copy the generation's directory, but not its private/, to the key directory of
+each signing host. keyforge-server will sign only within the delegated months.
 `
 )
 
 var directory string
 
+var (
+	selectorFlag = flag.String("selector", "", "Label the records are published under, default = Selector of the config, or of the signer whose KeyDir the keys are in")
+	zoneOrigin   = flag.String("origin", "", "Domain the records are published under, e.g. example.com; default = ZoneOrigin of the config, names relative to the including zone if empty")
+	zoneFile     = flag.String("zone", "", "Where to write the DNS zone file fragment, default = <key directory>/_KeyForge.zone")
+	jsonFile     = flag.String("json", "", "Where to write the records as a JSON list, if at all")
+	recordTTL    = flag.Int("ttl", 0, "TTL of the published records, in seconds; default = RecordTTL of the config")
+	epoch        = flag.Duration("epoch", 0, "How long each signing key lasts; must evenly divide a day; default = Epoch of the config")
+	branching    = flag.String("branching", "", "Comma separated children per sub-day tree level, e.g. 24,12; default = Branching of the config")
+	delegate     = flag.String("delegate", "", "Comma separated months, e.g. 2020-03,2020-04, to export delegated signing keys for from the existing keys, instead of generating new ones")
+	generation   = flag.String("key", "", "Key ID of the generation -delegate exports from, default = the newest")
+	rollover     = flag.Bool("rollover", false, "Generate a successor to the existing keys, which stay published")
+	activate     = flag.Duration("activate", 48*time.Hour, "How long after -rollover the new keys are signed with, so their records have reached resolvers first")
+	retire       = flag.String("retire", "", "Key ID of a generation to stop publishing, once its signatures have expired")
+	maintainer   = flag.Bool("maintain", false, "Keep running, publishing the records of the keys in use Horizon ahead whenever they end within RenewBefore")
+	checkOnly    = flag.Bool("check", false, "Report how far ahead the records of the keys in use are published, exiting 1 if they end within RenewBefore")
+)
+
+// Shape of the time tree, published alongside the public key
+var tree *utils.TimeTree
+
+// The tree shape of the config's Epoch and Branching, or the -epoch and
+// -branching flags where given
+func treeFromFlags(config *utils.Configuration) (error, *utils.TimeTree) {
+	levels := config.Branching
+
+	if *branching != "" {
+		levels = make([]int, 0)
+		for _, level := range strings.Split(*branching, ",") {
+			b, err := strconv.Atoi(strings.TrimSpace(level))
+			if err != nil {
+				return err, nil
+			}
+			levels = append(levels, b)
+		}
+	}
+
+	treeEpoch := config.Epoch.Duration
+	if *epoch != 0 {
+		treeEpoch = *epoch
+	}
+
+	return utils.NewTimeTree(treeEpoch, levels)
+}
+
 type Month struct {
 	pub  string
 	days map[int]string
@@ -119,17 +196,18 @@ func writeToPubkeyFile(filename string, input string) {
 
 	splitdata := chunkify(input, 1000)
 
-	for i, data := range splitdata {
-		currentfilename := filename + "_" + strconv.Itoa(i)
-
-		fullpath := path.Join(directory, currentfilename)
+	if filename == "" {
+		// The base record is looked up by name alone, so it can't be split
+		splitdata = []string{input}
+	}
 
+	for i, data := range splitdata {
+		node := ""
 		if filename != "" {
-			fullpath += "."
-			fullpath += pubKeyFile
-		} else {
-			fullpath = path.Join(directory, pubKeyFile)
+			node = filename + "_" + strconv.Itoa(i)
 		}
+
+		fullpath := path.Join(generationDir(keyID), recordFile(keyID, node))
 		fmt.Println(fullpath)
 
 		os.MkdirAll(filepath.Dir(fullpath), os.ModePerm)
@@ -140,8 +218,8 @@ func writeToPubkeyFile(filename string, input string) {
 }
 
 // Dump h's MSK to file
-func dumpPrivate(h hibs.GSHIBE) {
-	fullpath := path.Join(directory, "private")
+func dumpPrivate(h *hibs.GSHIBE) {
+	fullpath := path.Join(generationDir(keyID), "private")
 	fullpath = path.Join(fullpath, "private")
 
 	os.MkdirAll(filepath.Dir(fullpath), os.ModePerm)
@@ -149,16 +227,15 @@ func dumpPrivate(h hibs.GSHIBE) {
 	check(err)
 }
 
-// Collects two years worth of keys
-func collectKeys(h hibs.GSHIBE) map[int]*Year {
+// Collects the keys of every day from from until until
+func collectKeys(h *hibs.GSHIBE, from, until time.Time) map[int]*Year {
 
 	years := make(map[int]*Year)
 
-	currentDate := time.Now().UTC()
+	currentDate := from.UTC()
 	oneDay := time.Hour * 24
 
-	// Get each key for 365*2
-	for daycount := 0; daycount < 365; daycount++ {
+	for !currentDate.After(until) {
 
 		cyear, _month, cday := currentDate.Date()
 		cmonth := int(_month)
@@ -198,9 +275,7 @@ func collectKeys(h hibs.GSHIBE) map[int]*Year {
 	}
 
 	fmt.Println()
-	fmt.Println("Generated all public parameters necessary between now and", currentDate)
-	fmt.Println("This should hold you over for about a year.")
-	fmt.Println("After that date, please upload new values / update your KeyForge Keys")
+	fmt.Println("Generated all public parameters necessary between", from.UTC(), "and", until.UTC())
 	fmt.Println()
 
 	return years
@@ -210,9 +285,10 @@ func formatTagValue(tag, value string) string {
 	return fmt.Sprintf("%s=%s", tag, value)
 }
 
-// Dump various Q values to file(s)
-func dumpPublic(h hibs.GSHIBE) {
-	years := collectKeys(h)
+// Dump various Q values to file(s), for every day from from until until. The
+// base record names start as the first day its key published records for.
+func dumpPublic(h *hibs.GSHIBE, start, from, until time.Time) {
+	years := collectKeys(h, from, until)
 
 	// Write everything to the files
 	yearKeys := ""
@@ -242,31 +318,144 @@ func dumpPublic(h hibs.GSHIBE) {
 		writeToPubkeyFile(yearstr, monthKeys)
 	}
 
-	// Dump h's MPK and years to the same file
-	writeToPubkeyFile("", formatTagValue("public", h.ExportPublic())+","+yearKeys)
+	// Dump h's MPK, tree shape and years to the same file
+	base := formatTagValue("public", h.ExportPublic()) + ","
+	base += formatTagValue("tree", tree.String()) + ","
+	base += formatTagValue(utils.StartTag, start.UTC().Format(utils.StartFormat)) + ","
+	writeToPubkeyFile("", base+yearKeys)
 }
 
 func main() {
 	// Create params
 
 	// input:
-	configLoc, milterSock, kfSock, keyDir := utils.ConfigFlags()
-
-	err, config := utils.SetupConfig(configLoc, keyDir, milterSock, kfSock)
+	flags := utils.ConfigFlags()
+	flags.MayBeMissing = true
 
+	err, config := utils.LoadConfig(flags)
 	check(err)
 
+	// Leave a config for the other commands to start from, if there is none
+	if _, err := os.Stat(flags.ConfigFile()); os.IsNotExist(err) {
+		check(utils.WriteConfig(flags.ConfigFile(), config))
+		fmt.Println("config written to", flags.ConfigFile())
+	}
+
 	directory = config.KeyDirectory
 
-	fmt.Println("keyforge files will be placed in ", directory)
+	selector = config.SelectorFor(directory)
+	if *selectorFlag != "" {
+		selector = *selectorFlag
+	}
+
+	err, existing := generations()
+	check(err)
+
+	if *retire != "" {
+		check(retireGeneration(*retire, existing))
+		fmt.Println(*retire, "retired, its records are no longer in the zone file")
+
+		check(writeRecords(config))
+		return
+	}
+
+	if *checkOnly {
+		err, status := checkStatus(config)
+		check(err)
+		os.Exit(status)
+	}
+
+	if *maintainer {
+		maintain(config)
+		return
+	}
+
+	if *delegate != "" {
+		keyID = *generation
+		if keyID == "" && len(existing) > 0 {
+			keyID = existing[len(existing)-1]
+		}
+
+		check(writeDelegations(strings.Split(*delegate, ",")))
+		fmt.Print(delegateHelp)
+		return
+	}
+
+	// Overwriting the keys in use would break every signature made with them
+	if len(existing) > 0 && !*rollover {
+		fmt.Fprintln(os.Stderr, "keys already exist in", directory+"; use -rollover to generate their successor")
+		os.Exit(1)
+	}
+
+	activeFrom := time.Now()
+	if len(existing) > 0 {
+		activeFrom = activeFrom.Add(*activate)
+	}
+
+	err, keyID = nextKeyID()
+	check(err)
+	fmt.Println("keyforge files will be placed in ", generationDir(keyID))
+
+	err, tree = treeFromFlags(config)
+	check(err)
+
+	fmt.Println("signing keys will last", tree.Epoch, "with tree shape", tree)
 
 	// Setup MPK/MSK
 	var h hibs.GSHIBE
 	h.Setup()
 
 	// Dump public params
-	dumpPublic(h)
-	dumpPrivate(h)
+	from, until := publishWindow(config, time.Now())
+	dumpPublic(&h, from, from, until)
+	dumpPrivate(&h)
+	check(writeGeneration(keyID, activeFrom))
+
+	fmt.Println(keyID, "will be signed with from", activeFrom.UTC().Format(time.RFC3339))
+	fmt.Println("Run keyforge-generate -maintain to keep publishing records ahead of", until.UTC().Format(time.RFC3339)+",")
+	fmt.Println("or -check to be warned before it comes.")
+
+	check(writeRecords(config))
+
+	fmt.Print(finalHelp)
+}
+
+// Writes the records of every generation published to the zone file, and
+// the JSON list if asked
+func writeRecords(config *utils.Configuration) error {
+	err, ids := generations()
+	if err != nil {
+		return err
+	}
+
+	if err := collectRecords(ids); err != nil {
+		return err
+	}
+
+	// Dump the same records as a zone file fragment, and a JSON list if asked
+	zonePath := *zoneFile
+	if zonePath == "" {
+		zonePath = path.Join(directory, pubKeyFile+".zone")
+	}
+	origin, ttl := config.ZoneOrigin, config.RecordTTL
+	if *zoneOrigin != "" {
+		origin = *zoneOrigin
+	}
+	if *recordTTL != 0 {
+		ttl = *recordTTL
+	}
+
+	if err := writeZoneFile(zonePath, origin, ttl); err != nil {
+		return err
+	}
+	fmt.Println("zone file written to", zonePath)
+
+	if *jsonFile != "" {
+		if err := writeRecordJSON(*jsonFile, origin, ttl); err != nil {
+			return err
+		}
+		fmt.Println("record list written to", *jsonFile)
+	}
 
-	fmt.Println(finalHelp)
+	return nil
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// The days records are written for at now: from a day before, for verifiers
+// whose clocks lag, until Horizon ahead
+func publishWindow(config *utils.Configuration, now time.Time) (time.Time, time.Time) {
+	return now.Add(-24 * time.Hour), now.Add(config.Horizon.Duration)
+}
+
+// The start of the day containing t
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// The record of one tree node of generation id as tag=value pairs, joined
+// from the files it was split into. Empty when it was never written.
+func readNodeRecord(id, node string) (error, map[string]string) {
+	if node == "" {
+		return readBaseRecord(id)
+	}
+
+	record := ""
+	for i := 0; !strings.HasSuffix(record, "EOM"); i++ {
+		data, err := ioutil.ReadFile(path.Join(generationDir(id), recordFile(id, node+"_"+strconv.Itoa(i))))
+		if os.IsNotExist(err) && i == 0 {
+			return nil, map[string]string{}
+		} else if err != nil {
+			return err, nil
+		}
+		record += string(data)
+	}
+
+	return nil, parseTags(record)
+}
+
+// The first day between from and until whose records generation id has not
+// written, or the zero time if every one is there
+func firstGap(id string, from, until time.Time) (error, time.Time) {
+	nodes := make(map[string]map[string]string)
+
+	for day := startOfDay(from); !day.After(until); day = day.AddDate(0, 0, 1) {
+		year := utils.FormatYear(day.Year())
+		month := utils.FormatDig(int(day.Month()))
+
+		// The day's key is in its month's record, named in its year's, named in the base
+		for _, entry := range [][2]string{{"", year}, {year, month}, {year + month, utils.FormatDig(day.Day())}} {
+			node, tag := entry[0], entry[1]
+
+			tags, ok := nodes[node]
+			if !ok {
+				var err error
+				if err, tags = readNodeRecord(id, node); err != nil {
+					return err, time.Time{}
+				}
+				nodes[node] = tags
+			}
+
+			if _, ok := tags[tag]; !ok {
+				return nil, day
+			}
+		}
+	}
+
+	return nil, time.Time{}
+}
+
+// The generations whose records must be kept ahead at now: the one signed
+// with, and its successors. Older ones are only published until their
+// signatures have expired.
+func maintainedGenerations(ids []string, now time.Time) (error, []string) {
+	maintained := make([]string, 0)
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		maintained = append([]string{ids[i]}, maintained...)
+
+		err, active := activeFrom(ids[i])
+		if err != nil {
+			return err, nil
+		}
+		if !now.Before(active) {
+			break
+		}
+	}
+
+	return nil, maintained
+}
+
+// Removes the tree node records of generation id, leaving its base record
+func removeNodeRecords(id string) error {
+	files, err := ioutil.ReadDir(generationDir(id))
+	if err != nil {
+		return err
+	}
+
+	suffix := "." + recordFile(id, "")
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), suffix) {
+			if err := os.Remove(path.Join(generationDir(id), file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+Checks that the records of generation id are written RenewBefore ahead of
+now, and if not, rewrites them for the whole publishWindow. Records of days
+that have passed are dropped. Reports whether they were, or with checkOnly
+would have been, rewritten.
+*/
+func maintainGeneration(config *utils.Configuration, id string, now time.Time, checkOnly bool) (error, bool) {
+	from, until := publishWindow(config, now)
+	name := id
+	if name == "" {
+		name = "keys without a key ID"
+	}
+
+	err, gap := firstGap(id, now, until)
+	if err != nil {
+		return err, false
+	}
+
+	if gap.IsZero() {
+		log.Println(name, "published beyond", until.Format(time.RFC3339))
+		return nil, false
+	}
+
+	if !gap.Before(now.Add(config.RenewBefore.Duration)) {
+		log.Println(name, "published until", gap.Format(time.RFC3339))
+		return nil, false
+	}
+
+	log.Println("WARNING:", name, "published only until", gap.Format(time.RFC3339))
+	if checkOnly {
+		return nil, true
+	}
+
+	keyID = id
+	err, h, generationTree := loadKeys()
+	if err != nil {
+		return fmt.Errorf("cannot publish %s further: %v", name, err), false
+	}
+	tree = generationTree
+
+	// Expiry is still disclosed from the first records, not from the rewrite
+	err, base := readBaseRecord(id)
+	if err != nil {
+		return err, false
+	}
+	start := utils.RecordStart(base)
+	if start.IsZero() {
+		start = from
+	}
+
+	if err := removeNodeRecords(id); err != nil {
+		return err, false
+	}
+	dumpPublic(h, start, from, until)
+
+	log.Println(name, "now published until", until.Format(time.RFC3339))
+	return nil, true
+}
+
+// Runs PublishCommand, if there is one
+func runPublishCommand(config *utils.Configuration) error {
+	if config.PublishCommand == "" {
+		return nil
+	}
+
+	cmd := exec.Command("sh", "-c", config.PublishCommand)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// One pass of maintain. Reports whether records are missing within
+// RenewBefore, or with checkOnly would be.
+func maintainOnce(config *utils.Configuration, checkOnly bool) (error, bool) {
+	err, ids := generations()
+	if err != nil {
+		return err, false
+	}
+
+	err, maintained := maintainedGenerations(ids, time.Now())
+	if err != nil {
+		return err, false
+	}
+
+	if len(maintained) == 0 {
+		return fmt.Errorf("no keys in %s", directory), false
+	}
+
+	changed := false
+	for _, id := range maintained {
+		err, rewritten := maintainGeneration(config, id, time.Now(), checkOnly)
+		if err != nil {
+			return err, changed
+		}
+		changed = changed || rewritten
+	}
+
+	if changed && !checkOnly {
+		return writeRecords(config), true
+	}
+
+	return nil, changed
+}
+
+// The exit status of -check: 1 when the records of the keys in use end
+// within RenewBefore, changing nothing
+func checkStatus(config *utils.Configuration) (error, int) {
+	err, missing := maintainOnce(config, true)
+	if err != nil {
+		return err, 1
+	}
+	if missing {
+		return nil, 1
+	}
+	return nil, 0
+}
+
+/*
+Keeps the records of the keys in use published ahead, checking every
+MaintainEvery: once they end within RenewBefore, they are written again
+Horizon ahead, with the zone file, and PublishCommand is run to publish them,
+until it succeeds.
+*/
+func maintain(config *utils.Configuration) {
+	unpublished := false
+	for {
+		err, changed := maintainOnce(config, false)
+		if err != nil {
+			log.Println("ERROR:", err)
+		}
+
+		if changed || unpublished {
+			if err := runPublishCommand(config); err != nil {
+				log.Println("ERROR: publishing failed, retrying in", config.MaintainEvery.Duration, err)
+				unpublished = true
+			} else {
+				unpublished = false
+			}
+		}
+
+		time.Sleep(config.MaintainEvery.Duration)
+	}
+}
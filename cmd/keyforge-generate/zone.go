@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Longest character-string a TXT record may hold (RFC 1035 3.3)
+const maxCharacterString = 255
+
+// A TXT record as it should be published, named relative to the origin
+type TXTRecord struct {
+	Name  string
+	Value string
+}
+
+// Every record published, in the order collectRecords read them
+var records []TXTRecord
+
+func addRecord(name, value string) {
+	records = append(records, TXTRecord{name, value})
+}
+
+// Records sorted by name, so the output is stable between runs
+func sortedRecords() []TXTRecord {
+	sorted := append([]TXTRecord(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// Splits a value into the character-strings of a single TXT record. Resolvers
+// join these back together, so the split points don't matter.
+func splitCharacterStrings(value string) []string {
+	parts := make([]string, 0, len(value)/maxCharacterString+1)
+
+	for len(value) > maxCharacterString {
+		parts = append(parts, value[:maxCharacterString])
+		value = value[maxCharacterString:]
+	}
+
+	return append(parts, value)
+}
+
+func quoteCharacterString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+// Makes origin fully qualified, e.g. example.com -> example.com.
+func fqdn(origin string) string {
+	if origin == "" || strings.HasSuffix(origin, ".") {
+		return origin
+	}
+	return origin + "."
+}
+
+// Formats the records as an RFC 1035 master file fragment. With an origin the
+// fragment sets $ORIGIN itself, otherwise names are relative to whichever zone
+// $INCLUDEs it.
+func formatZone(origin string, ttl int) string {
+	var b strings.Builder
+
+	b.WriteString("; KeyForge public parameters, generated by keyforge-generate\n")
+	if origin != "" {
+		fmt.Fprintf(&b, "$ORIGIN %s\n", fqdn(origin))
+	}
+
+	for _, record := range sortedRecords() {
+		quoted := make([]string, 0)
+		for _, part := range splitCharacterStrings(record.Value) {
+			quoted = append(quoted, quoteCharacterString(part))
+		}
+
+		fmt.Fprintf(&b, "%s\t%d\tIN\tTXT\t%s\n", record.Name, ttl, strings.Join(quoted, " "))
+	}
+
+	return b.String()
+}
+
+func writeZoneFile(filename, origin string, ttl int) error {
+	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+	return ioutil.WriteFile(filename, []byte(formatZone(origin, ttl)), 0644)
+}
+
+// A record as most DNS provider APIs want it
+type jsonRecord struct {
+	Name    string   `json:"name"` // fully qualified when an origin is given
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	Value   string   `json:"value"`   // the whole value
+	Strings []string `json:"strings"` // value split into character-strings
+}
+
+func writeRecordJSON(filename, origin string, ttl int) error {
+	list := make([]jsonRecord, 0)
+
+	for _, record := range sortedRecords() {
+		name := record.Name
+		if origin != "" {
+			name += "." + fqdn(origin)
+		}
+
+		list = append(list, jsonRecord{name, "TXT", ttl, record.Value, splitCharacterStrings(record.Value)})
+	}
+
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+	return ioutil.WriteFile(filename, b, 0644)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/keyserver"
+	"github.com/keyforgery/KeyForge/sigheader"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// Answers lookups from the records keyforge-generate would publish for h
+type testCache struct {
+	h *hibs.GSHIBE
+}
+
+func (c testCache) GetTreeFromDNS(dns string) (error, *utils.TimeTree) {
+	return nil, &utils.DefaultTree
+}
+
+func (c testCache) GetPublicFromDNS(dns string, path []string) (error, string, []string) {
+	public := make([]string, 0, len(path))
+	for i := range path {
+		public = append(public, c.h.ExtractPath(path[:i+1]).Params())
+	}
+	return nil, c.h.ExportPublic(), public
+}
+
+func testFilter() *KeyForgeFilter {
+	var h hibs.GSHIBE
+	h.Setup()
+	keyserver.H = &h
+	keyserver.Tree = &utils.DefaultTree
+
+	return &KeyForgeFilter{
+		Server:   &keyserver.Server{DNS: "_KeyForge.example.com", Cache: testCache{&h}},
+		Domain:   "example.com",
+		Selector: "_KeyForge",
+	}
+}
+
+// The MTA end of a milter connection
+type testMTA struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startMilter(t *testing.T, filter Filter) *testMTA {
+	mta, milter := net.Pipe()
+	go serveMilter(milter, filter)
+	t.Cleanup(func() { mta.Close() })
+
+	mta.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testMTA{t, mta, bufio.NewReader(mta)}
+}
+
+func (m *testMTA) send(cmd byte, data ...string) {
+	payload := cStringsBytes(data...)
+	switch cmd {
+	case cmdBody, cmdOptNeg:
+		payload = []byte(strings.Join(data, ""))
+	case cmdMacro:
+		// The command the macros are for, then the name value pairs
+		payload = append([]byte(data[0]), cStringsBytes(data[1:]...)...)
+	}
+
+	packet := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)))
+	packet[4] = cmd
+	copy(packet[5:], payload)
+
+	if _, err := m.conn.Write(packet); err != nil {
+		m.t.Fatal(err)
+	}
+}
+
+func (m *testMTA) receive() (byte, []string) {
+	var length uint32
+	if err := binary.Read(m.r, binary.BigEndian, &length); err != nil {
+		m.t.Fatal(err)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(m.r, packet); err != nil {
+		m.t.Fatal(err)
+	}
+
+	if packet[0] == respChgHeader {
+		return packet[0], cStrings(packet[5:])
+	}
+	return packet[0], cStrings(packet[1:])
+}
+
+func (m *testMTA) expect(code byte) []string {
+	got, data := m.receive()
+	if got != code {
+		m.t.Fatalf("Expected reply %c, got %c %v", code, got, data)
+	}
+	return data
+}
+
+func (m *testMTA) negotiate() {
+	options := make([]byte, 12)
+	binary.BigEndian.PutUint32(options[0:], 6)
+	binary.BigEndian.PutUint32(options[4:], 0x1ff)
+	binary.BigEndian.PutUint32(options[8:], 0x1fffff)
+
+	m.send(cmdOptNeg, string(options))
+	m.expect(respOptNeg)
+}
+
+// Sends a whole message and returns the headers added to it
+func (m *testMTA) message(macros []string, headers []Header, body string) (added []Header, removed []string) {
+	m.send(cmdMacro, append([]string{"M"}, macros...)...)
+	m.send(cmdMail, "<alice@example.com>")
+	m.expect(respContinue)
+
+	for _, h := range headers {
+		m.send(cmdHeader, h.Name, h.Value)
+		m.expect(respContinue)
+	}
+
+	m.send(cmdEndOfHdrs)
+	m.expect(respContinue)
+
+	m.send(cmdBody, body)
+	m.expect(respContinue)
+
+	m.send(cmdEndOfBody)
+	for {
+		code, data := m.receive()
+		switch code {
+		case respAddHeader:
+			added = append(added, Header{data[0], data[1]})
+		case respChgHeader:
+			removed = append(removed, data[0])
+		case respContinue:
+			return
+		default:
+			m.t.Fatalf("Unexpected reply %c", code)
+		}
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	f := testFilter()
+	mta := startMilter(t, f.Filter)
+	mta.negotiate()
+
+	headers := []Header{
+		{"From", "alice@example.com"},
+		{"To", "bob@example.org"},
+		{"Subject", "deniable"},
+		{"KeyForge-Result", "pass"},
+	}
+	body := "Hello Bob\r\n"
+
+	added, _ := mta.message([]string{"{auth_authen}", "alice"}, headers, body)
+	if len(added) != 1 || added[0].Name != SignatureHeader {
+		t.Fatal("Submitted mail was not signed", added)
+	}
+
+	// The same message arriving at the recipient
+	signed := append(headers, added[0])
+
+	added, removed := mta.message(nil, signed, body)
+	if len(added) != 1 || added[0].Name != ResultHeader || strings.TrimSpace(added[0].Value) != "pass (d=example.com)" {
+		t.Log("Signed mail did not verify", added)
+		t.Fail()
+	}
+
+	if len(removed) != 1 || removed[0] != ResultHeader {
+		t.Log("Forged result header was not removed", removed)
+		t.Fail()
+	}
+
+	// Any change to the body or the signed headers fails
+	added, _ = mta.message(nil, signed, body+"P.S.\r\n")
+	if len(added) != 1 || !strings.HasPrefix(strings.TrimSpace(added[0].Value), "fail") {
+		t.Log("Changed mail verified", added)
+		t.Fail()
+	}
+
+	// Relays may refold and respace headers
+	signed[1].Value = "  bob@example.org\n\t"
+	added, _ = mta.message(nil, signed, body)
+	if len(added) != 1 || strings.TrimSpace(added[0].Value) != "pass (d=example.com)" {
+		t.Log("Mail with a refolded header did not verify", added)
+		t.Fail()
+	}
+
+	// But no second Subject may be added
+	added, _ = mta.message(nil, append(signed, Header{"Subject", "deniable?"}), body)
+	if len(added) != 1 || !strings.HasPrefix(strings.TrimSpace(added[0].Value), "fail") {
+		t.Log("Mail with an added subject verified", added)
+		t.Fail()
+	}
+
+	signed[2].Value = "not deniable"
+	added, _ = mta.message(nil, signed, body)
+	if len(added) != 1 || !strings.HasPrefix(strings.TrimSpace(added[0].Value), "fail") {
+		t.Log("Mail with a changed subject verified", added)
+		t.Fail()
+	}
+
+	mta.send(cmdQuit)
+}
+
+func TestMisalignedFrom(t *testing.T) {
+	// Without Signers every message is signed for the filter's Domain,
+	// whatever its From
+	mta := startMilter(t, testFilter().Filter)
+	mta.negotiate()
+
+	for from, result := range map[string]string{
+		"mallory@example.net":       "policy (d=example.com does not match From)",
+		"mallory@notexample.com":    "policy (d=example.com does not match From)",
+		"alice@mail.EXAMPLE.com":    "pass (d=example.com)",
+		"Alice <alice@example.com>": "pass (d=example.com)",
+	} {
+		headers := []Header{{"From", from}, {"Subject", "spoofed"}}
+		added, _ := mta.message([]string{"{auth_authen}", "mallory"}, headers, "hi\r\n")
+		if len(added) != 1 {
+			t.Fatal("Mail was not signed", added)
+		}
+
+		added, _ = mta.message(nil, append(headers, added[0]), "hi\r\n")
+		if len(added) != 1 || strings.TrimSpace(added[0].Value) != result {
+			t.Log("Mail from", from, "signed by example.com resulted in", added, "rather than", result)
+			t.Fail()
+		}
+	}
+}
+
+func TestUnsignedMail(t *testing.T) {
+	mta := startMilter(t, testFilter().Filter)
+	mta.negotiate()
+
+	added, _ := mta.message(nil, []Header{{"From", "carol@example.net"}}, "hi\r\n")
+	if len(added) != 0 {
+		t.Log("Headers added to unsigned mail", added)
+		t.Fail()
+	}
+}
+
+func TestSignerByDomain(t *testing.T) {
+	f := testFilter()
+
+	// Both domains share keys, which testCache publishes under any name
+	signers := make(map[string]*keyserver.Signer)
+	for domain, selector := range map[string]string{"example.com": "_KeyForge", "example.org": "mail"} {
+		signers[domain] = &keyserver.Signer{Domain: domain, Selector: selector, HIBE: keyserver.H, Tree: keyserver.Tree}
+	}
+	f.Server.Signers = signers
+
+	mta := startMilter(t, f.Filter)
+	mta.negotiate()
+
+	headers := []Header{{"From", "Bob <bob@Example.org>"}, {"Subject", "hi"}}
+	added, _ := mta.message([]string{"{auth_authen}", "bob"}, headers, "hi\r\n")
+	if len(added) != 1 {
+		t.Fatal("Mail from a signed domain was not signed", added)
+	}
+
+	err, sig := sigheader.Parse(added[0].Value)
+	if err != nil || sig.Domain != "example.org" || sig.Selector != "mail" {
+		t.Log("Signed with the wrong domain", err, sig)
+		t.Fail()
+	}
+
+	added, _ = mta.message(nil, append(headers, added[0]), "hi\r\n")
+	if len(added) != 1 || strings.TrimSpace(added[0].Value) != "pass (d=example.org)" {
+		t.Log("Signed mail did not verify", added)
+		t.Fail()
+	}
+
+	// Nothing is signed for other domains
+	added, _ = mta.message([]string{"{auth_authen}", "eve"}, []Header{{"From", "eve@example.net"}}, "hi\r\n")
+	if len(added) != 0 {
+		t.Log("Signed mail from a domain without keys", added)
+		t.Fail()
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	f := testFilter()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	err, audit := keyserver.OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	f.Server.Audit = audit
+
+	mta := startMilter(t, f.Filter)
+	mta.negotiate()
+
+	added, _ := mta.message([]string{"{auth_authen}", "alice"}, []Header{{"From", "alice@example.com"}}, "hi\r\n")
+	if len(added) != 1 {
+		t.Fatal("Mail was not signed", added)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var record keyserver.AuditRecord
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &record) != nil || record.Domain != "example.com" {
+		t.Log("Signature not audited", string(contents))
+		t.Fail()
+	}
+}
+
+func TestServeDrains(t *testing.T) {
+	f := testFilter()
+
+	for _, timeout := range []time.Duration{10 * time.Second, 50 * time.Millisecond} {
+		l, err := listen(filepath.Join(t.TempDir(), "kf.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ended := make(chan bool)
+		go func() { ended <- serve(l, f.Filter, timeout) }()
+
+		conn, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mta := &testMTA{t, conn, bufio.NewReader(conn)}
+		mta.negotiate()
+
+		// Open sessions are waited for, up to the timeout
+		l.Close()
+		select {
+		case drained := <-ended:
+			if drained || timeout > time.Second {
+				t.Log("Returned with a session open", drained, timeout)
+				t.Fail()
+			}
+			conn.Close()
+			continue
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		// The session ending lets it return
+		conn.Close()
+		if !<-ended || timeout < time.Second {
+			t.Log("Did not wait for the session", timeout)
+			t.Fail()
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	f := testFilter()
+
+	for offered, agreed := range map[uint32]uint32{1: 0, 2: 2, 4: 4, 6: 6, 7: 6} {
+		mta := startMilter(t, f.Filter)
+
+		options := make([]byte, 12)
+		binary.BigEndian.PutUint32(options[0:], offered)
+		binary.BigEndian.PutUint32(options[4:], 0x1ff)
+		binary.BigEndian.PutUint32(options[8:], 0x1fffff)
+		mta.send(cmdOptNeg, string(options))
+
+		// Too old, so the connection is dropped
+		if agreed == 0 {
+			if _, err := mta.r.ReadByte(); err != io.EOF {
+				t.Log("Accepted version", offered, err)
+				t.Fail()
+			}
+			continue
+		}
+
+		// The reply's options are binary, so read it whole
+		reply := make([]byte, 4+1+12)
+		if _, err := io.ReadFull(mta.r, reply); err != nil || reply[4] != respOptNeg {
+			t.Fatal("No options in reply", err, reply)
+		}
+		if got := binary.BigEndian.Uint32(reply[5:]); got != agreed {
+			t.Log("Offered version", offered, "agreed to", got)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+
+	"github.com/keyforgery/KeyForge/canonical"
+	"github.com/keyforgery/KeyForge/keyserver"
+	"github.com/keyforgery/KeyForge/sigheader"
+)
+
+const (
+	// Carries the signature, see package sigheader
+	SignatureHeader = sigheader.HeaderName
+	// Added to incoming mail with the outcome of verification
+	ResultHeader = "KeyForge-Result"
+)
+
+// Headers covered by a signature, in the order they are hashed
+var SigFields = []string{
+	"from",
+	"to",
+	"cc",
+	"content-type",
+	"content-transfer-encoding",
+	"mime-version",
+	"date",
+	"references",
+	"reply-to",
+	"message-id",
+	"subject",
+}
+
+// Headers signed once more than they occur, so another cannot be added
+var OverSigned = []string{"from", "subject"}
+
+// How we canonicalize the mail we sign
+var SignCanonicalization = canonical.Canonicalization{Header: canonical.Relaxed, Body: canonical.Relaxed}
+
+// Signs mail from authenticated users and verifies everything else
+type KeyForgeFilter struct {
+	Server   *keyserver.Server
+	Domain   string // d= of our signatures, when Server has no Signers
+	Selector string // s= of our signatures, when Server has no Signers
+}
+
+func canonicalHeaders(m *Message) []canonical.Header {
+	headers := make([]canonical.Header, 0, len(m.Headers))
+	for _, h := range m.Headers {
+		headers = append(headers, canonical.Header{Name: h.Name, Value: h.Value})
+	}
+	return headers
+}
+
+func (f *KeyForgeFilter) Filter(m *Message) Changes {
+	// A result header is only trusted if we added it
+	changes := Changes{Remove: []string{ResultHeader}}
+
+	if m.Oversized {
+		keyserver.Logger.Warn("message too large, passed along untouched", "from", m.From)
+		return changes
+	}
+
+	// Authenticated users are submitting mail, which we sign
+	if m.Macros["{auth_authen}"] != "" {
+		if value, ok := f.sign(m); ok {
+			changes.Add = append(changes.Add, Header{SignatureHeader, value})
+		}
+		return changes
+	}
+
+	if len(m.Header(SignatureHeader)) > 0 {
+		changes.Add = append(changes.Add, Header{ResultHeader, " " + f.verify(m)})
+	}
+
+	return changes
+}
+
+// The address m is from: that of its From header, or else the envelope's
+func sender(m *Message) string {
+	if from := m.Header("from"); len(from) > 0 {
+		if address, err := mail.ParseAddress(strings.Replace(from[0], "\r\n", "", -1)); err == nil {
+			return address.Address
+		}
+	}
+	return m.From
+}
+
+// Returns the signature header for m
+func (f *KeyForgeFilter) sign(m *Message) (string, bool) {
+	// The keys of the sender's domain, which d=, s= and k= name
+	from := sender(m)
+	err, signer := f.Server.SignerFor(from)
+	if err != nil {
+		keyserver.Logger.Info("not signing message", "from", from, "error", err)
+		return "", false
+	}
+
+	domain, selector := signer.Domain, signer.Selector
+	if domain == "" {
+		domain, selector = f.Domain, f.Selector
+	}
+
+	fields := make([]string, 0)
+	for _, field := range SigFields {
+		if len(m.Header(field)) > 0 {
+			fields = append(fields, field)
+		}
+	}
+	fields = append(fields, OverSigned...)
+
+	c := SignCanonicalization
+	_, bodyHash := canonical.BodyHash(c.Body, m.Body.Bytes(), -1)
+
+	sig := sigheader.Signature{
+		Version:          sigheader.Version,
+		Algorithm:        sigheader.Algorithm,
+		Canonicalization: c,
+		Domain:           domain,
+		Selector:         selector,
+		KeyID:            signer.KeyID,
+		TreeVersion:      signer.Tree.Version,
+		Headers:          fields,
+		BodyHash:         bodyHash,
+		BodyLength:       -1,
+	}
+
+	digest := canonical.Digest(c.Header, canonicalHeaders(m), fields,
+		canonical.Header{Name: SignatureHeader, Value: sig.Unsigned()})
+
+	var reply keyserver.SigReply
+	// With the keys k= names, even if another generation became active since
+	args := keyserver.SigArgs{Sha256: digest, SenderEmailAddress: from, KeyID: signer.KeyID}
+	if err := f.Server.Sign(&args, &reply); err != nil || !reply.Success {
+		keyserver.Logger.Error("cannot sign message", "from", m.From, "error", err, "reply", reply.Error)
+		return "", false
+	}
+
+	// The leaf and signature, from the header the server built
+	sig.TreeVersion = reply.Header.TreeVersion
+	sig.Path = reply.Header.Path
+	sig.QValues = reply.Header.QValues
+	sig.Sig = reply.Header.Sig
+
+	return sig.Fold(), true
+}
+
+// Returns the result header for m
+func (f *KeyForgeFilter) verify(m *Message) string {
+	header := m.Header(SignatureHeader)[0]
+	err, sig := sigheader.Parse(header)
+	if err != nil {
+		return "permerror (" + err.Error() + ")"
+	}
+
+	c := sig.Canonicalization
+	if err, bodyHash := canonical.BodyHash(c.Body, m.Body.Bytes(), sig.BodyLength); err != nil || bodyHash != sig.BodyHash {
+		return "fail (body changed)"
+	}
+
+	digest := canonical.Digest(c.Header, canonicalHeaders(m), sig.Headers,
+		canonical.Header{Name: SignatureHeader, Value: sig.Unsigned()})
+
+	args := keyserver.VerifyArgs{
+		Sha256:             digest,
+		SenderEmailAddress: m.From,
+		Header:             header,
+	}
+
+	var reply keyserver.VerifyReply
+	if err := f.Server.Verify(args, &reply); err != nil {
+		return "temperror (" + err.Error() + ")"
+	}
+
+	switch {
+	case reply.Answer && !aligned(sig.Domain, sender(m)):
+		// Signed, but by a domain the mail does not claim to be from
+		return "policy (" + signedBy(sig) + " does not match From)"
+	case reply.Answer:
+		return "pass (" + signedBy(sig) + ")"
+	case reply.IsExpired:
+		return "none (expired)"
+	case reply.ErrorCode == keyserver.ErrorTimeout || reply.ErrorCode == keyserver.ErrorServerFailure:
+		return "temperror (" + string(reply.ErrorCode) + ")"
+	case reply.ErrorCode != keyserver.ErrorNone:
+		return "permerror (" + string(reply.ErrorCode) + ")"
+	}
+
+	return "fail"
+}
+
+// The domain of an email address, lower case
+func addressDomain(address string) string {
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// Whether a signature by domain vouches for mail from address: its domain is
+// domain, or one under it
+func aligned(domain, address string) bool {
+	from := addressDomain(address)
+	domain = strings.ToLower(domain)
+	return from == domain || strings.HasSuffix(from, "."+domain)
+}
+
+// Names the keys sig was made with, for the result header
+func signedBy(sig *sigheader.Signature) string {
+	if sig.KeyID != "" {
+		return "d=" + sig.Domain + " k=" + sig.KeyID
+	}
+	return "d=" + sig.Domain
+}
@@ -0,0 +1,201 @@
+/*
+keyforge-milter
+
+keyforge-milter is a mail filter for Postfix or Sendmail. It signs mail
+submitted by authenticated users with a KeyForge-Signature header, and
+verifies the KeyForge-Signature of all other mail, recording the outcome in a
+KeyForge-Result header. Signing and verification happen in-process, so no
+keyforge-server is needed alongside it.
+
+A valid signature only passes when its d= is the domain of the From address
+or a parent of it, e.g. "pass (d=example.com k=k2)". Signatures by any other
+domain result in "policy".
+
+Mail is signed with the keys of the sender's domain, from the Signers of the
+configuration, or its Domain, Selector and KeyDir when only one domain is
+signed for.
+
+It listens on the configured MilterPipeLocation, given as a socket path or in
+the MTA's notation:
+
+	unix:/var/spool/postfix/kf/kf.sock
+	inet:8891@127.0.0.1
+
+For Postfix, add the same address to smtpd_milters, e.g.
+
+	smtpd_milters = unix:/kf/kf.sock
+
+Like keyforge-server, it logs JSON to stderr at LogLevel and records every
+signature issued in AuditLog. SIGHUP reopens AuditLog after it was rotated.
+SIGTERM stops taking connections from the MTA and waits up to ShutdownTimeout
+for those open to end before exiting.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/keyforgery/KeyForge/keyserver"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+func check(e error, message string) {
+	if e != nil {
+		fmt.Fprintln(os.Stderr, message, e)
+		os.Exit(1)
+	}
+}
+
+// Logs as JSON to stderr, at the configured level. What is logged with the
+// log package goes there too.
+func setupLogging(config *utils.Configuration) error {
+	level := slog.LevelInfo
+	if config.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			return err
+		}
+	}
+
+	keyserver.Logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(keyserver.Logger)
+	return nil
+}
+
+// Listens on a milter address: a path, unix:<path>, local:<path> or
+// inet:<port>@<host>
+func listen(address string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "inet:"), strings.HasPrefix(address, "inet6:"):
+		spec := address[strings.Index(address, ":")+1:]
+		port, host := spec, ""
+		if at := strings.Index(spec, "@"); at >= 0 {
+			port, host = spec[:at], spec[at+1:]
+		}
+		return net.Listen("tcp", net.JoinHostPort(host, port))
+
+	case strings.HasPrefix(address, "unix:"), strings.HasPrefix(address, "local:"):
+		address = address[strings.Index(address, ":")+1:]
+	}
+
+	// A socket left behind by an earlier run would stop us listening
+	if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+
+	return net.Listen("unix", address)
+}
+
+// Serves the MTA's connections to l until it is closed, then waits up to
+// timeout for those open to end. Whether they all did.
+func serve(l net.Listener, filter Filter, timeout time.Duration) bool {
+	var sessions sync.WaitGroup
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		check(err, "fail! Cannot accept from the MTA!")
+
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			if err := serveMilter(conn, filter); err != nil {
+				keyserver.Logger.Warn("milter connection failed", "error", err)
+			}
+		}()
+	}
+
+	ended := make(chan struct{})
+	go func() {
+		sessions.Wait()
+		close(ended)
+	}()
+
+	select {
+	case <-ended:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func main() {
+	flags := utils.ConfigFlags()
+
+	err, config := utils.LoadConfig(flags)
+	check(err, "fail! Cannot read config!")
+	check(setupLogging(config), "fail! Cannot parse LogLevel!")
+
+	configs := config.SignerConfigs()
+	if len(configs) == 0 {
+		check(fmt.Errorf("no Domain or Signers in %s", flags.ConfigFile()), "fail! Don't know which domain to sign for!")
+	}
+
+	// Load the keys of each domain we sign for
+	err, signers := keyserver.LoadSigners(configs)
+	check(err, "fail! Cannot load signing keys!")
+
+	// Pick where verification looks up public parameters
+	err, cache := keyserver.NewConfiguredDNSCache(config)
+	check(err, "fail! Cannot parse DNS resolver!")
+
+	filter := KeyForgeFilter{
+		Server: &keyserver.Server{
+			Signers: signers,
+			Cache:   cache,
+		},
+	}
+
+	// Record every signature issued
+	if config.AuditLog != "" {
+		err, filter.Server.Audit = keyserver.OpenAuditLog(config.AuditLog)
+		check(err, "fail! Cannot open the audit log!")
+	}
+
+	l, err := listen(config.MilterMTAPipe)
+	check(err, "fail! Cannot listen for the MTA!")
+
+	// Handle the case that the process is sigterm'd, or its audit log rotated
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func(ln net.Listener, c chan os.Signal) {
+		for sig := range c {
+			if sig == syscall.SIGHUP {
+				if audit := filter.Server.Audit; audit != nil {
+					if err := audit.Reopen(); err != nil {
+						keyserver.Logger.Error("cannot reopen the audit log", "path", audit.Path, "error", err)
+					}
+				}
+				continue
+			}
+
+			// Closing the listener removes the socket file, and ends serve
+			keyserver.Logger.Info("shutting down", "signal", sig.String())
+			ln.Close()
+			return
+		}
+	}(l, sigc)
+
+	for domain := range signers {
+		keyserver.Logger.Info("signing", "domain", domain)
+	}
+	keyserver.Logger.Info("listening for the MTA", "address", config.MilterMTAPipe)
+
+	if !serve(l, filter.Filter, config.ShutdownTimeout.Duration) {
+		keyserver.Logger.Warn("MTA connections still open")
+	}
+	if filter.Server.Audit != nil {
+		filter.Server.Audit.Close()
+	}
+}
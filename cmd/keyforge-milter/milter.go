@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// The parts of the Sendmail milter protocol (version 6) that KeyForge needs.
+// Postfix speaks the same protocol.
+
+// Commands from the MTA
+const (
+	cmdAbort      = 'A'
+	cmdBody       = 'B'
+	cmdConnect    = 'C'
+	cmdMacro      = 'D'
+	cmdEndOfBody  = 'E'
+	cmdHelo       = 'H'
+	cmdQuitNewCon = 'K'
+	cmdHeader     = 'L'
+	cmdMail       = 'M'
+	cmdEndOfHdrs  = 'N'
+	cmdOptNeg     = 'O'
+	cmdQuit       = 'Q'
+	cmdRcpt       = 'R'
+	cmdData       = 'T'
+	cmdUnknown    = 'U'
+)
+
+// Replies to the MTA
+const (
+	respAddHeader = 'h'
+	respChgHeader = 'm'
+	respContinue  = 'c'
+	respOptNeg    = 'O'
+)
+
+const (
+	// The newest version of the protocol we speak, and the oldest
+	milterVersion    = 6
+	minMilterVersion = 2
+
+	// Actions we may take at the end of a message
+	actAddHeaders = 0x01
+	actChgHeaders = 0x10
+
+	// Steps we don't need to hear about
+	protoNoConnect = 0x01
+	protoNoHelo    = 0x02
+	protoNoRcpt    = 0x08
+	protoNoUnknown = 0x100
+	protoNoData    = 0x200
+	protoLeadSpace = 0x100000 // header values are sent with their leading space
+
+	// Largest packet accepted from the MTA; body chunks are at most 64KiB
+	maxPacket = 1 << 20
+	// Messages larger than this are passed along untouched
+	MaxMessageSize = 32 << 20
+)
+
+// A header field. Value is everything after the colon, as in the message:
+// the leading space and any folding, with CRLF line endings, included.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// A message as it was received from the MTA
+type Message struct {
+	Macros    map[string]string // e.g. {auth_authen}
+	From      string            // envelope sender
+	Headers   []Header          // in the order received
+	Body      bytes.Buffer
+	Oversized bool // Body was dropped for exceeding MaxMessageSize
+}
+
+// Occurrences of a header with name, case insensitively
+func (m *Message) Header(name string) []string {
+	values := make([]string, 0)
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
+
+// What to change in a message before it continues
+type Changes struct {
+	Add    []Header
+	Remove []string // every occurrence of these headers is deleted
+}
+
+// Decides the changes to a message once all of it has been received
+type Filter func(m *Message) Changes
+
+// One connection from the MTA, which may carry several messages
+type session struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	filter Filter
+	macros map[byte]map[string]string // by the command they were sent for
+	msg    *Message
+
+	// Whether the MTA keeps the space after a header's colon in its value
+	leadSpace bool
+}
+
+// Serves one MTA connection until it quits
+func serveMilter(conn net.Conn, filter Filter) error {
+	defer conn.Close()
+
+	s := session{conn: conn, r: bufio.NewReader(conn), filter: filter}
+	s.reset()
+
+	for {
+		cmd, data, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		quit, err := s.handle(cmd, data)
+		if err != nil || quit {
+			return err
+		}
+	}
+}
+
+// Forgets everything about the current connection
+func (s *session) reset() {
+	s.macros = make(map[byte]map[string]string)
+	s.msg = nil
+}
+
+// Forgets the current message, and the macros sent for it
+func (s *session) resetMessage() {
+	for cmd := range s.macros {
+		if cmd != cmdConnect && cmd != cmdHelo {
+			delete(s.macros, cmd)
+		}
+	}
+	s.msg = nil
+}
+
+func (s *session) message() *Message {
+	if s.msg == nil {
+		s.msg = &Message{}
+	}
+	return s.msg
+}
+
+func (s *session) read() (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(s.r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+
+	if length == 0 || length > maxPacket {
+		return 0, nil, errors.New("milter packet of bad length")
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(s.r, packet); err != nil {
+		return 0, nil, err
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+func (s *session) write(code byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = code
+	copy(packet[5:], data)
+
+	_, err := s.conn.Write(packet)
+	return err
+}
+
+// Splits data into its NUL terminated strings
+func cStrings(data []byte) []string {
+	strs := strings.Split(string(data), "\x00")
+	if len(strs) > 0 && strs[len(strs)-1] == "" {
+		strs = strs[:len(strs)-1]
+	}
+	return strs
+}
+
+func cStringsBytes(strs ...string) []byte {
+	var buf bytes.Buffer
+	for _, s := range strs {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// Handles one command, replying if the protocol calls for it
+func (s *session) handle(cmd byte, data []byte) (quit bool, err error) {
+	switch cmd {
+	case cmdOptNeg:
+		return false, s.negotiate(data)
+
+	case cmdMacro:
+		// The first byte is the command the macros are for
+		if len(data) > 0 {
+			if data[0] == cmdMail {
+				// A new message begins
+				s.resetMessage()
+			}
+
+			macros := make(map[string]string)
+			strs := cStrings(data[1:])
+			for i := 0; i+1 < len(strs); i += 2 {
+				macros[strs[i]] = strs[i+1]
+			}
+			s.macros[data[0]] = macros
+		}
+		return false, nil
+
+	case cmdMail:
+		if strs := cStrings(data); len(strs) > 0 {
+			s.message().From = strings.Trim(strs[0], "<>")
+		}
+
+	case cmdHeader:
+		strs := cStrings(data)
+		if len(strs) >= 1 {
+			h := Header{Name: strs[0]}
+			if len(strs) >= 2 {
+				h.Value = toCRLF(strs[1])
+			}
+			if !s.leadSpace {
+				// Most likely what it was
+				h.Value = " " + h.Value
+			}
+			s.message().Headers = append(s.message().Headers, h)
+		}
+
+	case cmdBody:
+		s.body(data)
+
+	case cmdEndOfBody:
+		s.body(data)
+		return false, s.endOfMessage()
+
+	case cmdAbort:
+		// The current message is abandoned, the connection carries on
+		s.resetMessage()
+		return false, nil
+
+	case cmdQuitNewCon:
+		s.reset()
+		return false, nil
+
+	case cmdQuit:
+		return true, nil
+
+	case cmdConnect, cmdHelo, cmdRcpt, cmdData, cmdUnknown, cmdEndOfHdrs:
+		// Nothing to do until the body is over
+
+	default:
+		return true, errors.New("unknown milter command " + string(cmd))
+	}
+
+	return false, s.write(respContinue, nil)
+}
+
+// The MTA folds header values with bare LFs
+func toCRLF(value string) string {
+	return strings.Replace(strings.Replace(value, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+func (s *session) body(chunk []byte) {
+	m := s.message()
+	if m.Body.Len()+len(chunk) > MaxMessageSize {
+		m.Oversized = true
+		m.Body.Reset()
+	}
+	if !m.Oversized {
+		m.Body.Write(chunk)
+	}
+}
+
+func (s *session) negotiate(data []byte) error {
+	if len(data) < 12 {
+		return errors.New("short option negotiation")
+	}
+
+	version := binary.BigEndian.Uint32(data[0:])
+	actions := binary.BigEndian.Uint32(data[4:])
+	protocol := binary.BigEndian.Uint32(data[8:])
+
+	if version < minMilterVersion {
+		return fmt.Errorf("milter protocol version %d too old", version)
+	}
+
+	// Speak the older version, if that is what the MTA offers
+	if version > milterVersion {
+		version = milterVersion
+	}
+
+	if actions&(actAddHeaders|actChgHeaders) != actAddHeaders|actChgHeaders {
+		return errors.New("MTA does not allow adding and changing headers")
+	}
+
+	// Skip the steps we ignore, where the MTA allows it
+	want := uint32(protoNoConnect | protoNoHelo | protoNoRcpt | protoNoUnknown | protoNoData)
+
+	// Simple canonicalization needs header values exactly as they are
+	want |= protoLeadSpace
+	s.leadSpace = protocol&protoLeadSpace != 0
+
+	reply := make([]byte, 12)
+	binary.BigEndian.PutUint32(reply[0:], version)
+	binary.BigEndian.PutUint32(reply[4:], actAddHeaders|actChgHeaders)
+	binary.BigEndian.PutUint32(reply[8:], protocol&want)
+
+	return s.write(respOptNeg, reply)
+}
+
+func (s *session) endOfMessage() error {
+	m := s.message()
+
+	m.Macros = make(map[string]string)
+	for _, macros := range s.macros {
+		for name, value := range macros {
+			m.Macros[name] = value
+		}
+	}
+
+	s.resetMessage()
+
+	changes := s.filter(m)
+
+	for _, name := range changes.Remove {
+		// Deleted last first, so the indexes of the rest stay put
+		for i := len(m.Header(name)); i >= 1; i-- {
+			index := make([]byte, 4)
+			binary.BigEndian.PutUint32(index, uint32(i))
+			if err := s.write(respChgHeader, append(index, cStringsBytes(name, "")...)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, h := range changes.Add {
+		value := strings.Replace(h.Value, "\r\n", "\n", -1)
+		if !s.leadSpace {
+			// The MTA adds its own
+			value = strings.TrimPrefix(value, " ")
+		}
+		if err := s.write(respAddHeader, cStringsBytes(h.Name, value)); err != nil {
+			return err
+		}
+	}
+
+	return s.write(respContinue, nil)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testZone   = "example.com."
+	testKey    = "keyforge."
+	testSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// A stand-in authoritative server holding one zone in memory. It answers AXFR
+// and applies RFC 2136 updates, both only when signed with testKey.
+type testNameserver struct {
+	sync.Mutex
+	records []dns.RR
+	updates int
+}
+
+func (ns *testNameserver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	soa, _ := dns.NewRR(testZone + " 3600 IN SOA ns1.example.com. admin.example.com. 1 3600 600 86400 60")
+
+	switch {
+	case r.Opcode == dns.OpcodeUpdate:
+		ns.updates++
+		for _, rr := range r.Ns {
+			if rr.Header().Class == dns.ClassNONE {
+				ns.remove(rr)
+			} else {
+				ns.records = append(ns.records, rr)
+			}
+		}
+
+	case r.Question[0].Qtype == dns.TypeAXFR:
+		m.Answer = append([]dns.RR{soa}, ns.records...)
+		m.Answer = append(m.Answer, soa)
+	}
+
+	m.SetTsig(testKey, dns.HmacSHA256, tsigFudge, int64(r.IsTsig().TimeSigned))
+	w.WriteMsg(m)
+}
+
+// Deletes the record matching rr's owner, type and data
+func (ns *testNameserver) remove(rr dns.RR) {
+	target := rr.(*dns.TXT)
+	kept := ns.records[:0]
+
+	for _, existing := range ns.records {
+		txt, ok := existing.(*dns.TXT)
+		if ok && strings.EqualFold(txt.Hdr.Name, target.Hdr.Name) && txtValue(txt) == txtValue(target) {
+			continue
+		}
+		kept = append(kept, existing)
+	}
+
+	ns.records = kept
+}
+
+func startNameserver(t *testing.T, ns *testNameserver, zone string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err, records := ReadZone(strings.NewReader(zone), testZone, "served")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range records {
+		for _, txt := range set.Records {
+			ns.records = append(ns.records, txt)
+		}
+	}
+
+	server := dns.Server{
+		Listener:   listener,
+		Handler:    ns,
+		TsigSecret: map[string]string{testKey: testSecret},
+		// The default refuses every opcode but QUERY and NOTIFY
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+
+	go server.ActivateAndServe()
+	<-started
+
+	t.Cleanup(func() { server.Shutdown() })
+	return listener.Addr().String()
+}
+
+func testPublisher(address string) *Publisher {
+	return &Publisher{
+		Server:        address,
+		Zone:          testZone,
+		Selector:      pubKeyFile,
+		Batch:         2,
+		TSIGName:      testKey,
+		TSIGSecret:    testSecret,
+		TSIGAlgorithm: dns.HmacSHA256,
+	}
+}
+
+func TestDiff(t *testing.T) {
+	_, desired := ReadZone(strings.NewReader(`
+_KeyForge 3600 IN TXT "public=new,2020=aEOM"
+2020_0._KeyForge 3600 IN TXT "01=b" "EOM"
+`), testZone, "desired")
+
+	_, served := ReadZone(strings.NewReader(`
+_KeyForge 3600 IN TXT "public=old,2020=aEOM"
+2020_0._KeyForge 3600 IN TXT "01=bEOM"
+2019_0._KeyForge 3600 IN TXT "12=zEOM"
+`), testZone, "served")
+
+	changes := Diff(desired, served)
+
+	// 2019 is removed, 2020 is unchanged despite the different split, and the
+	// base record is replaced
+	if len(changes) != 2 {
+		t.Fatal("Unexpected changes", changes)
+	}
+
+	if changes[0].Name != "2019_0._keyforge.example.com." || len(changes[0].Remove) != 1 || len(changes[0].Add) != 0 {
+		t.Log("Unexpected change", changes[0])
+		t.Fail()
+	}
+
+	if changes[1].Name != "_keyforge.example.com." || len(changes[1].Remove) != 1 || len(changes[1].Add) != 1 {
+		t.Log("Unexpected change", changes[1])
+		t.Fail()
+	}
+}
+
+func TestPublish(t *testing.T) {
+	var ns testNameserver
+	address := startNameserver(t, &ns, `
+www 3600 IN TXT "not ours"
+_KeyForge 3600 IN TXT "public=old,2020=aEOM"
+2019_0._KeyForge 3600 IN TXT "12=zEOM"
+`)
+
+	p := testPublisher(address)
+
+	_, desired := ReadZone(strings.NewReader(`
+_KeyForge 3600 IN TXT "public=new,2020=aEOM"
+2020_0._KeyForge 3600 IN TXT "01=bEOM"
+202001_0._KeyForge 3600 IN TXT "01=cEOM"
+`), testZone, "desired")
+
+	err, served := p.Served()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := Diff(p.managed(desired), p.managed(served))
+	if err := p.Apply(changes); err != nil {
+		t.Fatal(err)
+	}
+
+	if ns.updates < 2 {
+		t.Log("Changes were not split into batches", ns.updates)
+		t.Fail()
+	}
+
+	// Afterwards the served records match, and nothing else was touched
+	err, served = p.Served()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining := Diff(p.managed(desired), p.managed(served)); len(remaining) != 0 {
+		t.Log("Served records differ after publishing", remaining)
+		t.Fail()
+	}
+
+	if _, ok := served["www.example.com."]; !ok {
+		t.Log("Unmanaged record was removed")
+		t.Fail()
+	}
+}
+
+func TestPublishBadKey(t *testing.T) {
+	var ns testNameserver
+	address := startNameserver(t, &ns, "")
+
+	p := testPublisher(address)
+	p.TSIGSecret = "d3JvbmdzZWNyZXQ="
+
+	if err, _ := p.Served(); err == nil {
+		t.Log("Transfer succeeded with the wrong key")
+		t.Fail()
+	}
+}
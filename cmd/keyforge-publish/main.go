@@ -0,0 +1,124 @@
+/*
+keyforge-publish
+
+keyforge-publish pushes the records written by keyforge-generate to an
+authoritative nameserver using RFC 2136 dynamic updates, signed with TSIG.
+
+The records currently served under the KeyForge selector are fetched with a
+zone transfer (AXFR, signed with the same key) and compared against the
+generated zone file, so only the difference is sent:
+
+- records that are generated but not served are added
+- records that are served but no longer generated are deleted
+- records whose value changed are replaced in the same update message
+
+Only TXT records at <selector>.<zone> or below it are ever touched.
+
+Example:
+
+	keyforge-publish -server ns1.example.com:53 -zone example.com \
+		-tsig-name keyforge. -tsig-secret <base64 secret>
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/keyforgery/KeyForge/utils"
+	"github.com/miekg/dns"
+)
+
+const (
+	pubKeyFile = "_KeyForge"
+)
+
+var (
+	server      = flag.String("server", "", "Authoritative nameserver to update, host:port")
+	zone        = flag.String("zone", "", "DNS zone the records are published in, e.g. example.com")
+	zoneFile    = flag.String("records", "", "Zone file fragment from keyforge-generate, default = <key directory>/_KeyForge.zone")
+	selector    = flag.String("selector", "", "Label the KeyForge records live under, default = Selector of the config, or of the signer whose KeyDir is the key directory")
+	tsigName    = flag.String("tsig-name", "", "Name of the TSIG key")
+	tsigSecret  = flag.String("tsig-secret", "", "Base64 TSIG secret")
+	tsigAlg     = flag.String("tsig-algorithm", "hmac-sha256", "TSIG algorithm")
+	dryRun      = flag.Bool("n", false, "Print the changes without sending them")
+	maxPerBatch = flag.Int("batch", 200, "Maximum records changed per update message")
+)
+
+func check(e error, message string) {
+	if e != nil {
+		fmt.Fprintln(os.Stderr, message, e)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	err, config := utils.LoadConfig(utils.ConfigFlags())
+	check(err, "fail! Cannot read config!")
+	keyDir := config.KeyDirectory
+
+	if *server == "" || *zone == "" {
+		fmt.Fprintln(os.Stderr, "both -server and -zone are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if _, _, err := net.SplitHostPort(*server); err != nil {
+		*server += ":53"
+	}
+
+	if *selector == "" {
+		*selector = config.SelectorFor(keyDir)
+	}
+
+	records := *zoneFile
+	if records == "" {
+		records = path.Join(keyDir, pubKeyFile+".zone")
+	}
+
+	p := Publisher{
+		Server:   *server,
+		Zone:     dns.Fqdn(*zone),
+		Selector: *selector,
+		Batch:    *maxPerBatch,
+	}
+
+	if *tsigName != "" {
+		p.TSIGName = dns.Fqdn(*tsigName)
+		p.TSIGSecret = *tsigSecret
+		p.TSIGAlgorithm = dns.Fqdn(strings.ToLower(*tsigAlg))
+	}
+
+	file, err := os.Open(records)
+	check(err, "fail! Cannot open the generated records:")
+	defer file.Close()
+
+	err, desired := ReadZone(file, p.Zone, records)
+	check(err, "fail! Cannot parse the generated records:")
+
+	err, served := p.Served()
+	check(err, "fail! Cannot transfer the currently served records:")
+
+	changes := Diff(p.managed(desired), p.managed(served))
+
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("Nothing to do, the served records are up to date.")
+		return
+	}
+
+	if *dryRun {
+		fmt.Println(len(changes), "changes not sent (dry run)")
+		return
+	}
+
+	check(p.Apply(changes), "fail! Update was not applied:")
+	fmt.Println(len(changes), "changes published to", p.Server)
+}
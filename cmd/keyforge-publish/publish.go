@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// How long a TSIG signature is valid for, either side of now
+const tsigFudge = 300
+
+// The TXT records at one owner name
+type RRSet struct {
+	Records []*dns.TXT
+}
+
+// TXT records keyed by lower case, fully qualified owner name
+type RecordSet map[string]*RRSet
+
+func (r RecordSet) add(txt *dns.TXT) {
+	name := strings.ToLower(txt.Hdr.Name)
+
+	set, ok := r[name]
+	if !ok {
+		set = &RRSet{}
+		r[name] = set
+	}
+
+	set.Records = append(set.Records, txt)
+}
+
+// The value of a TXT record, with its character-strings joined back together
+func txtValue(txt *dns.TXT) string {
+	return strings.Join(txt.Txt, "")
+}
+
+// The changes to make at one owner name. They are always sent in the same
+// update message, so a name is never left without a record.
+type Change struct {
+	Name   string
+	Remove []*dns.TXT
+	Add    []*dns.TXT
+}
+
+func abbreviate(s string) string {
+	if len(s) > 40 {
+		return s[:37] + "..."
+	}
+	return s
+}
+
+func (c Change) String() string {
+	lines := make([]string, 0)
+	for _, txt := range c.Remove {
+		lines = append(lines, "- "+c.Name+" TXT "+abbreviate(txtValue(txt)))
+	}
+	for _, txt := range c.Add {
+		lines = append(lines, "+ "+c.Name+" TXT "+abbreviate(txtValue(txt)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Reads the TXT records out of a master file, e.g. the fragment written by
+// keyforge-generate. Relative names are taken relative to origin.
+func ReadZone(r io.Reader, origin, filename string) (error, RecordSet) {
+	records := make(RecordSet)
+
+	zp := dns.NewZoneParser(r, dns.Fqdn(origin), filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if txt, isTXT := rr.(*dns.TXT); isTXT {
+			records.add(txt)
+		}
+	}
+
+	if err := zp.Err(); err != nil {
+		return err, nil
+	}
+
+	return nil, records
+}
+
+// Computes the changes that turn served into desired, ordered by name
+func Diff(desired, served RecordSet) []Change {
+	names := make(map[string]bool)
+	for name := range desired {
+		names[name] = true
+	}
+	for name := range served {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	changes := make([]Change, 0)
+
+	for _, name := range sorted {
+		change := Change{Name: name}
+
+		want := make(map[string]bool)
+		if set, ok := desired[name]; ok {
+			for _, txt := range set.Records {
+				want[txtValue(txt)] = true
+			}
+		}
+
+		have := make(map[string]bool)
+		if set, ok := served[name]; ok {
+			for _, txt := range set.Records {
+				have[txtValue(txt)] = true
+				if !want[txtValue(txt)] {
+					change.Remove = append(change.Remove, txt)
+				}
+			}
+		}
+
+		if set, ok := desired[name]; ok {
+			for _, txt := range set.Records {
+				if !have[txtValue(txt)] {
+					change.Add = append(change.Add, txt)
+				}
+			}
+		}
+
+		if len(change.Remove) > 0 || len(change.Add) > 0 {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+// Publishes KeyForge records to one zone on an authoritative nameserver
+type Publisher struct {
+	Server   string // host:port
+	Zone     string // fully qualified zone name
+	Selector string // label the KeyForge records live under
+	Batch    int    // maximum records changed per update message
+
+	// Leave TSIGName empty to send unsigned messages
+	TSIGName      string
+	TSIGSecret    string
+	TSIGAlgorithm string
+}
+
+func (p *Publisher) secrets() map[string]string {
+	if p.TSIGName == "" {
+		return nil
+	}
+	return map[string]string{p.TSIGName: p.TSIGSecret}
+}
+
+func (p *Publisher) sign(m *dns.Msg) {
+	if p.TSIGName != "" {
+		m.SetTsig(p.TSIGName, p.TSIGAlgorithm, tsigFudge, time.Now().Unix())
+	}
+}
+
+// Whether name is the selector record or one of the tree nodes under it
+func (p *Publisher) manages(name string) bool {
+	base := strings.ToLower(p.Selector + "." + p.Zone)
+	name = strings.ToLower(name)
+	return name == base || strings.HasSuffix(name, "."+base)
+}
+
+// The subset of records this publisher is responsible for
+func (p *Publisher) managed(records RecordSet) RecordSet {
+	result := make(RecordSet)
+	for name, set := range records {
+		if p.manages(name) {
+			result[name] = set
+		}
+	}
+	return result
+}
+
+// Fetches the records currently served for the zone with AXFR
+func (p *Publisher) Served() (error, RecordSet) {
+	records := make(RecordSet)
+
+	m := new(dns.Msg)
+	m.SetAxfr(p.Zone)
+	p.sign(m)
+
+	t := dns.Transfer{TsigSecret: p.secrets()}
+	envelopes, err := t.In(m, p.Server)
+	if err != nil {
+		return err, nil
+	}
+
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return envelope.Error, nil
+		}
+
+		for _, rr := range envelope.RR {
+			if txt, ok := rr.(*dns.TXT); ok {
+				records.add(txt)
+			}
+		}
+	}
+
+	return nil, records
+}
+
+// Sends one update message with the given changes
+func (p *Publisher) send(changes []Change) error {
+	m := new(dns.Msg)
+	m.SetUpdate(p.Zone)
+
+	for _, change := range changes {
+		remove := make([]dns.RR, 0, len(change.Remove))
+		for _, txt := range change.Remove {
+			remove = append(remove, dns.Copy(txt))
+		}
+		m.Remove(remove)
+
+		add := make([]dns.RR, 0, len(change.Add))
+		for _, txt := range change.Add {
+			add = append(add, txt)
+		}
+		m.Insert(add)
+	}
+
+	p.sign(m)
+
+	// Updates easily outgrow a datagram
+	c := dns.Client{Net: "tcp", TsigSecret: p.secrets()}
+	response, _, err := c.Exchange(m, p.Server)
+	if err != nil {
+		return err
+	}
+
+	if response.Rcode != dns.RcodeSuccess {
+		return errors.New("update refused: " + dns.RcodeToString[response.Rcode])
+	}
+
+	return nil
+}
+
+// Sends the changes in as many update messages as the batch size requires
+func (p *Publisher) Apply(changes []Change) error {
+	batch := make([]Change, 0)
+	size := 0
+
+	for _, change := range changes {
+		changeSize := len(change.Remove) + len(change.Add)
+
+		if len(batch) > 0 && size+changeSize > p.Batch {
+			if err := p.send(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			size = 0
+		}
+
+		batch = append(batch, change)
+		size += changeSize
+	}
+
+	if len(batch) > 0 {
+		if err := p.send(batch); err != nil {
+			return fmt.Errorf("%d changes not applied: %v", len(batch), err)
+		}
+	}
+
+	return nil
+}
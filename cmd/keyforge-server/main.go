@@ -4,141 +4,229 @@ package main
 
 This server is a service that signs / verifies messages/hashes
 
+It serves JSON-RPC on the KeyForgePipeFile unix socket, and the same over
+HTTP at /v1/ on HTTPAddress, see keyserver.API. Only the Clients of the config
+may use either: on the socket by their uid or gid, over HTTP by bearer token
+or, with TLSClientCA, by client certificate. Prometheus metrics are at
+/metrics, for anyone.
+
+It logs JSON to stderr at LogLevel, and records every signature issued in
+AuditLog. SIGHUP loads the keys again from their directories, say once
+keyforge-generate has written new ones, without dropping connections, and
+reopens AuditLog after it was rotated. SIGTERM stops taking new connections
+and waits for the requests under way before exiting.
+
 The key generation only works to the Day limit. We only guarantee 15 minute liveliness of keys.
 */
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"html"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
-	"net/rpc"
-	"net/rpc/jsonrpc"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
+	"github.com/keyforgery/KeyForge/keyserver"
 	"github.com/keyforgery/KeyForge/utils"
 )
 
 const pubHelp = "Specifies the directory for public and private keyfiles, default = ~/.KeyForge/"
 
-func startKeyServer(sock string) {
-	// Start and register rpc server
-	keyserver := new(Server)
-	// TODO: TEMPORARY HACK, FIX, MAYBE CONFIG FILES?
-	keyserver.DNS = "test"
-	server := rpc.NewServer()
-	server.Register(keyserver)
-	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-
-	// Transport == unix sockets
-	l, e := net.Listen("unix", sock)
-	if e != nil {
-		log.Fatal("listen error:", e)
-		panic(e)
+// Serves JSON-RPC on l, for the clients auth knows, until l is closed
+func startKeyServer(l net.Listener, kfserver *keyserver.Server, auth *keyserver.Authenticator) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fatal("cannot accept on the unix socket", err)
+		}
+
+		go auth.ServeRPC(kfserver, conn)
+	}
+}
+
+// Loads the keys again, from the directories configured at start. The keys
+// signed with are kept if the new ones cannot be loaded.
+func reloadKeys(kfserver *keyserver.Server, config *utils.Configuration) {
+	if configs := config.SignerConfigs(); len(configs) > 0 {
+		err, signers := keyserver.LoadSigners(configs)
+		if err != nil {
+			keyserver.Logger.Error("cannot reload signing keys, keeping the old ones", "error", err)
+			return
+		}
+		kfserver.SetSigners(signers)
+	} else if err := kfserver.ReloadHIBE(config.KeyDirectory); err != nil {
+		keyserver.Logger.Error("cannot reload signing keys, keeping the old ones", "error", err)
+		return
+	}
+
+	keyserver.Logger.Info("reloaded signing keys")
+}
+
+// Logs as JSON to stderr, at the configured level. What is logged with the
+// log package, by net/http and net/rpc, goes there too.
+func setupLogging(config *utils.Configuration) error {
+	level := slog.LevelInfo
+	if config.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			return err
+		}
 	}
 
-	defer l.Close()
+	keyserver.Logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(keyserver.Logger)
+	return nil
+}
 
-	// Handle the case that the process is sigterm'd:
+/*
+Waits for signals: SIGHUP reloads the keys and reopens the audit log after
+rotation, SIGINT and SIGTERM stop taking connections and wait up to
+ShutdownTimeout for requests under way, then close done.
+*/
+func handleSignals(kfserver *keyserver.Server, config *utils.Configuration, l net.Listener, httpServer *http.Server, done chan struct{}) {
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigc {
+		if sig == syscall.SIGHUP {
+			reloadKeys(kfserver, config)
+
+			if kfserver.Audit != nil {
+				if err := kfserver.Audit.Reopen(); err != nil {
+					keyserver.Logger.Error("cannot reopen the audit log", "path", kfserver.Audit.Path, "error", err)
+				}
+			}
+			continue
+		}
 
-	go func(ln net.Listener, c chan os.Signal) {
-		sig := <-c
-		log.Printf("Caught signal %s: shutting down.", sig)
-		ln.Close()
-		os.Exit(0)
-	}(l, sigc)
+		keyserver.Logger.Info("shutting down", "signal", sig.String())
 
-	// Inf loop that handles our rpc
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Fatal(err)
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Duration)
+
+		// Closing the listener removes the socket file
+		l.Close()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			keyserver.Logger.Warn("HTTP requests still under way", "error", err)
+		}
+		if err := kfserver.Shutdown(ctx); err != nil {
+			keyserver.Logger.Warn("RPC requests still under way", "error", err)
+		}
+		if kfserver.Audit != nil {
+			kfserver.Audit.Close()
 		}
 
-		go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		cancel()
+		close(done)
+		return
 	}
 }
 
+func fatal(message string, err error) {
+	keyserver.Logger.Error(message, "error", err)
+	os.Exit(1)
+}
+
 func check(e error, message string) {
 	if e != nil {
-		fmt.Println(message)
-		panic(e)
+		fatal(message, e)
 	}
 }
 
 func main() {
-	configLoc, _, _, _ := utils.ConfigFlags()
+	err, config := utils.LoadConfig(utils.ConfigFlags())
+	check(err, "fail! Cannot read config!")
+	check(setupLogging(config), "fail! Cannot parse LogLevel!")
 
-	err, config := utils.ReadConfig(configLoc)
-	keyDir := config.KeyDirectory
+	// Pick where verification looks up public parameters
+	err, cache := keyserver.NewConfiguredDNSCache(config)
+	check(err, "fail! Cannot parse DNS resolver!")
 
-	check(err, "fail! Cannot read config!")
+	kfserver := &keyserver.Server{Cache: cache}
 
-	privateFile = keyDir + "/private/private"
-	publicFile = keyDir + "/_KeyForge"
+	// Record every signature issued
+	if config.AuditLog != "" {
+		err, kfserver.Audit = keyserver.OpenAuditLog(config.AuditLog)
+		check(err, "fail! Cannot open the audit log!")
+	}
 
-	// Load our HIBE instance
-	h := loadHIBE()
+	// Load the keys of each domain we sign for, chosen by the sender's domain
+	if configs := config.SignerConfigs(); len(configs) > 0 {
+		err, kfserver.Signers = keyserver.LoadSigners(configs)
+		check(err, "fail! Cannot load signing keys!")
+	} else {
+		// No domain configured, everything is signed with the keys in KeyDir
+		keyserver.LoadHIBE(config.KeyDirectory)
+		kfserver.DNS = utils.DefaultDNS
+	}
 
-	// Start the keyserver
-	go startKeyServer(config.KFPipe)
+	// Who may sign and verify
+	auth := keyserver.NewAuthenticator(config.Clients)
 
-	// simple webserver
+	// Start the keyserver, on unix sockets
+	l, err := net.Listen("unix", config.KFPipe)
+	check(err, "fail! Cannot listen on "+config.KFPipe)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Hello, %q", html.EscapeString(r.URL.Path))
-	})
+	go startKeyServer(l, kfserver, auth)
 
-	http.HandleFunc("/expire", func(w http.ResponseWriter, r *http.Request) {
-		// As a demo, we display expiry info every 30 minutes
-		now := time.Now().UTC()
-		expiry := now.Add(time.Minute * -30)
+	// Sign and verify over HTTP, for services that do not speak JSON-RPC
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", keyserver.NewAPI(kfserver, auth))
 
-		// Let's truncate the time
-		cyear, _month, cday := expiry.Date()
-		cmonth := int(_month)
+	// What it has been doing, for Prometheus
+	mux.Handle("/metrics", &keyserver.MetricsHandler{Server: kfserver, Auth: auth})
 
-		hour, minute, _ := expiry.Clock()
-		chunk := int((hour*60 + minute) / 30)
-		private := ""
+	// Secrets of expired leaves, which make old signatures deniable. Delegated
+	// hosts hold too little of the tree, the master's host publishes them.
+	expiry := &keyserver.ExpiryServer{Server: kfserver, Delay: config.ExpiryDelay.Duration}
+	mux.Handle("/expire", expiry)
+	mux.Handle("/expire/", expiry)
 
-		// Last year:
-		lastYear := make([]string, 0)
-		lastYear = append(lastYear, utils.FormatYear(cyear-1))
-		private += h.ExportLeafPrivate(lastYear)
+	server := &http.Server{Addr: config.HTTPAddress, Handler: mux}
 
-		// past months
-		pastMonth := cmonth - 1
+	done := make(chan struct{})
+	go handleSignals(kfserver, config, l, server, done)
 
-		for pastMonth >= 0 {
-			monthPath := make([]string, 0)
-			monthPath = append(monthPath, utils.FormatYear(cyear))
-			monthPath = append(monthPath, utils.FormatDig(pastMonth))
-			private += h.ExportLeafPrivate(lastYear)
-			pastMonth -= 1
-		}
+	if config.TLSCert == "" {
+		keyserver.Logger.Info("serving HTTP", "address", server.Addr)
+		err = server.ListenAndServe()
+	} else {
+		err = serveTLS(server, config)
+	}
 
-		// all of the necessary chunks
-		for chunk >= 0 {
-			path := utils.FomatPath(cyear, cmonth, cday, chunk)
-			private += h.ExportLeafPrivate(path)
-			chunk -= 1
-		}
+	if err != http.ErrServerClosed {
+		fatal("cannot serve HTTP", err)
+	}
 
-		// day -1
+	// Shutting down, let the requests under way finish
+	<-done
+}
 
-		fmt.Fprintf(w, "Hi, the following are expiry information for anything prior to ")
-		fmt.Fprintf(w, expiry.String())
-		fmt.Fprintf(w, "\n")
-		fmt.Fprintf(w, private)
-	})
+// Serves server over TLS, where clients may authenticate with a certificate
+// from TLSClientCA
+func serveTLS(server *http.Server, config *utils.Configuration) error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.TLSClientCA != "" {
+		ca, err := ioutil.ReadFile(config.TLSClientCA)
+		check(err, "fail! Cannot read TLS client CA!")
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			check(fmt.Errorf("no certificates in %s", config.TLSClientCA), "fail! Cannot read TLS client CA!")
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	server.TLSConfig = tlsConfig
 
+	keyserver.Logger.Info("serving HTTPS", "address", server.Addr)
+	return server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
 }
@@ -310,3 +310,235 @@ func BenchmarkL4VerifyRandom(b *testing.B) { benchLevelVerifyRandom(4, b) }
 func BenchmarkL5VerifyRandom(b *testing.B) { benchLevelVerifyRandom(5, b) }
 func BenchmarkL6VerifyRandom(b *testing.B) { benchLevelVerifyRandom(6, b) }
 func BenchmarkL7VerifyRandom(b *testing.B) { benchLevelVerifyRandom(7, b) }
+
+func TestSignFromNode(t *testing.T) {
+	var h GSHIBE
+	h.Setup()
+
+	// Only the public parameters and one node's secrets are known
+	var forger GSHIBE
+	forger.SetupPublicFromString(h.ExportPublic())
+
+	path := []string{"2020", "03", "02", "45"}
+	node := h.ExtractPath(path[:2])
+
+	err, imported := forger.NodeFromPrivate(path[1], h.ExportNodePrivate(path[:2]), node.parent.QValues)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := "forged"
+	signature := forger.SignWith(m, forger.ExtractBelow(imported, path[2:]))
+
+	if !h.Verify(signature, m, path) {
+		t.Log("Signature from an imported node failed to verify")
+		t.Fail()
+	}
+
+	// The same signature as the key holder would have made
+	genuine := h.Sign(m, path)
+	if !signature.Sig.Equal(genuine.Sig) {
+		t.Log("Imported node signed differently")
+		t.Fail()
+	}
+
+	if h.Verify(signature, m, []string{"2020", "04", "02", "45"}) {
+		t.Log("Signature verified outside the imported subtree")
+		t.Fail()
+	}
+
+	if err, _ := forger.NodeFromPrivate(path[1], "AAAA", nil); err == nil {
+		t.Log("Truncated node secret was accepted")
+		t.Fail()
+	}
+}
+
+func TestImportNode(t *testing.T) {
+	var h GSHIBE
+	h.Setup()
+
+	// A signer holding only March 2020
+	var delegate GSHIBE
+	delegate.SetupPublicFromString(h.ExportPublic())
+
+	month := []string{"2020", "03"}
+	ancestors := h.ExtractPath(month).parent.QValues
+
+	if err := delegate.ImportNode(month, h.ExportNodePrivate(month), ancestors); err != nil {
+		t.Fatal(err)
+	}
+
+	m := "delegated"
+	path := []string{"2020", "03", "17", "12"}
+
+	if !delegate.Holds(path) {
+		t.Fatal("Imported node does not hold its descendants")
+	}
+
+	signature := delegate.Sign(m, path)
+	if !h.Verify(signature, m, path) {
+		t.Log("Signature from an imported node failed to verify")
+		t.Fail()
+	}
+
+	for _, outside := range [][]string{{"2020", "04", "01", "00"}, {"2021", "03", "17", "12"}} {
+		if delegate.Holds(outside) || delegate.ExtractPath(outside) != nil {
+			t.Log("Delegate holds", outside, "outside its month")
+			t.Fail()
+		}
+	}
+
+	// The year is known, but only for its Q value
+	if delegate.Holds([]string{"2020"}) {
+		t.Log("Delegate holds the year above its month")
+		t.Fail()
+	}
+
+	if err := delegate.ImportNode(month, h.ExportNodePrivate(month), nil); err == nil {
+		t.Log("Import without the ancestors' Q values was accepted")
+		t.Fail()
+	}
+}
+
+// Whether valid holds true exactly outside bad
+func batchResult(valid []bool, bad ...int) bool {
+	expected := make([]bool, len(valid))
+	for i := range expected {
+		expected[i] = true
+	}
+	for _, i := range bad {
+		expected[i] = false
+	}
+
+	for i := range valid {
+		if valid[i] != expected[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBatchVerify(t *testing.T) {
+	var h GSHIBE
+	h.Setup()
+
+	// Signatures for two leaves, several sharing each
+	paths := [][]string{{"2020", "03", "02", "45"}, {"2020", "03", "02", "46"}}
+
+	items := make([]BatchItem, 0)
+	for i := 0; i < 7; i++ {
+		path := paths[i%len(paths)]
+		message := RandStringRunes(64)
+		items = append(items, BatchItem{h.Sign(message, path), message, path})
+	}
+
+	if valid := h.BatchVerify(items); len(valid) != len(items) || !batchResult(valid) {
+		t.Log("Valid batch failed to verify", valid)
+		t.Fail()
+	}
+
+	if valid := h.BatchVerify(nil); len(valid) != 0 {
+		t.Log("Empty batch gave results", valid)
+		t.Fail()
+	}
+
+	// Bad signatures are picked out from the rest
+	bad := append([]BatchItem(nil), items...)
+	bad[3].Message = "This should not verify"
+	bad[6].Message = "Nor this"
+	if valid := h.BatchVerify(bad); !batchResult(valid, 3, 6) {
+		t.Log("Bad messages in a batch were not found", valid)
+		t.Fail()
+	}
+
+	// Even when swapped with another, which a plain sum would not notice
+	bad = append([]BatchItem(nil), items...)
+	bad[0].Sig, bad[2].Sig = bad[2].Sig, bad[0].Sig
+	if valid := h.BatchVerify(bad); !batchResult(valid, 0, 2) {
+		t.Log("Swapped signatures in a batch were not found", valid)
+		t.Fail()
+	}
+
+	bad = append([]BatchItem(nil), items...)
+	bad[1].ID = paths[0]
+	if valid := h.BatchVerify(bad); !batchResult(valid, 1) {
+		t.Log("Wrong path in a batch was not found", valid)
+		t.Fail()
+	}
+
+	// A signature whose Q values do not match its path fails alone
+	bad = append([]BatchItem(nil), items...)
+	bad[5].ID = bad[5].ID[:2]
+	if valid := h.BatchVerify(bad); !batchResult(valid, 5) {
+		t.Log("Short path in a batch was not found", valid)
+		t.Fail()
+	}
+
+	// Each agrees with Verify
+	for i, valid := range h.BatchVerify(bad) {
+		if valid != (len(bad[i].ID) == len(bad[i].Sig.QValues) && h.Verify(bad[i].Sig, bad[i].Message, bad[i].ID)) {
+			t.Log("Batch result", i, "disagrees with Verify")
+			t.Fail()
+		}
+	}
+}
+
+// Signatures checked this many at a time by the batch benchmarks
+const benchBatchSize = 64
+
+// Benchmark batch verification of b.N signatures for one leaf, every bad-th
+// one of them invalid (none if bad is 0)
+func benchLevelBatchVerify(levels, bad int, b *testing.B) {
+	/////////////////////////////////////////////////////
+	// Initialization:
+
+	// Set randomness
+	rand.Seed(time.Now().UnixNano())
+
+	// set up hibe
+	var h GSHIBE
+	h.Setup()
+
+	// Generate a size l string, two chars each
+	path := make([]string, levels)
+
+	for i := 0; i < levels; i++ {
+		path[i] = RandStringRunes(2)
+	}
+
+	items := make([]BatchItem, b.N)
+
+	for i := 0; i < b.N; i++ {
+		// Generate a random 64-byte string to sign (64 == len(any sha256 result))
+		message := RandStringRunes(64)
+		items[i] = BatchItem{h.Sign(message, path), message, path}
+
+		if bad > 0 && i%bad == bad-1 {
+			items[i].Message = RandStringRunes(64)
+		}
+	}
+
+	// Reset timer
+	b.ResetTimer()
+
+	/////////////////////////////////////////////////////
+	// Benchmark
+	for i := 0; i < b.N; i += benchBatchSize {
+		end := i + benchBatchSize
+		if end > b.N {
+			end = b.N
+		}
+		h.BatchVerify(items[i:end])
+	}
+}
+
+func BenchmarkL1BatchVerify(b *testing.B) { benchLevelBatchVerify(1, 0, b) }
+func BenchmarkL2BatchVerify(b *testing.B) { benchLevelBatchVerify(2, 0, b) }
+func BenchmarkL3BatchVerify(b *testing.B) { benchLevelBatchVerify(3, 0, b) }
+func BenchmarkL4BatchVerify(b *testing.B) { benchLevelBatchVerify(4, 0, b) }
+func BenchmarkL5BatchVerify(b *testing.B) { benchLevelBatchVerify(5, 0, b) }
+func BenchmarkL6BatchVerify(b *testing.B) { benchLevelBatchVerify(6, 0, b) }
+func BenchmarkL7BatchVerify(b *testing.B) { benchLevelBatchVerify(7, 0, b) }
+
+// One bad signature in every batch, found by bisection
+func BenchmarkL4BatchVerifyOneBad(b *testing.B) { benchLevelBatchVerify(4, benchBatchSize, b) }
@@ -1,9 +1,11 @@
 package hibs
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/big"
 	"sync"
@@ -22,6 +24,7 @@ type GSHIBE struct {
 		sync.RWMutex
 		m map[string]*liger.G1
 	}
+	extractLock sync.Mutex // guards Roots and every entity's Children
 }
 
 // Public parameters for the GSHIBE scheme
@@ -79,43 +82,73 @@ func GSSigFromPublic(sig string, qvalues []string) (error, *GSSig) {
 	newSig := liger.NewG1()
 	newSig.SetBytes(sigDecode)
 
-	qv := make([]*liger.G2, len(qvalues))
+	err, qv := QValuesFromStrings(qvalues)
+	if err != nil {
+		return err, nil
+	}
 
-	for i, value := range qvalues {
-		qDecode, err2 := base64.StdEncoding.DecodeString(value)
-		if err2 != nil {
+	return nil, &GSSig{newSig, qv}
+}
+
+// Decodes a list of b64 encoded Q values
+func QValuesFromStrings(values []string) (error, []*liger.G2) {
+	qv := make([]*liger.G2, len(values))
+
+	for i, value := range values {
+		err, qi := QValueFromString(value)
+		if err != nil {
 			return err, nil
 		}
 
-		qi := liger.NewG2()
-		qi.SetBytes(qDecode)
-
 		qv[i] = qi
 	}
 
-	return nil, &GSSig{newSig, qv}
+	return nil, qv
+}
+
+// Decodes a b64 encoded Q value, as published for each node
+func QValueFromString(value string) (error, *liger.G2) {
+	qDecode, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return err, nil
+	}
+
+	qi := liger.NewG2()
+	qi.SetBytes(qDecode)
+
+	return nil, qi
 }
 
 func (h *GSHIBE) ExportSign(m string, ID []string, include int) (sig string, qvalues []string) {
 	val := h.Sign(m, ID)
+	return val.Export(include)
+}
 
-	for _, val := range val.QValues {
+// Returns the b64 encoded signature point and the last include Q values, the
+// rest being published in DNS
+func (s GSSig) Export(include int) (sig string, qvalues []string) {
+	for _, val := range s.QValues {
 		bytes := val.Bytes()
 		qvalues = append(qvalues, base64.StdEncoding.EncodeToString(bytes))
 	}
-	fmt.Println(qvalues)
 
-	qvalues = qvalues[len(val.QValues)-include:]
+	qvalues = qvalues[len(s.QValues)-include:]
 
-	sig = base64.StdEncoding.EncodeToString(val.Sig.Bytes())
+	sig = base64.StdEncoding.EncodeToString(s.Sig.Bytes())
 
 	return
 }
 
+// Signs m for the node at ID. With imported nodes only, the node must be held,
+// see Holds.
 func (h *GSHIBE) Sign(m string, ID []string) GSSig {
 	// Extract to the ID
-	entity := h.ExtractPath(ID)
+	return h.SignWith(m, h.ExtractPath(ID))
+}
 
+// Signs m with the secrets of entity, which need not be derived from this
+// GSHIBE's master secret, see NodeFromPrivate
+func (h *GSHIBE) SignWith(m string, entity *Entity) GSSig {
 	// we bit prefix m with an ascii '1' for signing
 	s_t := h.PublicKeyHash(m, true)
 	s_t.MulBN(entity.PrivKey)
@@ -173,6 +206,136 @@ func (h *GSHIBE) Verify(s GSSig, message string, ID []string) bool {
 	return comparee.Equal(mul)
 }
 
+// One signature of a batch, see BatchVerify
+type BatchItem struct {
+	Sig     GSSig
+	Message string
+	ID      []string
+}
+
+// A random nonzero 64 bit exponent
+func batchExponent() *liger.BN {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		if z := new(big.Int).SetBytes(buf); z.Sign() != 0 {
+			return liger.NewBNFromBig(z)
+		}
+	}
+}
+
+/*
+BatchVerify verifies every signature in items, all under h's public
+parameters, and reports which are valid, in order. The whole batch is checked
+at once; only if that fails is it split in half and each half checked in
+turn, down to the bad signatures. A batch with a few bad signatures among
+many costs a few checks per bad one.
+*/
+func (h *GSHIBE) BatchVerify(items []BatchItem) []bool {
+	valid := make([]bool, len(items))
+	h.bisect(items, valid)
+	return valid
+}
+
+// Marks the signatures in items that verify in valid, which lines up with it
+func (h *GSHIBE) bisect(items []BatchItem, valid []bool) {
+	if len(items) == 0 {
+		return
+	}
+
+	if h.batchCheck(items) {
+		for i := range valid {
+			valid[i] = true
+		}
+		return
+	}
+
+	if len(items) == 1 {
+		return
+	}
+
+	half := len(items) / 2
+	h.bisect(items[:half], valid[:half])
+	h.bisect(items[half:], valid[half:])
+}
+
+/*
+batchCheck checks every signature in items at once. Each signature's equation
+is raised to a random 64 bit exponent and the results multiplied together,
+with the terms paired with the same Q value combined, so the whole batch costs
+one pairing and one product of pairings. True only if every signature
+verifies, but for a chance of about 2^-64.
+*/
+func (h *GSHIBE) batchCheck(items []BatchItem) bool {
+	if len(items) == 0 {
+		return true
+	}
+
+	sum := liger.NewG1()
+	sum.SetIdentity()
+
+	// The G1 side of each term, by the Q value it is paired with
+	terms := make(map[string]*liger.G1)
+	qvalues := make(map[string]*liger.G2)
+	order := make([]string, 0)
+
+	addTerm := func(q *liger.G2, p *liger.G1) {
+		key := string(q.Bytes())
+		if term, ok := terms[key]; ok {
+			term.Add(p)
+			return
+		}
+		terms[key] = p
+		qvalues[key] = q
+		order = append(order, key)
+	}
+
+	for _, item := range items {
+		if len(item.ID) == 0 || len(item.Sig.QValues) != len(item.ID) {
+			return false
+		}
+
+		r := batchExponent()
+
+		sig := liger.CloneG1(item.Sig.Sig)
+		sig.MulBN(r)
+		sum.Add(sig)
+
+		// As in Verify, each weighted by r
+		P_1 := h.PublicKeyHash(item.ID[0], false)
+		P_1.MulBN(r)
+		addTerm(h.Params.Q0, P_1)
+
+		for i := 1; i < len(item.ID); i++ {
+			P_i := h.PublicKeyHash(item.ID[i], false)
+			P_i.MulBN(r)
+			addTerm(item.Sig.QValues[i-1], P_i)
+		}
+
+		P_M := h.PublicKeyHash(item.Message, true)
+		P_M.MulBN(r)
+		addTerm(item.Sig.QValues[len(item.ID)-1], P_M)
+	}
+
+	g1Vals := make([]*liger.G1, 0, len(order))
+	g2Vals := make([]*liger.G2, 0, len(order))
+	for _, key := range order {
+		g1Vals = append(g1Vals, terms[key])
+		g2Vals = append(g2Vals, qvalues[key])
+	}
+
+	comparee := liger.Pair(*sum, *h.Params.P0)
+
+	mul, err := liger.ProductPair(g1Vals, g2Vals)
+	if err != nil {
+		return false
+	}
+
+	return comparee.Equal(mul)
+}
+
 func (h *GSHIBE) Encrypt(IDS []string, message []byte) *Ciphertext {
 	var P1 *liger.G1
 	var PT *liger.G1
@@ -224,7 +387,8 @@ func (h *GSHIBE) Decrypt(IDS []string, cipher *Ciphertext) (message []byte) {
 	return result
 }
 
-// Extract as defined in our modified scheme
+// Extract as defined in our modified scheme. Returns nil if the secrets the
+// node derives from are not held, see ImportNode.
 func (h *GSHIBE) Extract(ID string, parent *Entity) *Entity {
 	var entityMap map[string]*Entity
 	var lastST *liger.G1
@@ -245,12 +409,19 @@ func (h *GSHIBE) Extract(ID string, parent *Entity) *Entity {
 		lastS = parent.PrivKey
 	}
 
+	h.extractLock.Lock()
 	currentEntity, nodeExists := entityMap[ID]
+	h.extractLock.Unlock()
 
 	if nodeExists {
 		return currentEntity
 	}
 
+	if lastS == nil {
+		// Only part of the tree was imported, and this is outside it
+		return nil
+	}
+
 	// Create a node if one doesn't exist for this ID
 
 	// 1. Compute PT = H(ID_t) -> G1
@@ -293,6 +464,15 @@ func (h *GSHIBE) Extract(ID string, parent *Entity) *Entity {
 	newEntity.QValues = append(newEntity.QValues, QT)
 
 	newEntity.parent = parent
+
+	h.extractLock.Lock()
+	defer h.extractLock.Unlock()
+
+	if existing, raced := entityMap[ID]; raced {
+		// Another caller extracted the same node meanwhile
+		return existing
+	}
+
 	entityMap[ID] = &newEntity
 	return &newEntity
 }
@@ -300,13 +480,105 @@ func (h *GSHIBE) Extract(ID string, parent *Entity) *Entity {
 // Helper function that will extract from the root to the leaf and return the
 // final leaf entity
 func (h *GSHIBE) ExtractPath(IDS []string) (leaf *Entity) {
+	return h.ExtractBelow(nil, IDS)
+}
+
+// Extracts the descendant of node at IDS, relative to node. A nil node is the
+// root.
+func (h *GSHIBE) ExtractBelow(node *Entity, IDS []string) (leaf *Entity) {
+	leaf = node
 	for _, ID := range IDS {
 		leaf = h.Extract(ID, leaf)
+		if leaf == nil {
+			return nil
+		}
 	}
 
 	return
 }
 
+/*
+ImportNode loads the node at IDS from the output of ExportNodePrivate, so that
+it and everything beneath it can be extracted and signed for without the
+master secret. ancestors are the Q values of the nodes above it, root first.
+
+ExportLeafPrivate is not enough for this: it holds the node's secret s_t but
+not its secret point S_t, and children need both.
+
+Several nodes may be imported. Paths outside all of them extract to nil;
+check with Holds before signing.
+*/
+func (h *GSHIBE) ImportNode(IDS []string, encoded string, ancestors []*liger.G2) error {
+	if len(IDS) == 0 || len(ancestors) != len(IDS)-1 {
+		return errors.New("need a Q value for each ancestor of the node")
+	}
+
+	err, node := h.NodeFromPrivate(IDS[len(IDS)-1], encoded, ancestors)
+	if err != nil {
+		return err
+	}
+
+	h.extractLock.Lock()
+	defer h.extractLock.Unlock()
+
+	if h.Roots == nil {
+		h.Roots = make(map[string]*Entity)
+	}
+
+	// The ancestors are held without secrets, only to find the way down
+	parent := &Entity{QValues: make([]*liger.G2, 0)}
+	entityMap := h.Roots
+
+	for i, ID := range IDS[:len(IDS)-1] {
+		ancestor, exists := entityMap[ID]
+		if !exists {
+			ancestor = &Entity{
+				Public:   h.PublicKeyHash(ID, false),
+				ID:       ID,
+				Children: make(map[string]*Entity),
+				parent:   parent,
+				QValues:  append(append([]*liger.G2(nil), parent.QValues...), ancestors[i]),
+			}
+			entityMap[ID] = ancestor
+		}
+
+		parent = ancestor
+		entityMap = ancestor.Children
+	}
+
+	node.parent = parent
+	entityMap[IDS[len(IDS)-1]] = node
+
+	return nil
+}
+
+// Whether the secrets for the node at IDS are held, either from the master
+// secret or from an imported node above it
+func (h *GSHIBE) Holds(IDS []string) bool {
+	if h.MasterSecret != nil {
+		return true
+	}
+
+	h.extractLock.Lock()
+	defer h.extractLock.Unlock()
+
+	entityMap := h.Roots
+	for _, ID := range IDS {
+		entity, exists := entityMap[ID]
+		if !exists {
+			return false
+		}
+
+		if entity.PrivKey != nil {
+			return true
+		}
+
+		entityMap = entity.Children
+	}
+
+	return false
+}
+
 func (h *GSHIBE) Setup() {
 	var hibeParams Parameters
 
@@ -360,6 +632,95 @@ func (h *GSHIBE) ExportLeafPrivate(IDS []string) string {
 	return base64.StdEncoding.EncodeToString([]byte(entity.PrivKey.ToHexString()))
 }
 
+// Returns a b64 encoded string of the secrets of a particular node: its
+// secret point S_t and secret s_t. Unlike ExportLeafPrivate this is enough to
+// derive every descendant of the node, and so to sign anywhere beneath it.
+// Encoded as length, value pairs, lengths are big endian.
+func (h *GSHIBE) ExportNodePrivate(IDS []string) string {
+	entity := h.ExtractPath(IDS)
+
+	pointBytes := entity.PrivPoint.Bytes()
+	keyBytes := entity.PrivKey.Bytes()
+
+	buf := make([]byte, 4+len(pointBytes)+4+len(keyBytes))
+	binary.BigEndian.PutUint32(buf, uint32(len(pointBytes)))
+	copy(buf[4:], pointBytes)
+	binary.BigEndian.PutUint32(buf[4+len(pointBytes):], uint32(len(keyBytes)))
+	copy(buf[8+len(pointBytes):], keyBytes)
+
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+/*
+NodeFromPrivate recreates the node named ID from the output of
+ExportNodePrivate, without the master secret. ancestors are the Q values of
+the nodes above it, root first; its own Q value is derived from its secret.
+
+Descendants can then be extracted with ExtractBelow and signed for with
+SignWith. This is how anyone holding the published expiry information signs
+for an expired part of the tree. Only the public parameters need be set up.
+*/
+func (h *GSHIBE) NodeFromPrivate(ID string, encoded string, ancestors []*liger.G2) (error, *Entity) {
+	if !h.publicSetup {
+		return errors.New("public parameters are not set up"), nil
+	}
+
+	decode, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err, nil
+	}
+
+	// Encoded as l, v, lengths are big endian
+	if len(decode) < 4 {
+		return errors.New("node secret is truncated"), nil
+	}
+	lenPoint := binary.BigEndian.Uint32(decode)
+
+	if uint64(len(decode)) < 8+uint64(lenPoint) {
+		return errors.New("node secret is truncated"), nil
+	}
+	lenKey := binary.BigEndian.Uint32(decode[4+lenPoint:])
+
+	if uint64(len(decode)) != 8+uint64(lenPoint)+uint64(lenKey) {
+		return errors.New("node secret has the wrong length"), nil
+	}
+
+	point := liger.NewG1()
+	point.SetBytes(decode[4 : 4+lenPoint])
+
+	key := liger.NewBN()
+	key.SetBytes(decode[8+lenPoint:])
+
+	QT := liger.NewG2()
+	QT.Set(h.Params.P0)
+	QT.MulBN(key)
+
+	var node Entity
+	node.PrivKey = key
+	node.PrivPoint = point
+	node.Public = h.PublicKeyHash(ID, false)
+	node.ID = ID
+	node.Children = make(map[string]*Entity)
+	node.QValues = make([]*liger.G2, 0, len(ancestors)+1)
+	node.QValues = append(node.QValues, ancestors...)
+	node.QValues = append(node.QValues, QT)
+
+	return nil, &node
+}
+
+// Returns the b64 encoded Q values of the nodes above IDS, root first, which
+// NodeFromPrivate and ImportNode need alongside ExportNodePrivate
+func (h *GSHIBE) ExportAncestorParams(IDS []string) []string {
+	params := make([]string, 0, len(IDS))
+
+	node := h.ExtractPath(IDS)
+	for node = node.parent; node != nil && len(node.QValues) > 0; node = node.parent {
+		params = append([]string{node.Params()}, params...)
+	}
+
+	return params
+}
+
 // Imports from the b64 encoded public parameters in encodedPK
 func (h *GSHIBE) SetupPublicFromString(encodedPK string) error {
 	var hibeParams Parameters
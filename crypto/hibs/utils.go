@@ -46,33 +46,30 @@ func (h *GSHIBE) PublicKeyHash(id string, isSigning bool) *liger.G1 {
 		id = "1" + id
 	}
 
-	if h.hashCache.m == nil {
-		h.hashCache.m = make(map[string]*liger.G1)
-	}
-
 	// check if the hash is in our hash cache
-	// Get read lock
-	//h.hashCache.RLock()
+	h.hashCache.RLock()
 	value, isInCache := h.hashCache.m[id]
+	h.hashCache.RUnlock()
+
 	if isInCache {
-		//	h.hashCache.RUnlock()
+		// Callers may modify the point, so hand out a copy
 		result := liger.NewG1()
 		result.Set(value)
-		return value
+		return result
 	}
-	// This is not cached =(
-	//h.hashCache.RUnlock()
-
-	// Get write lock
-	//h.hashCache.Lock()
-	//defer h.hashCache.Unlock()
 
+	// This is not cached =(
 	// Calculate the hash and map to a member of g2
 	result := liger.NewG1()
 	result.SetFromStringHash(id, sha256.New())
 
+	h.hashCache.Lock()
+	if h.hashCache.m == nil {
+		h.hashCache.m = make(map[string]*liger.G1)
+	}
 	h.hashCache.m[id] = liger.NewG1()
 	h.hashCache.m[id].Set(result)
+	h.hashCache.Unlock()
 
 	return result
 }
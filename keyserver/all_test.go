@@ -0,0 +1,1583 @@
+package keyserver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc/jsonrpc"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/utils"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testDNS = "_KeyForge.example.com"
+
+// Publishes the records keyforge-generate would write for the days containing
+// each of when into zone, in the same layout
+func publishDays(h *hibs.GSHIBE, zone *StaticResolver, when ...time.Time) {
+	publishDaysAt(h, zone, testDNS, when...)
+}
+
+// The same, under dns
+func publishDaysAt(h *hibs.GSHIBE, zone *StaticResolver, dns string, when ...time.Time) {
+	// node -> tag=value entries
+	nodes := make(map[string][]string)
+	seen := make(map[string]bool)
+
+	addEntry := func(node, tag, value string) {
+		if !seen[node+"/"+tag] {
+			seen[node+"/"+tag] = true
+			nodes[node] = append(nodes[node], tag+"="+value)
+		}
+	}
+
+	addEntry("", "public", h.ExportPublic())
+	addEntry("", "tree", Tree.String())
+
+	for _, day := range when {
+		cyear, _month, cday := day.UTC().Date()
+		year := utils.FormatYear(cyear)
+		month := utils.FormatDig(int(_month))
+
+		dayNode := h.ExtractPath([]string{year, month, utils.FormatDig(cday)})
+		monthNode := dayNode.Parent()
+		yearNode := monthNode.Parent()
+
+		addEntry("", year, yearNode.Params())
+		addEntry(year, month, monthNode.Params())
+		addEntry(year+month, utils.FormatDig(cday), dayNode.Params())
+	}
+
+	for node, entries := range nodes {
+		name := dns
+		if node != "" {
+			name = node + "_0." + dns
+		}
+		zone.Set(name, strings.Join(entries, ",")+"EOM")
+	}
+}
+
+func setupTestServer(t *testing.T) (*Server, *StaticResolver) {
+	return setupTestServerWithTree(t, &utils.DefaultTree)
+}
+
+func setupTestServerWithTree(t *testing.T, tree *utils.TimeTree) (*Server, *StaticResolver) {
+	var h hibs.GSHIBE
+	h.Setup()
+	H = &h
+	Tree = tree
+	KeyID, Generations = "", nil
+
+	zone := NewStaticResolver()
+	now := time.Now().UTC()
+	publishDays(H, zone, now, now.Add(tree.Epoch))
+
+	s := Server{DNS: testDNS, Cache: NewDNSCache(zone, 0)}
+	return &s, zone
+}
+
+func TestStaticResolver(t *testing.T) {
+	zone := NewStaticResolver()
+	zone.Set("A.Example.com.", "one", "two")
+
+	err, txt, _ := zone.LookupTXT("a.example.com")
+	if err != nil || len(txt) != 2 || txt[0] != "one" {
+		t.Log("Lookup failed", err, txt)
+		t.Fail()
+	}
+
+	zone.Delete("a.example.com")
+	if err, _, _ := zone.LookupTXT("a.example.com"); err == nil {
+		t.Log("Deleted record still resolves")
+		t.Fail()
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	if _, r := NewResolver(""); r == nil {
+		t.Fail()
+	}
+
+	_, r := NewResolver("tcp://127.0.0.1")
+	ns, ok := r.(*NameserverResolver)
+	if !ok || ns.Network != "tcp" || ns.Address != "127.0.0.1:53" {
+		t.Log("Unexpected resolver", r)
+		t.Fail()
+	}
+
+	if err, _ := NewResolver("http://127.0.0.1:53"); err == nil {
+		t.Log("Accepted an unsupported network")
+		t.Fail()
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	var sigReply SigReply
+	s.Sign(&SigArgs{Sha256: "deadbeef"}, &sigReply)
+
+	args := VerifyArgs{
+		Sha256:    "deadbeef",
+		DNS:       testDNS,
+		Signature: sigReply.Signature,
+		Expiry:    sigReply.Expiry,
+	}
+
+	var reply VerifyReply
+	s.Verify(args, &reply)
+	if !reply.Success || !reply.Answer {
+		t.Log("Signature failed to verify", reply)
+		t.Fail()
+	}
+
+	args.Sha256 = "This should not verify"
+
+	reply = VerifyReply{}
+	s.Verify(args, &reply)
+	if reply.Answer {
+		t.Log("Signature verified when it shouldn't", reply)
+		t.Fail()
+	}
+}
+
+func TestSignatureHeader(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	var sigReply SigReply
+	s.Sign(&SigArgs{Sha256: "header"}, &sigReply)
+
+	sig := sigReply.Header
+	if sig == nil || sig.DNS() != testDNS || sig.Sig != sigReply.Sig || strings.Join(sig.Path, ".") != strings.Join(sigReply.Path, ".") {
+		t.Fatal("Signing replied with the wrong header", sig)
+	}
+
+	// The caller adds what the message's headers and body hashed to
+	sig.Headers = []string{"from"}
+	sig.BodyHash = "bh"
+
+	for hash, answer := range map[string]bool{"header": true, "other": false} {
+		var reply VerifyReply
+		s.Verify(VerifyArgs{Sha256: hash, Header: sig.Fold()}, &reply)
+		if !reply.Success || reply.Answer != answer {
+			t.Log("Verifying", hash, "from the header gave", reply, "rather than", answer)
+			t.Fail()
+		}
+	}
+
+	var reply VerifyReply
+	s.Verify(VerifyArgs{Sha256: "header", Header: strings.Replace(sig.String(), "d=", "d=a..", 1)}, &reply)
+	if reply.Answer || reply.ErrorCode != ErrorMalformedSignature {
+		t.Log("Verified a malformed header", reply)
+		t.Fail()
+	}
+}
+
+func TestSignVerifyTreeShapes(t *testing.T) {
+	shapes := []struct {
+		epoch     time.Duration
+		branching []int
+	}{
+		{5 * time.Minute, nil},
+		{5 * time.Minute, []int{24, 12}},
+		{time.Hour, []int{4, 6}},
+		{24 * time.Hour, nil},
+	}
+
+	for _, shape := range shapes {
+		err, tree := utils.NewTimeTree(shape.epoch, shape.branching)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := setupTestServerWithTree(t, tree)
+
+		var sigReply SigReply
+		s.Sign(&SigArgs{Sha256: "deadbeef"}, &sigReply)
+
+		var reply VerifyReply
+		s.Verify(VerifyArgs{
+			Sha256:    "deadbeef",
+			DNS:       testDNS,
+			Signature: sigReply.Signature,
+			Expiry:    sigReply.Expiry,
+		}, &reply)
+
+		if !reply.Answer {
+			t.Log("Signature failed to verify with tree", tree, reply)
+			t.Fail()
+		}
+	}
+}
+
+func TestVerifyMissingRecords(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	var sigReply SigReply
+	s.Sign(&SigArgs{Sha256: "deadbeef"}, &sigReply)
+
+	args := VerifyArgs{
+		Sha256:    "deadbeef",
+		DNS:       "_KeyForge.missing.example.com",
+		Signature: sigReply.Signature,
+		Expiry:    sigReply.Expiry,
+	}
+
+	var reply VerifyReply
+	s.Verify(args, &reply)
+	if !reply.VerifyFailed || reply.Answer || reply.ErrorCode != ErrorNoRecord {
+		t.Log("Verified without any published records", reply)
+		t.Fail()
+	}
+}
+
+func TestVerifyErrorCodes(t *testing.T) {
+	s, zone := setupTestServer(t)
+
+	var sigReply SigReply
+	s.Sign(&SigArgs{Sha256: "deadbeef"}, &sigReply)
+
+	cyear, _month, _ := time.Now().UTC().Date()
+	year := utils.FormatYear(cyear)
+	month := utils.FormatDig(int(_month))
+
+	verify := func() VerifyReply {
+		// Start from an empty cache each time
+		s.Cache = NewDNSCache(zone, 0)
+
+		var reply VerifyReply
+		s.Verify(VerifyArgs{
+			Sha256:    "deadbeef",
+			DNS:       testDNS,
+			Signature: sigReply.Signature,
+			Expiry:    sigReply.Expiry,
+		}, &reply)
+		return reply
+	}
+
+	// The month's days are split over two records, but the second is missing
+	zone.Set(year+month+"_0."+testDNS, "01=abc")
+	if reply := verify(); reply.ErrorCode != ErrorTruncatedChain {
+		t.Log("Expected a truncated chain", reply)
+		t.Fail()
+	}
+
+	zone.Set(year+month+"_0."+testDNS, "garbageEOM")
+	if reply := verify(); reply.ErrorCode != ErrorMalformedRecord {
+		t.Log("Expected a malformed record", reply)
+		t.Fail()
+	}
+
+	zone.Delete(year + "_0." + testDNS)
+	if reply := verify(); reply.ErrorCode != ErrorNoRecord {
+		t.Log("Expected a missing record", reply)
+		t.Fail()
+	}
+}
+
+// Counts the queries that reach the underlying resolver
+type countingResolver struct {
+	sync.Mutex
+	Resolver
+	delay   time.Duration
+	queries map[string]int
+}
+
+func (r *countingResolver) LookupTXT(name string) (error, []string, time.Duration) {
+	r.Lock()
+	r.queries[name]++
+	r.Unlock()
+
+	time.Sleep(r.delay)
+	return r.Resolver.LookupTXT(name)
+}
+
+func TestCacheTTL(t *testing.T) {
+	zone := NewStaticResolver()
+	zone.TTL = time.Minute
+	zone.Set("_KeyForge.example.com", "public=old,2020=aEOM")
+
+	cache := NewDNSCache(zone, 0).(*_DNSCache)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if _, v := cache.getPublicFromDNS("public", "", "_KeyForge.example.com"); v != "old" {
+		t.Log("Unexpected value", v)
+		t.Fail()
+	}
+
+	// Rotate the key, the old value is still fresh
+	zone.Set("_KeyForge.example.com", "public=new,2020=aEOM")
+	if _, v := cache.getPublicFromDNS("public", "", "_KeyForge.example.com"); v != "old" {
+		t.Log("Cache entry was not used", v)
+		t.Fail()
+	}
+
+	// Once the TTL has passed the rotated key is picked up
+	now = now.Add(2 * time.Minute)
+	if _, v := cache.getPublicFromDNS("public", "", "_KeyForge.example.com"); v != "new" {
+		t.Log("Stale cache entry was used", v)
+		t.Fail()
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	zone := NewStaticResolver()
+	counter := countingResolver{Resolver: zone, queries: make(map[string]int)}
+	cache := NewDNSCache(&counter, 2).(*_DNSCache)
+
+	for _, domain := range []string{"a", "b", "c"} {
+		zone.Set(domain, "public="+domain+"EOM")
+		cache.getPublicFromDNS("public", "", domain)
+	}
+
+	if cache.lru.Len() != 2 {
+		t.Log("Cache grew past its bound", cache.lru.Len())
+		t.Fail()
+	}
+
+	// "a" was least recently used, and must be fetched again
+	cache.getPublicFromDNS("public", "", "c")
+	cache.getPublicFromDNS("public", "", "a")
+
+	if counter.queries["a"] != 2 || counter.queries["c"] != 1 {
+		t.Log("Unexpected queries", counter.queries)
+		t.Fail()
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	zone := NewStaticResolver()
+	zone.Set("_KeyForge.example.com", "public=pkEOM")
+
+	counter := countingResolver{Resolver: zone, delay: 50 * time.Millisecond, queries: make(map[string]int)}
+	cache := NewDNSCache(&counter, 0).(*_DNSCache)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, v := cache.getPublicFromDNS("public", "", "_KeyForge.example.com"); v != "pk" {
+				t.Log("Unexpected value", v)
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if counter.queries["_KeyForge.example.com"] != 1 {
+		t.Log("Concurrent fetches were not coalesced", counter.queries)
+		t.Fail()
+	}
+}
+
+// Answers TXT queries on a local UDP socket with a fixed TTL
+func serveTXT(t *testing.T, records map[string]string, ttl uint32) string {
+	return serveSpoofedTXT(t, records, ttl, false)
+}
+
+// Like serveTXT, but with spoof, every answer is preceded by forged ones: a
+// datagram that is not DNS, and answers with the wrong ID or question
+func serveSpoofedTXT(t *testing.T, records map[string]string, ttl uint32, spoof bool) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+
+			q := query.Questions[0]
+
+			if spoof {
+				forged := func(id uint16, name string) []byte {
+					qname := dnsmessage.MustNewName(name)
+					packed, _ := (&dnsmessage.Message{
+						Header:    dnsmessage.Header{ID: id, Response: true},
+						Questions: []dnsmessage.Question{{Name: qname, Type: q.Type, Class: q.Class}},
+						Answers: []dnsmessage.Resource{{
+							Header: dnsmessage.ResourceHeader{Name: qname, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: ttl},
+							Body:   &dnsmessage.TXTResource{TXT: []string{"public=forgedEOM"}},
+						}},
+					}).Pack()
+					return packed
+				}
+
+				conn.WriteTo([]byte("not DNS"), addr)
+				conn.WriteTo(forged(query.ID+1, q.Name.String()), addr)
+				conn.WriteTo(forged(query.ID, "other."+q.Name.String()), addr)
+			}
+
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true},
+				Questions: query.Questions,
+			}
+
+			if value, ok := records[q.Name.String()]; ok {
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: ttl},
+					Body:   &dnsmessage.TXTResource{TXT: []string{value[:len(value)/2], value[len(value)/2:]}},
+				}}
+			} else {
+				response.RCode = dnsmessage.RCodeNameError
+			}
+
+			packed, _ := response.Pack()
+			conn.WriteTo(packed, addr)
+		}
+	}()
+
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestNameserverResolverSpoofed(t *testing.T) {
+	address := serveSpoofedTXT(t, map[string]string{"_keyforge.example.com.": "public=pkEOM"}, 42, true)
+	r := NewNameserverResolver("udp", address)
+
+	// The forgeries arrive first, and are passed over
+	for i := 0; i < 10; i++ {
+		err, txt, _ := r.LookupTXT("_KeyForge.example.com")
+		if err != nil || len(txt) != 1 || txt[0] != "public=pkEOM" {
+			t.Fatal("Spoofed answer accepted", err, txt)
+		}
+	}
+
+	// Questions must match but for the case of the name
+	response := dnsmessage.Message{Header: dnsmessage.Header{ID: 1}}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("a.example."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+	}
+	for _, question := range []dnsmessage.Question{
+		{Name: dnsmessage.MustNewName("A.Example."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+		{Name: dnsmessage.MustNewName("b.example."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+		{Name: dnsmessage.MustNewName("a.example."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		{Name: dnsmessage.MustNewName("a.example."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassCHAOS},
+	} {
+		response.Questions = []dnsmessage.Question{question}
+		if answers(&response, &query) != (question.Name.String() == "A.Example.") {
+			t.Log("Wrongly decided whether", question, "answers", query.Questions[0])
+			t.Fail()
+		}
+	}
+}
+
+func TestNameserverResolver(t *testing.T) {
+	address := serveTXT(t, map[string]string{"_keyforge.example.com.": "public=pkEOM"}, 42)
+	r := NewNameserverResolver("udp", address)
+
+	err, txt, ttl := r.LookupTXT("_KeyForge.example.com")
+	if err != nil || len(txt) != 1 || txt[0] != "public=pkEOM" || ttl != 42*time.Second {
+		t.Log("Unexpected answer", err, txt, ttl)
+		t.Fail()
+	}
+
+	err, _, _ = r.LookupTXT("missing.example.com")
+	if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+		t.Log("Expected NXDOMAIN, got", err)
+		t.Fail()
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	zone := NewStaticResolver()
+	counter := countingResolver{Resolver: zone, queries: make(map[string]int)}
+	cache := NewDNSCache(&counter, 0).(*_DNSCache)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		err, _ := cache.getPublicFromDNS("public", "", "_KeyForge.broken.example.com")
+		if lookupErr, ok := err.(*LookupError); !ok || lookupErr.Code != ErrorNoRecord {
+			t.Log("Unexpected error", err)
+			t.Fail()
+		}
+	}
+
+	if counter.queries["_KeyForge.broken.example.com"] != 1 {
+		t.Log("Failure was not cached", counter.queries)
+		t.Fail()
+	}
+
+	// Once published, the record is found after the negative entry expires
+	zone.Set("_KeyForge.broken.example.com", "public=pkEOM")
+	now = now.Add(NegativeCacheTTL + time.Second)
+
+	if err, v := cache.getPublicFromDNS("public", "", "_KeyForge.broken.example.com"); err != nil || v != "pk" {
+		t.Log("Negative entry outlived its TTL", err, v)
+		t.Fail()
+	}
+}
+
+func TestExpiryPublisher(t *testing.T) {
+	var h hibs.GSHIBE
+	h.Setup()
+
+	_, tree := utils.NewTimeTree(6*time.Hour, nil)
+
+	now := time.Date(2020, time.March, 2, 13, 0, 0, 0, time.UTC)
+	e := ExpiryPublisher{
+		HIBE:  &h,
+		Tree:  tree,
+		Start: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Delay: ExpiryDelay,
+		Now:   func() time.Time { return now },
+	}
+
+	get := func(header string, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/expire", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("", "")
+	if w.Code != http.StatusOK {
+		t.Fatal("Unexpected status", w.Code)
+	}
+
+	var doc utils.ExpiryDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	// January, February, March 1st, and the quarters of March 2nd that began
+	// more than the delay ago
+	expected := [][]string{{"2020", "01"}, {"2020", "02"}, {"2020", "03", "01"},
+		{"2020", "03", "02", "00"}, {"2020", "03", "02", "01"}, {"2020", "03", "02", "02"}}
+	if len(doc.Nodes) != len(expected) {
+		t.Fatal("Unexpected nodes", doc.Nodes)
+	}
+
+	for i, node := range doc.Nodes {
+		if strings.Join(node.Path, "/") != strings.Join(expected[i], "/") {
+			t.Log("Unexpected node", node.Path, "expected", expected[i])
+			t.Fail()
+		}
+		if node.Secret != h.ExportNodePrivate(node.Path) {
+			t.Log("Unexpected secret for", node.Path)
+			t.Fail()
+		}
+	}
+
+	if !doc.Expired.Equal(time.Date(2020, time.March, 2, 18, 0, 0, 0, time.UTC)) || doc.Tree != tree.String() {
+		t.Log("Unexpected document", doc.Expired, doc.Tree)
+		t.Fail()
+	}
+
+	etag := w.Header().Get("ETag")
+	if w := get("If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Log("Matching ETag was not honoured", w.Code)
+		t.Fail()
+	}
+
+	// Caches may send every version they hold, weakly
+	for match, code := range map[string]int{
+		`"stale", ` + etag:            http.StatusNotModified,
+		`W/"stale",W/` + etag:         http.StatusNotModified,
+		`"stale" , "older"`:           http.StatusOK,
+		`W/"stale", *`:                http.StatusNotModified,
+		strings.Trim(etag, `"`):       http.StatusOK,
+		`"` + strings.Trim(etag, `"`): http.StatusOK, // unterminated
+	} {
+		if w := get("If-None-Match", match); w.Code != code {
+			t.Log("If-None-Match:", match, "answered with", w.Code, "rather than", code)
+			t.Fail()
+		}
+	}
+
+	if w := get("If-Modified-Since", w.Header().Get("Last-Modified")); w.Code != http.StatusNotModified {
+		t.Log("If-Modified-Since was not honoured", w.Code)
+		t.Fail()
+	}
+
+	// The current leaf is only disclosed once the delay has passed
+	now = time.Date(2020, time.March, 2, 18, 0, 0, 0, time.UTC).Add(ExpiryDelay)
+	if w := get("If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Log("Leaf disclosed before the delay passed", w.Code)
+		t.Fail()
+	}
+
+	now = now.Add(time.Second)
+	if w := get("If-None-Match", etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Log("Document did not change when a leaf was disclosed", w.Code)
+		t.Fail()
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/expire", nil)
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Log("POST was accepted", w.Code)
+		t.Fail()
+	}
+}
+
+// Writes a key directory holding the public record and one delegated key for
+// the month containing when, and returns it
+func setupDelegatedKeys(t *testing.T, h *hibs.GSHIBE, when time.Time) string {
+	dir := setupKeyDir(t, h, false)
+	delegatedDir := filepath.Join(dir, "delegated")
+
+	month := []string{utils.FormatYear(when.Year()), utils.FormatDig(int(when.Month()))}
+	_, notBefore, notAfter := utils.DefaultTree.Span(month)
+
+	key := utils.DelegatedKey{
+		Version:   utils.DelegationVersion,
+		Tree:      utils.DefaultTree.String(),
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+		Node: utils.NodeSecret{
+			Path:      month,
+			Secret:    h.ExportNodePrivate(month),
+			Ancestors: h.ExportAncestorParams(month),
+		},
+	}
+
+	data, _ := json.Marshal(key)
+	os.MkdirAll(delegatedDir, 0700)
+	if err := ioutil.WriteFile(filepath.Join(delegatedDir, "month.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// Writes a key directory holding the public record, and the master secret if
+// asked, and returns it
+func setupKeyDir(t *testing.T, h *hibs.GSHIBE, master bool) string {
+	dir := t.TempDir()
+
+	base := "public=" + h.ExportPublic() + ",tree=" + utils.DefaultTree.String() + "EOM"
+	if err := ioutil.WriteFile(filepath.Join(dir, "_KeyForge"), []byte(base), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if master {
+		os.MkdirAll(filepath.Join(dir, "private"), 0700)
+		if err := ioutil.WriteFile(filepath.Join(dir, "private", "private"), []byte(h.ExportMasterPrivate()), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// Writes generation keyID of h, with its master secret, into keyDir
+func setupGeneration(t *testing.T, keyDir string, h *hibs.GSHIBE, keyID string, activeFrom time.Time) {
+	dir := filepath.Join(keyDir, keyID)
+	os.MkdirAll(filepath.Join(dir, "private"), 0700)
+
+	base := "public=" + h.ExportPublic() + ",tree=" + utils.DefaultTree.String() + "EOM"
+	if err := ioutil.WriteFile(filepath.Join(dir, keyID+"._KeyForge"), []byte(base), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "private", "private"), []byte(h.ExportMasterPrivate()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	generation := utils.Generation{Version: utils.GenerationVersion, KeyID: keyID, ActiveFrom: activeFrom}
+	if err := utils.WriteGeneration(filepath.Join(dir, utils.GenerationFile), &generation); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyGenerations(t *testing.T) {
+	Tree = &utils.DefaultTree
+	now := time.Now().UTC()
+	zone := NewStaticResolver()
+
+	var old, successor hibs.GSHIBE
+	old.Setup()
+	successor.Setup()
+
+	keyDir := t.TempDir()
+	setupGeneration(t, keyDir, &old, "k1", now.Add(-time.Hour))
+	setupGeneration(t, keyDir, &successor, "k2", now.Add(time.Hour))
+	os.MkdirAll(filepath.Join(keyDir, "k3.retired"), 0700)
+
+	publishDaysAt(&old, zone, "k1._KeyForge.example.com", now, now.Add(Tree.Epoch))
+	publishDaysAt(&successor, zone, "k2._KeyForge.example.com", now, now.Add(Tree.Epoch))
+
+	err, signers := LoadSigners([]utils.SignerConfig{{Domain: "example.com", KeyDirectory: keyDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := signers["example.com"]
+	if signer.KeyID != "k1" || len(signer.Generations) != 2 || signer.Generations[0].KeyID != "k2" {
+		t.Fatal("Loaded the wrong generations", signer.KeyID, signer.Generations)
+	}
+
+	if next := signer.at(now.Add(2 * time.Hour)); next.KeyID != "k2" || next.Domain != "example.com" || next.HIBE.ExportPublic() != successor.ExportPublic() {
+		t.Log("Not signing with the successor once it is active", next.KeyID)
+		t.Fail()
+	}
+
+	s := Server{Signers: signers, Cache: NewDNSCache(zone, 0)}
+
+	// The active generation, then the successor by its key ID
+	for _, keyID := range []string{"", "k2"} {
+		var reply SigReply
+		err := s.Sign(&SigArgs{Sha256: "rollover", SenderEmailAddress: "alice@example.com", KeyID: keyID}, &reply)
+		if err != nil || !reply.Success {
+			t.Fatal("Failed to sign with", keyID, err)
+		}
+
+		want := keyID
+		if want == "" {
+			want = "k1"
+		}
+		if reply.KeyID != want || reply.DNS != want+"._KeyForge.example.com" {
+			t.Log("Signed with", reply.KeyID, "at", reply.DNS, "rather than", want)
+			t.Fail()
+		}
+
+		var vreply VerifyReply
+		s.Verify(VerifyArgs{Sha256: "rollover", DNS: reply.DNS, Signature: reply.Sig,
+			TreeVersion: reply.TreeVersion, Path: reply.Path, QValues: reply.QValues}, &vreply)
+		if !vreply.Answer {
+			t.Log("Signature of", want, "failed to verify", vreply)
+			t.Fail()
+		}
+
+		// Not under the other generation's records
+		other := "k2._KeyForge.example.com"
+		if want == "k2" {
+			other = "k1._KeyForge.example.com"
+		}
+		vreply = VerifyReply{}
+		s.Verify(VerifyArgs{Sha256: "rollover", DNS: other, Signature: reply.Sig,
+			TreeVersion: reply.TreeVersion, Path: reply.Path, QValues: reply.QValues}, &vreply)
+		if vreply.Answer {
+			t.Log("Signature of", want, "verified under", other)
+			t.Fail()
+		}
+	}
+
+	var reply SigReply
+	if err := s.Sign(&SigArgs{Sha256: "rollover", SenderEmailAddress: "alice@example.com", KeyID: "k9"}, &reply); err != ErrUnknownKey {
+		t.Log("Signed with a generation that does not exist", err)
+		t.Fail()
+	}
+
+	if keys := s.PublicKeys(); len(keys) != 2 || keys[0].KeyID != "k2" || keys[1].DNS != "k1._KeyForge.example.com" {
+		t.Log("Unexpected public keys", keys)
+		t.Fail()
+	}
+
+	// Both generations' expiry is published, the active one's by default
+	expiry := &ExpiryServer{Server: &s, Delay: ExpiryDelay}
+	for path, keyID := range map[string]string{"/expire/example.com": "k1", "/expire/example.com?k=k2": "k2"} {
+		h := &old
+		if keyID == "k2" {
+			h = &successor
+		}
+
+		w := httptest.NewRecorder()
+		expiry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var doc utils.ExpiryDocument
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		if w.Code != http.StatusOK || doc.KeyID != keyID || len(doc.Nodes) == 0 || doc.Nodes[0].Secret != h.ExportNodePrivate(doc.Nodes[0].Path) {
+			t.Log("Wrong expiry published at", path, w.Code, doc.KeyID)
+			t.Fail()
+		}
+	}
+}
+
+func TestDelegatedSigning(t *testing.T) {
+	var master hibs.GSHIBE
+	master.Setup()
+
+	now := time.Now().UTC()
+	LoadHIBE(setupDelegatedKeys(t, &master, now.Add(utils.DefaultTree.Epoch)))
+	if !Delegated || H.MasterSecret != nil {
+		t.Fatal("Delegated keys were not loaded in place of the master secret")
+	}
+
+	zone := NewStaticResolver()
+	publishDays(&master, zone, now, now.Add(Tree.Epoch))
+	s := Server{DNS: testDNS, Cache: NewDNSCache(zone, 0)}
+
+	var reply SigReply
+	if err := s.Sign(&SigArgs{Sha256: "delegated"}, &reply); err != nil || !reply.Success {
+		t.Fatal("Delegated signing failed", err)
+	}
+
+	var vreply VerifyReply
+	s.Verify(VerifyArgs{Sha256: "delegated", DNS: testDNS, Signature: reply.Signature, Expiry: reply.Expiry}, &vreply)
+	if !vreply.Answer {
+		t.Log("Delegated signature failed to verify", vreply)
+		t.Fail()
+	}
+
+	// Outside the delegated month nothing can be signed
+	LoadHIBE(setupDelegatedKeys(t, &master, now.AddDate(0, 2, 0)))
+
+	reply = SigReply{}
+	if err := s.Sign(&SigArgs{Sha256: "delegated"}, &reply); err == nil || reply.Success {
+		t.Log("Signed outside the delegated month")
+		t.Fail()
+	}
+}
+
+func TestMultipleSigners(t *testing.T) {
+	Tree = &utils.DefaultTree
+	now := time.Now().UTC()
+	zone := NewStaticResolver()
+
+	configs := []utils.SignerConfig{
+		{Domain: "example.com"},
+		{Domain: "Example.ORG", Selector: "mail"},
+	}
+
+	for i := range configs {
+		var h hibs.GSHIBE
+		h.Setup()
+		configs[i].KeyDirectory = setupKeyDir(t, &h, true)
+
+		dns := configs[i].Selector + "." + strings.ToLower(configs[i].Domain)
+		if configs[i].Selector == "" {
+			dns = utils.DefaultSelector + "." + configs[i].Domain
+		}
+		publishDaysAt(&h, zone, dns, now, now.Add(Tree.Epoch))
+	}
+
+	err, signers := LoadSigners(configs)
+	if err != nil || len(signers) != 2 {
+		t.Fatal("Failed to load signers", err, signers)
+	}
+
+	s := Server{Signers: signers, Cache: NewDNSCache(zone, 0)}
+
+	for sender, dns := range map[string]string{
+		"alice@example.com":         "_KeyForge.example.com",
+		"Bob <bob@EXAMPLE.org>":     "mail.example.org",
+		"<carol@sub.a@example.org>": "mail.example.org",
+	} {
+		var reply SigReply
+		if err := s.Sign(&SigArgs{Sha256: "multiple", SenderEmailAddress: sender}, &reply); err != nil {
+			t.Log("Failed to sign for", sender, err)
+			t.Fail()
+			continue
+		}
+
+		if reply.DNS != dns || reply.Selector+"."+reply.Domain != dns {
+			t.Log("Signed for", sender, "with", reply.DNS, reply.Domain, reply.Selector)
+			t.Fail()
+		}
+
+		var vreply VerifyReply
+		s.Verify(VerifyArgs{Sha256: "multiple", DNS: reply.DNS, Signature: reply.Sig,
+			TreeVersion: reply.TreeVersion, Path: reply.Path, QValues: reply.QValues}, &vreply)
+		if !vreply.Answer {
+			t.Log("Signature for", sender, "failed to verify", vreply)
+			t.Fail()
+		}
+
+		// Not under another domain's keys
+		vreply = VerifyReply{}
+		other := "_KeyForge.example.com"
+		if dns == other {
+			other = "mail.example.org"
+		}
+		s.Verify(VerifyArgs{Sha256: "multiple", DNS: other, Signature: reply.Sig,
+			Path: reply.Path, QValues: reply.QValues}, &vreply)
+		if vreply.Answer {
+			t.Log("Signature for", sender, "verified under", other)
+			t.Fail()
+		}
+	}
+
+	var reply SigReply
+	if err := s.Sign(&SigArgs{Sha256: "multiple", SenderEmailAddress: "mallory@example.net"}, &reply); err == nil || reply.Success {
+		t.Log("Signed for a domain without keys")
+		t.Fail()
+	}
+
+	configs = append(configs, utils.SignerConfig{Domain: "EXAMPLE.com", KeyDirectory: configs[0].KeyDirectory})
+	if err, _ := LoadSigners(configs); err == nil {
+		t.Log("Loaded two signers for one domain")
+		t.Fail()
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	signArgs := SignBatchArgs{}
+	for i := 0; i < 5; i++ {
+		signArgs.Items = append(signArgs.Items, SigArgs{Sha256: "batch" + strconv.Itoa(i)})
+	}
+
+	var signReply SignBatchReply
+	if err := s.SignBatch(signArgs, &signReply); err != nil || len(signReply.Replies) != 5 {
+		t.Fatal("Batch signing failed", err, signReply)
+	}
+
+	verifyArgs := VerifyBatchArgs{}
+	for i, reply := range signReply.Replies {
+		if !reply.Success || reply.Error != "" {
+			t.Fatal("Item", i, "was not signed", reply)
+		}
+
+		verifyArgs.Items = append(verifyArgs.Items, VerifyArgs{
+			Sha256:    signArgs.Items[i].Sha256,
+			DNS:       testDNS,
+			Signature: reply.Sig,
+			Path:      reply.Path,
+			QValues:   reply.QValues,
+		})
+	}
+
+	// A bad signature, one that cannot be parsed and one for a missing domain
+	verifyArgs.Items[1].Sha256 = "This should not verify"
+	verifyArgs.Items = append(verifyArgs.Items,
+		VerifyArgs{Sha256: "batch0", DNS: testDNS, Signature: "x", Expiry: "soon"},
+		VerifyArgs{Sha256: "batch0", DNS: "_KeyForge.missing.example.com", Signature: signReply.Replies[0].Signature, Expiry: signReply.Replies[0].Expiry})
+
+	var verifyReply VerifyBatchReply
+	s.VerifyBatch(verifyArgs, &verifyReply)
+	if len(verifyReply.Replies) != len(verifyArgs.Items) {
+		t.Fatal("Expected a reply for each item", verifyReply)
+	}
+
+	for i, reply := range verifyReply.Replies {
+		switch i {
+		case 1:
+			if !reply.Success || reply.Answer {
+				t.Log("Bad signature in a batch verified", reply)
+				t.Fail()
+			}
+		case 5:
+			if reply.ErrorCode != ErrorMalformedSignature {
+				t.Log("Malformed signature in a batch", reply)
+				t.Fail()
+			}
+		case 6:
+			if reply.ErrorCode != ErrorNoRecord {
+				t.Log("Signature from a missing domain in a batch", reply)
+				t.Fail()
+			}
+		default:
+			if !reply.Success || !reply.Answer {
+				t.Log("Item", i, "of a batch failed to verify", reply)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	for _, test := range []struct {
+		list, etag string
+		matches    bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{`"b","a"`, `"a"`, true},
+		{`"1-300s:24,12-5"`, `"1-300s:24,12-5"`, true},
+		{`"1-300s:24", "12-5"`, `"1-300s:24,12-5"`, false},
+		{`"b", *`, `"a"`, true},
+		{`"a`, `"a"`, false},
+		{`a`, `"a"`, false},
+		{`"b", a, "a"`, `"a"`, false},
+		{` , `, `"a"`, false},
+	} {
+		if matchesETag(test.list, test.etag) != test.matches {
+			t.Log("If-None-Match:", test.list, "matching", test.etag, "is not", test.matches)
+			t.Fail()
+		}
+	}
+}
+
+func TestAPI(t *testing.T) {
+	s, _ := setupTestServer(t)
+	api := httptest.NewServer(NewAPI(s, nil))
+	defer api.Close()
+
+	post := func(path, body string) (int, []byte) {
+		resp, err := http.Post(api.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+
+	status, body := post("/v1/sign", `{"Sha256": "api"}`)
+	var sig SigReply
+	if err := json.Unmarshal(body, &sig); status != http.StatusOK || err != nil || !sig.Success {
+		t.Fatal("Signing failed", status, string(body))
+	}
+
+	args, _ := json.Marshal(VerifyArgs{Sha256: "api", DNS: testDNS, Signature: sig.Sig, Path: sig.Path, QValues: sig.QValues})
+	status, body = post("/v1/verify", string(args))
+	var reply VerifyReply
+	if err := json.Unmarshal(body, &reply); status != http.StatusOK || err != nil || !reply.Answer {
+		t.Log("Verification failed", status, string(body))
+		t.Fail()
+	}
+
+	// A bad signature is still a successful request
+	args, _ = json.Marshal(VerifyArgs{Sha256: "other", DNS: testDNS, Signature: sig.Sig, Path: sig.Path, QValues: sig.QValues})
+	status, body = post("/v1/verify", string(args))
+	reply = VerifyReply{}
+	if err := json.Unmarshal(body, &reply); status != http.StatusOK || err != nil || reply.Answer {
+		t.Log("Bad signature verified", status, string(body))
+		t.Fail()
+	}
+
+	// Or given as the header alone
+	header := sig.Header
+	header.Headers = []string{"from"}
+	header.BodyHash = "bh"
+	for hash, answer := range map[string]bool{"api": true, "other": false} {
+		args, _ = json.Marshal(VerifyArgs{Sha256: hash, Header: header.Fold()})
+		status, body = post("/v1/verify", string(args))
+		reply = VerifyReply{}
+		if err := json.Unmarshal(body, &reply); status != http.StatusOK || err != nil || reply.Answer != answer {
+			t.Log("Verifying", hash, "by its header gave", status, string(body))
+			t.Fail()
+		}
+	}
+
+	for _, c := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/v1/sign", `{"Sha256": `, http.StatusBadRequest},
+		{"/v1/sign", `{"Sha256": "api", "Unknown": 1}`, http.StatusBadRequest},
+		{"/v1/sign", `{}`, http.StatusBadRequest},
+		{"/v1/verify", `{"Sha256": "api", "DNS": "` + testDNS + `", "Signature": "x", "Expiry": "soon"}`, http.StatusBadRequest},
+		{"/v1/verify", `{"Sha256": "api", "DNS": "_KeyForge.missing.example.com", "Signature": "x", "Expiry": "soon"}`, http.StatusBadGateway},
+		{"/v1/verify", `{"Sha256": "api", "DNS": "` + testDNS + `"}`, http.StatusBadRequest},
+		{"/v1/verify", `{"Sha256": "api", "Header": "v=1; d=a..b"}`, http.StatusBadRequest},
+		{"/v1/verify", `{"Header": "` + header.String() + `"}`, http.StatusBadRequest},
+		{"/v1/public", `{}`, http.StatusMethodNotAllowed},
+		{"/v1/unknown", `{}`, http.StatusNotFound},
+	} {
+		if status, body := post(c.path, c.body); status != c.status {
+			t.Log("POST", c.path, c.body, "answered", status, "not", c.status, string(body))
+			t.Fail()
+		}
+	}
+
+	resp, err := http.Get(api.URL + "/v1/public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var public PublicReply
+	json.NewDecoder(resp.Body).Decode(&public)
+	resp.Body.Close()
+	if len(public.Keys) != 1 || public.Keys[0].Public != H.ExportPublic() || public.Keys[0].Tree != Tree.String() {
+		t.Log("Unexpected public keys", public)
+		t.Fail()
+	}
+
+	resp, err = http.Get(api.URL + "/v1/sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST" {
+		t.Log("GET of /v1/sign answered", resp.StatusCode, resp.Header)
+		t.Fail()
+	}
+
+	// Senders in domains without keys
+	s.Signers = map[string]*Signer{"example.com": {Domain: "example.com", Selector: "_KeyForge", HIBE: H, Tree: Tree}}
+	if status, body := post("/v1/sign", `{"Sha256": "api", "SenderEmailAddress": "eve@example.net"}`); status != http.StatusUnprocessableEntity {
+		t.Log("Signing for an unknown domain answered", status, string(body))
+		t.Fail()
+	}
+
+	resp, err = http.Get(api.URL + "/v1/public?domain=example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Log("Public key of an unknown domain answered", resp.StatusCode)
+		t.Fail()
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	auth := NewAuthenticator([]utils.ClientConfig{
+		{Name: "web", Token: "web-token", Domains: []string{"Example.com"}},
+		{Name: "any", Token: "any-token"},
+	})
+
+	api := httptest.NewServer(NewAPI(s, auth))
+	defer api.Close()
+
+	post := func(token, body string) int {
+		r, _ := http.NewRequest(http.MethodPost, api.URL+"/v1/sign", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, c := range []struct {
+		token, sender string
+		status        int
+	}{
+		{"", "alice@example.com", http.StatusUnauthorized},
+		{"wrong-token", "alice@example.com", http.StatusUnauthorized},
+		{"web-token", "alice@example.com", http.StatusOK},
+		{"web-token", "alice@example.org", http.StatusForbidden},
+		{"any-token", "alice@example.org", http.StatusOK},
+	} {
+		if status := post(c.token, `{"Sha256": "auth", "SenderEmailAddress": "`+c.sender+`"}`); status != c.status {
+			t.Log("Signing for", c.sender, "with", c.token, "answered", status, "not", c.status)
+			t.Fail()
+		}
+	}
+
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only read on Linux")
+	}
+
+	// Over the unix socket, by uid
+	serve := func(auth *Authenticator) string {
+		sock := filepath.Join(t.TempDir(), "kf.sock")
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go auth.ServeRPC(s, conn)
+			}
+		}()
+		return sock
+	}
+
+	call := func(sock, sender string) error {
+		client, err := jsonrpc.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		var reply SigReply
+		return client.Call("Server.Sign", &SigArgs{Sha256: "auth", SenderEmailAddress: sender}, &reply)
+	}
+
+	uid := uint32(os.Getuid())
+	sock := serve(NewAuthenticator([]utils.ClientConfig{{Name: "milter", UIDs: []uint32{uid}, Domains: []string{"example.com"}}}))
+
+	if err := call(sock, "alice@example.com"); err != nil {
+		t.Log("Signing over the unix socket failed", err)
+		t.Fail()
+	}
+
+	if err := call(sock, "alice@example.org"); err == nil || err.Error() != ErrForbiddenDomain.Error() {
+		t.Log("Signed for a forbidden domain over the unix socket", err)
+		t.Fail()
+	}
+
+	// Other users are turned away
+	sock = serve(NewAuthenticator([]utils.ClientConfig{{Name: "other", UIDs: []uint32{uid + 1}}}))
+	if err := call(sock, "alice@example.com"); err == nil {
+		t.Log("Unknown user signed over the unix socket")
+		t.Fail()
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewTokenBucket(2, 4)
+	b.Now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		if !b.Take(1) {
+			t.Fatal("Burst refused at", i)
+		}
+	}
+
+	if b.Take(1) || b.Hits() != 1 {
+		t.Log("Took beyond the burst", b.Hits())
+		t.Fail()
+	}
+
+	// Refilled at Rate, never beyond Burst
+	now = now.Add(time.Second)
+	if !b.Take(2) || b.Take(1) {
+		t.Log("Did not refill at the rate")
+		t.Fail()
+	}
+
+	now = now.Add(time.Hour)
+	if !b.Take(4) || b.Take(1) {
+		t.Log("Did not refill to the burst")
+		t.Fail()
+	}
+
+	var unlimited *TokenBucket = NewTokenBucket(0, 0)
+	if unlimited != nil || !unlimited.Take(1000) {
+		t.Log("Bucket without a rate limited")
+		t.Fail()
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	auth := NewAuthenticator([]utils.ClientConfig{{Name: "web", Token: "web-token", Rate: 0.001, Burst: 2}})
+	api := httptest.NewServer(NewAPI(s, auth))
+	defer api.Close()
+
+	sign := func() *http.Response {
+		r, _ := http.NewRequest(http.MethodPost, api.URL+"/v1/sign", strings.NewReader(`{"Sha256": "limited"}`))
+		r.Header.Set("Authorization", "Bearer web-token")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := sign(); resp.StatusCode != http.StatusOK {
+			t.Fatal("Signing within the limit answered", resp.StatusCode)
+		}
+	}
+
+	if resp := sign(); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Log("Signing beyond the client's limit answered", resp.StatusCode)
+		t.Fail()
+	}
+
+	if auth.Clients[0].Limit.Hits() != 1 {
+		t.Log("Limit hit not counted", auth.Clients[0].Limit.Hits())
+		t.Fail()
+	}
+
+	// Per sender domain, whoever asks
+	s.Signers = map[string]*Signer{"example.com": {Domain: "example.com", Selector: "_KeyForge",
+		HIBE: H, Tree: Tree, Limit: NewTokenBucket(0.001, 1)}}
+
+	var reply SigReply
+	if err := s.Sign(&SigArgs{Sha256: "limited", SenderEmailAddress: "a@example.com"}, &reply); err != nil || !reply.Success {
+		t.Fatal("Signing within the domain's limit failed", err, reply)
+	}
+
+	reply = SigReply{}
+	if err := s.Sign(&SigArgs{Sha256: "limited", SenderEmailAddress: "a@example.com"}, &reply); err != nil || reply.Success || reply.ErrorCode != ErrorRateLimited {
+		t.Log("Signing beyond the domain's limit", err, reply)
+		t.Fail()
+	}
+
+	var batch SignBatchReply
+	s.SignBatch(SignBatchArgs{Items: []SigArgs{{Sha256: "limited", SenderEmailAddress: "b@example.com"}}}, &batch)
+	if batch.Replies[0].Success || batch.Replies[0].ErrorCode != ErrorRateLimited {
+		t.Log("Batch item beyond the domain's limit", batch.Replies[0])
+		t.Fail()
+	}
+}
+
+func TestReload(t *testing.T) {
+	var old, renewed hibs.GSHIBE
+	old.Setup()
+	renewed.Setup()
+
+	config := utils.SignerConfig{Domain: "example.com", KeyDirectory: setupKeyDir(t, &old, true), Rate: 10}
+	err, signers := LoadSigners([]utils.SignerConfig{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Server{Signers: signers}
+	signers["example.com"].Limit.Take(5)
+
+	expiry := &ExpiryServer{Server: &s, Delay: ExpiryDelay}
+	publishedBy := func(path string, h *hibs.GSHIBE) bool {
+		w := httptest.NewRecorder()
+		expiry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			return false
+		}
+
+		var doc utils.ExpiryDocument
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		return len(doc.Nodes) > 0 && doc.Nodes[0].Secret == h.ExportNodePrivate(doc.Nodes[0].Path)
+	}
+
+	if !publishedBy("/expire/example.com", &old) {
+		t.Fatal("Expiry not published")
+	}
+
+	// New keys written by keyforge-generate
+	config.KeyDirectory = setupKeyDir(t, &renewed, true)
+	err, signers = LoadSigners([]utils.SignerConfig{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetSigners(signers)
+
+	if keys := s.PublicKeys(); len(keys) != 1 || keys[0].Public != renewed.ExportPublic() {
+		t.Log("Still signing with the old keys", keys)
+		t.Fail()
+	}
+
+	if !publishedBy("/expire/example.com", &renewed) || !publishedBy("/expire", &renewed) {
+		t.Log("Still publishing the old keys' expiry")
+		t.Fail()
+	}
+
+	w := httptest.NewRecorder()
+	expiry.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/expire/example.org", nil))
+	if w.Code != http.StatusNotFound {
+		t.Log("Published expiry for a domain without keys", w.Code)
+		t.Fail()
+	}
+
+	// The same rate, so the same bucket with what was used of it
+	if !s.Signers["example.com"].Limit.Take(5) || s.Signers["example.com"].Limit.Take(1) {
+		t.Log("Rate limit bucket not kept across the reload")
+		t.Fail()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	// A request under way
+	if err := s.requests.begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Log("Shutdown did not wait for the request", err)
+		t.Fail()
+	}
+
+	var reply SigReply
+	if err := s.Sign(&SigArgs{Sha256: "late"}, &reply); err != ErrShuttingDown || reply.Success {
+		t.Log("Signed while shutting down", err)
+		t.Fail()
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-done:
+		t.Fatal("Shutdown returned with a request under way", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	s.requests.end()
+	if err := <-done; err != nil {
+		t.Log("Shutdown failed once the request ended", err)
+		t.Fail()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s, _ := setupTestServer(t)
+	s.Signers = map[string]*Signer{"example.com": {Domain: "example.com", Selector: "_KeyForge",
+		HIBE: H, Tree: Tree, Limit: NewTokenBucket(0.001, 1)}}
+
+	success := labels("result", "success")
+	limited := labels("result", string(ErrorRateLimited))
+	failed := labels("result", "verify-failed")
+	missing := labels("dns", "_keyforge.metrics.example.com", "code", string(ErrorNoRecord))
+
+	signs, limits, verifies := metrics.signs.get(success), metrics.signs.get(limited), metrics.verifies.get(failed)
+	misses := metrics.failures.get(missing)
+
+	var reply SigReply
+	s.Sign(&SigArgs{Sha256: "counted", SenderEmailAddress: "a@example.com"}, &reply)
+	s.Sign(&SigArgs{Sha256: "counted", SenderEmailAddress: "a@example.com"}, &SigReply{})
+
+	var vreply VerifyReply
+	s.Verify(VerifyArgs{Sha256: "not counted", DNS: reply.DNS, Signature: reply.Sig, Path: reply.Path, QValues: reply.QValues}, &vreply)
+	s.Verify(VerifyArgs{Sha256: "counted", DNS: "_KeyForge.metrics.example.com", Signature: reply.Sig, Path: reply.Path, QValues: reply.QValues}, &VerifyReply{})
+
+	if metrics.signs.get(success) != signs+1 || metrics.signs.get(limited) != limits+1 {
+		t.Log("Signings not counted by result")
+		t.Fail()
+	}
+
+	if metrics.verifies.get(failed) != verifies+1 || metrics.failures.get(missing) != misses+1 {
+		t.Log("Verifications not counted by result", vreply)
+		t.Fail()
+	}
+
+	w := httptest.NewRecorder()
+	(&MetricsHandler{Server: s}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE keyforge_sign_total counter\n",
+		"keyforge_verify_lookup_failures_total{" + missing + "} ",
+		`keyforge_rate_limit_hits_total{domain="example.com"} 1` + "\n",
+		`keyforge_dns_cache_lookups_total{result="miss"} `,
+		"# TYPE keyforge_pairing_duration_seconds histogram\n",
+		`keyforge_verify_duration_seconds_bucket{le="+Inf"} `,
+		"keyforge_sign_duration_seconds_count ",
+	} {
+		if !strings.Contains(body, line) {
+			t.Log("Missing from metrics:", line)
+			t.Fail()
+		}
+	}
+
+	if labels("dns", "a\"b\\c\nd") != `dns="a\"b\\c\nd"` {
+		t.Log("Label values not escaped", labels("dns", "a\"b\\c\nd"))
+		t.Fail()
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	s, _ := setupTestServer(t)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	err, audit := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Audit = audit
+
+	records := func(path string) []AuditRecord {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var records []AuditRecord
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record AuditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatal("Malformed audit record", line)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+
+	client := &ClientServer{s, &Client{ClientConfig: utils.ClientConfig{Name: "milter"}}}
+
+	var reply SigReply
+	if err := client.Sign(&SigArgs{Sha256: "audited", SenderEmailAddress: "Alice <alice@Example.com>", RequestID: "req-1"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	got := records(path)
+	if len(got) != 1 || got[0].RequestID != "req-1" || reply.RequestID != "req-1" || got[0].Client != "milter" ||
+		got[0].Sha256 != "audited" || got[0].Domain != "example.com" || got[0].DNS != testDNS ||
+		strings.Join(got[0].Path, "/") != strings.Join(reply.Path, "/") {
+		t.Log("Unexpected audit record", got)
+		t.Fail()
+	}
+
+	// Rotated away, the next record starts a new file
+	os.Rename(path, path+".1")
+	if err := audit.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SignBatch(SignBatchArgs{Items: []SigArgs{{Sha256: "batched"}}}, &SignBatchReply{})
+	if got := records(path); len(got) != 1 || got[0].Sha256 != "batched" || got[0].Client != "" || got[0].RequestID == "" {
+		t.Log("Unexpected audit record after rotation", got)
+		t.Fail()
+	}
+	if got := records(path + ".1"); len(got) != 1 {
+		t.Log("Rotated audit log was written to", got)
+		t.Fail()
+	}
+
+	// Nothing is signed that could not be recorded
+	audit.Close()
+	reply = SigReply{}
+	if err := s.Sign(&SigArgs{Sha256: "unrecorded"}, &reply); err != ErrAudit || reply.Success || reply.Signature != "" {
+		t.Log("Signed without an audit record", err, reply)
+		t.Fail()
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	if requestID("abc-123") != "abc-123" {
+		t.Log("Request ID not kept")
+		t.Fail()
+	}
+
+	for _, given := range []string{"", "with space", "new\nline", strings.Repeat("x", maxRequestID+1)} {
+		if id := requestID(given); id == given || len(id) != 16 {
+			t.Log("Request ID", strconv.Quote(given), "became", id)
+			t.Fail()
+		}
+	}
+
+	s, _ := setupTestServer(t)
+	api := httptest.NewServer(NewAPI(s, nil))
+	defer api.Close()
+
+	r, _ := http.NewRequest(http.MethodPost, api.URL+"/v1/sign", strings.NewReader(`{"Sha256": "traced"}`))
+	r.Header.Set("X-Request-ID", "trace-7")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var reply SigReply
+	json.NewDecoder(resp.Body).Decode(&reply)
+	if resp.Header.Get("X-Request-ID") != "trace-7" || reply.RequestID != "trace-7" {
+		t.Log("Request ID not echoed", resp.Header.Get("X-Request-ID"), reply.RequestID)
+		t.Fail()
+	}
+}
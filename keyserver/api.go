@@ -0,0 +1,311 @@
+package keyserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Largest request body the API reads
+const maxAPIRequest = 1 << 20
+
+/*
+API serves a Server over HTTP with JSON bodies, for services that do not speak
+JSON-RPC:
+
+	POST /v1/sign	SigArgs in, SigReply out
+	POST /v1/verify	VerifyArgs in, VerifyReply out; the signature given by
+			Header, or by DNS and Signature
+	GET  /v1/public	the public keys published, as PublicReply
+
+A failed signing is answered with an APIError. Verification always answers
+with a VerifyReply, its status telling a bad signature (200 with Answer false)
+from one that could not be checked.
+
+Signing and verifying are only for the clients Auth recognises, by bearer
+token or TLS client certificate; the public keys are for anyone.
+*/
+type API struct {
+	Server *Server
+	Auth   *Authenticator // nil lets anyone in
+	mux    *http.ServeMux
+}
+
+// The body of an error reply
+type APIError struct {
+	Error string
+}
+
+// One public key signed with, as published in DNS
+type PublicKey struct {
+	Domain    string // empty without Signers
+	Selector  string // empty without Signers
+	DNS       string // where the records are
+	Public    string // the public= tag of the record
+	Tree      string // the tree= tag of the record
+	Delegated bool   // whether only delegated keys are held
+
+	KeyID      string    // the generation, empty for keys without one
+	ActiveFrom time.Time // when signing with it began, or begins
+}
+
+type PublicReply struct {
+	Keys []PublicKey
+}
+
+func NewAPI(s *Server, auth *Authenticator) *API {
+	a := API{Server: s, Auth: auth, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/v1/sign", a.sign)
+	a.mux.HandleFunc("/v1/verify", a.verify)
+	a.mux.HandleFunc("/v1/public", a.public)
+	return &a
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, APIError{message})
+}
+
+// Answers 405 unless r uses method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || method == http.MethodGet && r.Method == http.MethodHead {
+		return true
+	}
+
+	allow := method
+	if method == http.MethodGet {
+		allow += ", " + http.MethodHead
+	}
+	w.Header().Set("Allow", allow)
+	writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+// Decodes r's JSON body into v, answering 400 or 415 if it cannot
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" && !strings.HasPrefix(contentType, "application/json") {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "expected application/json")
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequest))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "malformed request: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+// The client that sent r, answering 401 if there is none. Without Auth,
+// anyone may do anything.
+func (a *API) client(w http.ResponseWriter, r *http.Request) (*Client, bool) {
+	if a.Auth == nil {
+		return &Client{}, true
+	}
+
+	if c := a.Auth.ByRequest(r); c != nil {
+		return c, true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="keyforge"`)
+	writeAPIError(w, http.StatusUnauthorized, "unknown client")
+	return nil, false
+}
+
+func (a *API) sign(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	client, ok := a.client(w, r)
+	if !ok {
+		return
+	}
+
+	var args SigArgs
+	if !readJSON(w, r, &args) {
+		return
+	}
+
+	if args.Sha256 == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing Sha256")
+		return
+	}
+
+	if args.RequestID == "" {
+		args.RequestID = r.Header.Get("X-Request-ID")
+	}
+
+	var reply SigReply
+	if client.refuse(&args, &reply) {
+		w.Header().Set("X-Request-ID", reply.RequestID)
+		writeRefusal(w, &reply)
+		return
+	}
+
+	err := a.Server.sign(&args, &reply, client.Name)
+	w.Header().Set("X-Request-ID", reply.RequestID)
+
+	switch {
+	case err == nil && !reply.Success:
+		writeRefusal(w, &reply)
+	case err == nil:
+		writeJSON(w, http.StatusOK, reply)
+	case err == ErrUnknownDomain, err == ErrUnknownKey:
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+	case err == ErrNoLeafKey, err == ErrShuttingDown:
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Answers a signing that was refused, as reply says
+func writeRefusal(w http.ResponseWriter, reply *SigReply) {
+	switch reply.ErrorCode {
+	case ErrorRateLimited:
+		w.Header().Set("Retry-After", "1")
+		writeAPIError(w, http.StatusTooManyRequests, reply.Error)
+	case ErrorForbidden:
+		writeAPIError(w, http.StatusForbidden, reply.Error)
+	default:
+		writeAPIError(w, http.StatusInternalServerError, reply.Error)
+	}
+}
+
+// The status a verification is answered with
+func verifyStatus(reply *VerifyReply) int {
+	switch reply.ErrorCode {
+	case ErrorNone, ErrorExpired:
+		return http.StatusOK
+	case ErrorMalformedSignature:
+		return http.StatusBadRequest
+	case ErrorTimeout:
+		return http.StatusGatewayTimeout
+	}
+
+	// The sender's records could not be had, or used
+	return http.StatusBadGateway
+}
+
+func (a *API) verify(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if _, ok := a.client(w, r); !ok {
+		return
+	}
+
+	var args VerifyArgs
+	if !readJSON(w, r, &args) {
+		return
+	}
+
+	if args.Sha256 == "" || args.Header == "" && (args.DNS == "" || args.Signature == "") {
+		writeAPIError(w, http.StatusBadRequest, "missing Sha256, or Header or DNS and Signature")
+		return
+	}
+
+	if args.RequestID == "" {
+		args.RequestID = r.Header.Get("X-Request-ID")
+	}
+
+	var reply VerifyReply
+	err := a.Server.Verify(args, &reply)
+	w.Header().Set("X-Request-ID", reply.RequestID)
+
+	if err == ErrShuttingDown {
+		writeAPIError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, verifyStatus(&reply), reply)
+}
+
+// Every generation of the keys signer stands for, newest first
+func publicKeys(signer *Signer, dns string) []PublicKey {
+	generations := signer.Generations
+	if len(generations) == 0 {
+		generations = []*Signer{signer}
+	}
+
+	keys := make([]PublicKey, 0, len(generations))
+	for _, g := range generations {
+		keys = append(keys, PublicKey{
+			Domain:     signer.Domain,
+			Selector:   signer.Selector,
+			DNS:        withKeyID(g.KeyID, dns),
+			Public:     g.HIBE.ExportPublic(),
+			Tree:       g.Tree.String(),
+			Delegated:  g.Delegated,
+			KeyID:      g.KeyID,
+			ActiveFrom: g.ActiveFrom,
+		})
+	}
+	return keys
+}
+
+// The public keys s signs with, by domain, each domain's generations newest
+// first
+func (s *Server) PublicKeys() []PublicKey {
+	s.keys.RLock()
+	defer s.keys.RUnlock()
+
+	keys := make([]PublicKey, 0)
+
+	if len(s.Signers) == 0 {
+		if H != nil && Tree != nil {
+			keys = append(keys, publicKeys(globalSigner(), s.DNS)...)
+		}
+		return keys
+	}
+
+	for _, signer := range s.Signers {
+		keys = append(keys, publicKeys(signer, signer.Selector+"."+signer.Domain)...)
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Domain < keys[j].Domain })
+	return keys
+}
+
+// Lists the public keys, only those of ?domain= if given
+func (a *API) public(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	domain := strings.ToLower(r.URL.Query().Get("domain"))
+
+	reply := PublicReply{Keys: make([]PublicKey, 0)}
+	for _, key := range a.Server.PublicKeys() {
+		if domain == "" || key.Domain == domain {
+			reply.Keys = append(reply.Keys, key)
+		}
+	}
+
+	if domain != "" && len(reply.Keys) == 0 {
+		writeAPIError(w, http.StatusNotFound, "no key for "+domain)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, reply)
+}
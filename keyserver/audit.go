@@ -0,0 +1,83 @@
+package keyserver
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// One signature issued, as the audit log records it
+type AuditRecord struct {
+	Time      time.Time
+	RequestID string
+	Client    string   // who asked, empty when signing in-process
+	Sha256    string   // the hash signed
+	Domain    string   // the sender's domain
+	DNS       string   // the records of the keys signed with, <selector>.<domain>
+	Path      []string // the leaf signed for
+}
+
+/*
+AuditLog appends a record of every signature issued to a file, one JSON
+object per line. The file is only ever appended to; to rotate it, rename it
+and call Reopen, which starts a new one at Path, as logrotate's create mode
+does.
+*/
+type AuditLog struct {
+	Path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openAuditFile(path string) (error, *os.File) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return err, file
+}
+
+// Opens the audit log at path, creating it if it is not there
+func OpenAuditLog(path string) (error, *AuditLog) {
+	err, file := openAuditFile(path)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &AuditLog{Path: path, file: file}
+}
+
+// Appends record, in a single write so concurrent records never interleave
+func (a *AuditLog) Record(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// Closes the file and opens Path again, after it was rotated. The old file
+// is kept if the new one cannot be opened.
+func (a *AuditLog) Reopen() error {
+	err, file := openAuditFile(a.Path)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	old := a.file
+	a.file = file
+	return old.Close()
+}
+
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,237 @@
+package keyserver
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// Returned when a client signs for a sender its policy does not allow
+var ErrForbiddenDomain = errors.New("client may not sign for the sender's domain")
+
+// A client allowed to use the server, see utils.ClientConfig
+type Client struct {
+	utils.ClientConfig
+	Limit *TokenBucket // How often it may sign, nil for always
+}
+
+// Refuses in reply a signing c may not ask for: for a sender it may not sign
+// for, or beyond its rate limit. Reports whether it did. Gives args its
+// request ID, so the refusal is logged with it.
+func (c *Client) refuse(args *SigArgs, reply *SigReply) bool {
+	args.RequestID = requestID(args.RequestID)
+	reply.RequestID = args.RequestID
+
+	if !c.MaySign(args.SenderEmailAddress) {
+		requestLogger(args.RequestID).Warn("client may not sign for the sender", "client", c.Name,
+			"sender", args.SenderEmailAddress)
+		reply.Error = ErrForbiddenDomain.Error()
+		reply.ErrorCode = ErrorForbidden
+		metrics.signed(nil, reply)
+		return true
+	}
+
+	if !c.Limit.Take(1) {
+		requestLogger(args.RequestID).Warn("rate limit reached", "client", c.Name)
+		setRateLimited(reply, "client "+c.Name)
+		metrics.signed(nil, reply)
+		return true
+	}
+
+	return false
+}
+
+// Whether c may sign for mail from sender
+func (c *Client) MaySign(sender string) bool {
+	if len(c.Domains) == 0 {
+		return true
+	}
+
+	domain := emailDomain(sender)
+	for _, allowed := range c.Domains {
+		if strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Recognises clients by how they connected
+type Authenticator struct {
+	Clients []*Client
+}
+
+// An Authenticator for configs. Without any, the user the server runs as is
+// the only client.
+func NewAuthenticator(configs []utils.ClientConfig) *Authenticator {
+	if len(configs) == 0 {
+		configs = []utils.ClientConfig{{Name: "local", UIDs: []uint32{uint32(os.Getuid())}}}
+	}
+
+	var a Authenticator
+	for _, config := range configs {
+		a.Clients = append(a.Clients, &Client{config, NewTokenBucket(config.Rate, config.Burst)})
+	}
+
+	return &a
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// The client a unix socket peer running as uid and gid is, or nil
+func (a *Authenticator) ByPeer(uid, gid uint32) *Client {
+	for _, c := range a.Clients {
+		if containsID(c.UIDs, uid) || containsID(c.GIDs, gid) {
+			return c
+		}
+	}
+	return nil
+}
+
+// The client with the bearer token, or nil
+func (a *Authenticator) ByToken(token string) *Client {
+	if token == "" {
+		return nil
+	}
+
+	for _, c := range a.Clients {
+		if c.Token != "" && subtle.ConstantTimeCompare([]byte(c.Token), []byte(token)) == 1 {
+			return c
+		}
+	}
+	return nil
+}
+
+// The client with a verified certificate, or nil
+func (a *Authenticator) ByCertificate(cert *x509.Certificate) *Client {
+	for _, c := range a.Clients {
+		if c.CertSubject != "" && c.CertSubject == cert.Subject.CommonName {
+			return c
+		}
+	}
+	return nil
+}
+
+// The client that sent r, by its TLS client certificate or bearer token, or
+// nil
+func (a *Authenticator) ByRequest(r *http.Request) *Client {
+	// Only certificates the TLS config verified count
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if c := a.ByCertificate(r.TLS.VerifiedChains[0][0]); c != nil {
+			return c
+		}
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return a.ByToken(strings.TrimSpace(authorization[7:]))
+	}
+
+	return nil
+}
+
+// The client at the other end of a unix socket
+func (a *Authenticator) ByConn(conn net.Conn) (error, *Client) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("not a unix socket"), nil
+	}
+
+	err, uid, gid := peerCredentials(unixConn)
+	if err != nil {
+		return err, nil
+	}
+
+	if c := a.ByPeer(uid, gid); c != nil {
+		return nil, c
+	}
+
+	return fmt.Errorf("no client for uid %d gid %d", uid, gid), nil
+}
+
+// Serves JSON-RPC on a unix socket connection, for the client at its other end
+func (a *Authenticator) ServeRPC(s *Server, conn net.Conn) {
+	err, client := a.ByConn(conn)
+	if err != nil {
+		Logger.Warn("refused connection on the unix socket", "error", err)
+		conn.Close()
+		return
+	}
+
+	server := rpc.NewServer()
+	server.RegisterName("Server", &ClientServer{s, client})
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+/*
+ClientServer is a Server as one client may use it, registered with net/rpc
+under the name Server for each connection. Signing is refused for senders the
+client may not sign for, and beyond the client's rate limit.
+*/
+type ClientServer struct {
+	Server *Server
+	Client *Client
+}
+
+func (c *ClientServer) Sign(args *SigArgs, reply *SigReply) error {
+	if c.Client.refuse(args, reply) {
+		if reply.ErrorCode == ErrorForbidden {
+			return ErrForbiddenDomain
+		}
+
+		// Rate limited, which the reply tells
+		return nil
+	}
+
+	return c.Server.sign(args, reply, c.Client.Name)
+}
+
+func (c *ClientServer) SignBatch(args SignBatchArgs, reply *SignBatchReply) error {
+	reply.Replies = make([]SigReply, len(args.Items))
+
+	allowed := SignBatchArgs{}
+	indexes := make([]int, 0, len(args.Items))
+	for i := range args.Items {
+		if !c.Client.refuse(&args.Items[i], &reply.Replies[i]) {
+			allowed.Items = append(allowed.Items, args.Items[i])
+			indexes = append(indexes, i)
+		}
+	}
+
+	var allowedReply SignBatchReply
+	if err := c.Server.signBatch(allowed, &allowedReply, c.Client.Name); err != nil {
+		return err
+	}
+
+	// Back in the order asked for
+	for j, i := range indexes {
+		reply.Replies[i] = allowedReply.Replies[j]
+	}
+
+	return nil
+}
+
+func (c *ClientServer) Verify(args VerifyArgs, reply *VerifyReply) error {
+	return c.Server.Verify(args, reply)
+}
+
+func (c *ClientServer) VerifyBatch(args VerifyBatchArgs, reply *VerifyBatchReply) error {
+	return c.Server.VerifyBatch(args, reply)
+}
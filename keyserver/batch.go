@@ -0,0 +1,237 @@
+package keyserver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+type SignBatchArgs struct {
+	Items []SigArgs
+}
+
+type SignBatchReply struct {
+	Replies []SigReply // One for each item, in order; see SigReply.Error
+}
+
+type VerifyBatchArgs struct {
+	Items []VerifyArgs
+}
+
+type VerifyBatchReply struct {
+	Replies []VerifyReply // One for each item, in order
+}
+
+/*
+SignBatch signs many hashes at once. Items from senders in the same domain
+are signed for the same leaf, extracted once. An item that cannot be signed
+has its reply's Error set; the rest are still signed. Each item counts
+against its domain's rate limit.
+*/
+func (s *Server) SignBatch(args SignBatchArgs, reply *SignBatchReply) error {
+	return s.signBatch(args, reply, "")
+}
+
+// Signs a batch for client, see signLeaf
+func (s *Server) signBatch(args SignBatchArgs, reply *SignBatchReply, client string) error {
+	if err := s.requests.begin(); err != nil {
+		return err
+	}
+	defer s.requests.end()
+
+	defer metrics.signTime.since(time.Now())
+
+	now := time.Now().UTC()
+
+	// By signer domain and key ID, see leafKey
+	leaves := make(map[string]*signingLeaf)
+	leafErrors := make(map[string]error)
+
+	reply.Replies = make([]SigReply, len(args.Items))
+
+	for i := range args.Items {
+		item := &args.Items[i]
+		item.RequestID = requestID(item.RequestID)
+		reply.Replies[i].RequestID = item.RequestID
+
+		err := s.signBatchItem(item, client, now, leaves, leafErrors, &reply.Replies[i])
+		if err != nil {
+			reply.Replies[i].Error = err.Error()
+			requestLogger(item.RequestID).Warn("cannot sign", "client", client,
+				"sender", item.SenderEmailAddress, "error", err)
+		}
+		metrics.signed(err, &reply.Replies[i])
+	}
+
+	Logger.Debug("signed a batch", "client", client, "items", len(args.Items))
+
+	return nil
+}
+
+// Signs one item of a batch into reply, with the leaf of its signer's domain
+// from leaves, or from leafErrors why there is none, picking it if not yet
+// picked
+func (s *Server) signBatchItem(item *SigArgs, client string, now time.Time, leaves map[string]*signingLeaf, leafErrors map[string]error, reply *SigReply) error {
+	err, signer := s.signerForArgs(item)
+	if err != nil {
+		return err
+	}
+
+	if !signer.Limit.Take(1) {
+		requestLogger(item.RequestID).Warn("rate limit reached", "domain", signer.Domain)
+		setRateLimited(reply, "sender domain "+signer.Domain)
+		return nil
+	}
+
+	key := leafKey(signer)
+	leaf, ok := leaves[key]
+	if !ok {
+		err, leaf = signer.leaf(now)
+		leaves[key] = leaf
+		leafErrors[key] = err
+	}
+
+	if err := leafErrors[key]; err != nil {
+		return err
+	}
+
+	return s.signLeaf(signer, leaf, item, client, reply)
+}
+
+// Identifies the keys a leaf was picked from within a batch, as a domain may
+// sign with more than one generation of keys
+func leafKey(signer *Signer) string {
+	return signer.Domain + "/" + signer.KeyID
+}
+
+/*
+VerifyBatch verifies many signatures at once. Records are looked up once for
+each node however many items share it, and the signatures under each public
+key are checked together by hibs.BatchVerify.
+*/
+func (s *Server) VerifyBatch(args VerifyBatchArgs, reply *VerifyBatchReply) error {
+	if err := s.requests.begin(); err != nil {
+		return err
+	}
+	defer s.requests.end()
+	defer metrics.verifyTime.since(time.Now())
+
+	batch := newVerifyBatch()
+
+	reply.Replies = make([]VerifyReply, len(args.Items))
+
+	// Indexes of the items ready to check, by their sender's public key
+	groups := make(map[*hibs.GSHIBE][]int)
+	pending := make([]*pendingVerify, len(args.Items))
+
+	for i := range args.Items {
+		args.Items[i].RequestID = requestID(args.Items[i].RequestID)
+		reply.Replies[i].RequestID = args.Items[i].RequestID
+
+		if pending[i] = s.prepareVerify(&args.Items[i], &reply.Replies[i], batch); pending[i] != nil {
+			groups[pending[i].hibe] = append(groups[pending[i].hibe], i)
+		}
+	}
+
+	for h, indexes := range groups {
+		items := make([]hibs.BatchItem, 0, len(indexes))
+		for _, i := range indexes {
+			items = append(items, pending[i].item())
+		}
+
+		start := time.Now()
+		valid := h.BatchVerify(items)
+		metrics.pairingTime.since(start)
+
+		for j, i := range indexes {
+			reply.Replies[i].Success = true
+			reply.Replies[i].Answer = valid[j]
+			pending[i].log(valid[j])
+		}
+	}
+
+	for i := range args.Items {
+		metrics.verified(&args.Items[i], &reply.Replies[i])
+	}
+
+	return nil
+}
+
+// Lookups shared by the items of a batch, so that each record is fetched and
+// parsed once. A nil *verifyBatch shares nothing.
+type verifyBatch struct {
+	trees   map[string]treeLookup   // by DNS
+	publics map[string]publicLookup // by DNS and day path
+	hibes   map[string]*hibs.GSHIBE // by encoded master public key
+}
+
+type treeLookup struct {
+	err  error
+	tree *utils.TimeTree
+}
+
+type publicLookup struct {
+	err    error
+	mpk    string
+	public []string
+}
+
+func newVerifyBatch() *verifyBatch {
+	return &verifyBatch{
+		trees:   make(map[string]treeLookup),
+		publics: make(map[string]publicLookup),
+		hibes:   make(map[string]*hibs.GSHIBE),
+	}
+}
+
+func (b *verifyBatch) tree(cache DNSCache, dns string) (error, *utils.TimeTree) {
+	if b == nil {
+		return cache.GetTreeFromDNS(dns)
+	}
+
+	lookup, ok := b.trees[dns]
+	if !ok {
+		lookup.err, lookup.tree = cache.GetTreeFromDNS(dns)
+		b.trees[dns] = lookup
+	}
+
+	return lookup.err, lookup.tree
+}
+
+func (b *verifyBatch) public(cache DNSCache, dns string, path []string) (error, string, []string) {
+	if b == nil {
+		return cache.GetPublicFromDNS(dns, path)
+	}
+
+	key := dns + "/" + strings.Join(path, "/")
+
+	lookup, ok := b.publics[key]
+	if !ok {
+		lookup.err, lookup.mpk, lookup.public = cache.GetPublicFromDNS(dns, path)
+		b.publics[key] = lookup
+	}
+
+	return lookup.err, lookup.mpk, lookup.public
+}
+
+// The public parameters encoded in mpk
+func (b *verifyBatch) hibe(mpk string) (error, *hibs.GSHIBE) {
+	if b != nil {
+		if h, ok := b.hibes[mpk]; ok {
+			return nil, h
+		}
+	}
+
+	var h hibs.GSHIBE
+	if err := h.SetupPublicFromString(mpk); err != nil {
+		return err, nil
+	}
+
+	if b != nil {
+		b.hibes[mpk] = &h
+	}
+
+	return nil, &h
+}
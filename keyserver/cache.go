@@ -0,0 +1,423 @@
+package keyserver
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+type DNSCache interface {
+	GetTreeFromDNS(dns string) (err error, tree *utils.TimeTree)
+	GetPublicFromDNS(dns string, path []string) (err error, mpk string, public []string)
+}
+
+const (
+	// How long to keep records whose TTL the resolver can't tell us
+	DefaultCacheTTL = 5 * time.Minute
+	// Upper bound on how long any tree node is cached, whatever its TTL
+	MaxCacheTTL = 24 * time.Hour
+	// Number of tree nodes held before the least recently used is evicted
+	DefaultCacheSize = 10000
+	// How long a failed lookup is remembered before DNS is asked again
+	NegativeCacheTTL = time.Minute
+	// Longest chain of <tag>_<n> records a single tree node may span
+	MaxNodeRecords = 64
+)
+
+// Why a lookup of KeyForge records failed
+type LookupError struct {
+	Code ErrorCode
+	Name string // the DNS name being resolved
+	Err  error
+}
+
+func (e *LookupError) Error() string {
+	if e.Err == nil {
+		return string(e.Code) + ": " + e.Name
+	}
+	return string(e.Code) + ": " + e.Name + ": " + e.Err.Error()
+}
+
+// Classifies err from a resolver into a LookupError
+func newLookupError(name string, err error) *LookupError {
+	code := ErrorServerFailure
+
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		if dnsErr.IsNotFound {
+			code = ErrorNoRecord
+		} else if dnsErr.IsTimeout {
+			code = ErrorTimeout
+		}
+	}
+
+	return &LookupError{code, name, err}
+}
+
+// Whether a failure is worth remembering. Timeouts are transient on our side,
+// so those are retried on the next message rather than cached.
+func cacheableError(err error) bool {
+	lookupErr, ok := err.(*LookupError)
+	return ok && lookupErr.Code != ErrorTimeout
+}
+
+// A cached tree node, or the reason it couldn't be fetched
+type cacheEntry struct {
+	key     string
+	values  map[string]string
+	err     error
+	expires time.Time
+}
+
+// A lookup in progress, shared by every caller asking for the same node
+type pendingFetch struct {
+	done   chan struct{}
+	err    error
+	values map[string]string
+}
+
+type _DNSCache struct {
+	// Where TXT queries are sent
+	Resolver Resolver
+
+	// Maximum number of tree nodes to cache
+	MaxEntries int
+
+	// Tries at each lookup, and the wait between them
+	Attempts int
+	Backoff  time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element // domain|node -> element holding a *cacheEntry
+	lru      *list.List               // most recently used at the front
+	inflight map[string]*pendingFetch
+	now      func() time.Time
+}
+
+// Creates a cache of at most size tree nodes that fetches records through
+// resolver. A nil resolver means the system resolver, and a size of 0 means
+// DefaultCacheSize.
+func NewDNSCache(resolver Resolver, size int) DNSCache {
+	var retval _DNSCache
+
+	if resolver == nil {
+		resolver = &SystemResolver{}
+	}
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+
+	retval.Resolver = resolver
+	retval.MaxEntries = size
+	retval.Attempts = utils.DefaultDNSAttempts
+	retval.Backoff = utils.DefaultDNSBackoff
+	retval.entries = make(map[string]*list.Element)
+	retval.lru = list.New()
+	retval.inflight = make(map[string]*pendingFetch)
+	retval.now = time.Now
+
+	return &retval
+}
+
+// Creates the cache config asks for: through its DNSResolver, of
+// DNSCacheSize nodes, trying each lookup DNSAttempts times DNSBackoff apart
+func NewConfiguredDNSCache(config *utils.Configuration) (error, DNSCache) {
+	err, resolver := NewResolver(config.DNSResolver)
+	if err != nil {
+		return err, nil
+	}
+
+	cache := NewDNSCache(resolver, config.DNSCacheSize).(*_DNSCache)
+	if config.DNSAttempts > 0 {
+		cache.Attempts = config.DNSAttempts
+	}
+	cache.Backoff = config.DNSBackoff.Duration
+
+	return nil, cache
+}
+
+// Looks up the TXT records for query, trying up to Attempts times
+func (d *_DNSCache) lookupTXT(query string) (error, []string, time.Duration) {
+	err, txt, ttl := d.Resolver.LookupTXT(query)
+
+	for tryCount := 1; tryCount < d.Attempts && err != nil; tryCount++ {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			// The record does not exist, asking again won't help
+			break
+		}
+
+		time.Sleep(d.Backoff)
+		err, txt, ttl = d.Resolver.LookupTXT(query)
+	}
+
+	if err != nil {
+		Logger.Warn("DNS lookup failed", "name", query, "error", err)
+		return newLookupError(query, err), nil, 0
+	}
+
+	if len(txt) == 0 {
+		Logger.Warn("DNS lookup failed", "name", query, "error", "no TXT records")
+		return &LookupError{ErrorNoRecord, query, nil}, nil, 0
+	}
+
+	return nil, txt, ttl
+}
+
+func (d *_DNSCache) dnsTXTQuery(query string) (error, string, time.Duration) {
+	err, txt, ttl := d.lookupTXT(query)
+	if err != nil {
+		return err, "", 0
+	}
+
+	return nil, txt[0], ttl
+}
+
+/*
+Because months or days may be split between multiple DNS records, we must perform multiple
+dns queries per tree node. The below code handles this case, collates it into one string,
+and returns the value.
+e.g. 202001_0._KeyForge.example.com, 202001_1._KeyForge.example.com
+tag = 2020001
+all values = 2020001_*._keyforge.example.com
+
+dns = _keyforge.example.com
+*/
+func (d *_DNSCache) getTreeNodeFromDNS(tag, dns string) (error, string, time.Duration) {
+
+	count := 0
+	result := ""
+	ttl := MaxCacheTTL
+
+	for !strings.HasSuffix(result, "EOM") {
+		currentDNS := ""
+		if tag == "" {
+			if count > 0 {
+				// The base record can't be split
+				return &LookupError{ErrorTruncatedChain, dns, nil}, "", 0
+			}
+			currentDNS = dns
+		} else {
+			currentDNS = tag + "_" + strconv.Itoa(count) + "." + dns
+		}
+
+		if count >= MaxNodeRecords {
+			return &LookupError{ErrorTruncatedChain, currentDNS, errors.New("no EOM marker")}, "", 0
+		}
+
+		err, txtEntry, entryTTL := d.dnsTXTQuery(currentDNS)
+		if err != nil {
+			if lookupErr, ok := err.(*LookupError); ok && count > 0 && lookupErr.Code == ErrorNoRecord {
+				// The first part exists, but the chain ends before EOM
+				lookupErr.Code = ErrorTruncatedChain
+			}
+			return err, "", 0
+		}
+
+		// The node is only as fresh as its shortest lived record
+		if entryTTL < ttl {
+			ttl = entryTTL
+		}
+
+		result += txtEntry
+		count += 1
+	}
+
+	return nil, result[:len(result)-len("EOM")], ttl
+}
+
+// Adds a node to the cache, evicting the least recently used if we're full.
+// d.mu must be held.
+func (d *_DNSCache) store(key string, values map[string]string, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		// Not to be cached
+		return
+	}
+
+	entry := cacheEntry{key, values, err, d.now().Add(ttl)}
+
+	if el, ok := d.entries[key]; ok {
+		el.Value = &entry
+		d.lru.MoveToFront(el)
+		return
+	}
+
+	d.entries[key] = d.lru.PushFront(&entry)
+
+	for d.lru.Len() > d.MaxEntries {
+		oldest := d.lru.Back()
+		d.lru.Remove(oldest)
+		delete(d.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Provides the tag/value map of a tree node from the cache if it is fresh, or
+// fetches it if it isn't. Concurrent requests for the same node share one fetch.
+func (d *_DNSCache) getTreeNode(treenode string, dns string) (error, map[string]string) {
+	key := dns + "|" + treenode
+
+	d.mu.Lock()
+
+	if el, ok := d.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if d.now().Before(entry.expires) {
+			d.lru.MoveToFront(el)
+			d.mu.Unlock()
+
+			if entry.err != nil {
+				metrics.cache.add(labels("result", "negative-hit"), 1)
+			} else {
+				metrics.cache.add(labels("result", "hit"), 1)
+			}
+			return entry.err, entry.values
+		}
+
+		// Stale, the key may have been rotated
+		d.lru.Remove(el)
+		delete(d.entries, key)
+	}
+
+	if pending, ok := d.inflight[key]; ok {
+		// Someone is already fetching this node
+		d.mu.Unlock()
+		metrics.cache.add(labels("result", "shared"), 1)
+		<-pending.done
+		return pending.err, pending.values
+	}
+
+	pending := pendingFetch{done: make(chan struct{})}
+	d.inflight[key] = &pending
+	d.mu.Unlock()
+
+	metrics.cache.add(labels("result", "miss"), 1)
+
+	err, nodeData, ttl := d.getTreeNodeFromDNS(treenode, dns)
+	if err == nil {
+		err, pending.values = makeTagValueMap(nodeData)
+		if err != nil {
+			err = &LookupError{ErrorMalformedRecord, treenode + "." + dns, err}
+		}
+	}
+	pending.err = err
+
+	d.mu.Lock()
+	delete(d.inflight, key)
+	if err == nil {
+		d.store(key, pending.values, nil, ttl)
+	} else if cacheableError(err) {
+		// Remember the failure briefly, so a broken domain doesn't cost a
+		// round of lookups for every message
+		d.store(key, nil, err, NegativeCacheTTL)
+	}
+	d.mu.Unlock()
+
+	close(pending.done)
+
+	return pending.err, pending.values
+}
+
+// Provides an entry from a dns cache if it exists, or fetches if it doesn't
+func (d *_DNSCache) getPublicFromDNS(key string, treenode string, dns string) (error, string) {
+	Logger.Debug("collecting from the DNS cache", "key", key, "node", treenode, "dns", dns)
+
+	err, values := d.getTreeNode(treenode, dns)
+	if err != nil {
+		return err, ""
+	}
+
+	value, ok := values[key]
+	if !ok {
+		// The node exists, but nothing is published for this key
+		name := dns
+		if treenode != "" {
+			name = treenode + "." + dns
+		}
+		return &LookupError{ErrorNoRecord, name, errors.New("no value for " + key)}, ""
+	}
+
+	return nil, value
+}
+
+// Gets the shape of the time tree the domain signs with. Domains that publish
+// no schema use the default tree.
+func (d *_DNSCache) GetTreeFromDNS(dns string) (err error, tree *utils.TimeTree) {
+	err, values := d.getTreeNode("", dns)
+	if err != nil {
+		return
+	}
+
+	err, tree = utils.ParseTimeTree(values["tree"])
+	if err != nil {
+		err = &LookupError{ErrorMalformedRecord, dns, err}
+	}
+	return
+}
+
+// Gets the Q Values out of DNS for this particular entry
+// returns the values along the path e.g. [year, month, day]
+func (d *_DNSCache) GetPublicFromDNS(dns string, path []string) (err error, mpk string, public []string) {
+	public = make([]string, 0)
+
+	// get public
+	err, mpk = d.getPublicFromDNS("public", "", dns)
+	if err != nil {
+		return
+	}
+
+	// year is in the base
+	err, year := d.getPublicFromDNS(path[0], "", dns)
+	if err != nil {
+		return
+	}
+
+	// months are in <year key>._keyforge....
+	err, month := d.getPublicFromDNS(path[1], path[0], dns)
+	if err != nil {
+		return
+	}
+
+	// Day is in <year><month>.dns
+	err, day := d.getPublicFromDNS(path[2], path[0]+path[1], dns)
+	if err != nil {
+		return
+	}
+
+	public = append(public, year)
+	public = append(public, month)
+	public = append(public, day)
+
+	return
+}
+
+func trimQuote(s string) string {
+	if last := len(s) - 1; last >= 0 && s[last] == '"' {
+		s = s[:last]
+	}
+	if len(s) > 0 && s[0] == '"' {
+		s = s[1:]
+	}
+	return s
+}
+
+func makeTagValueMap(input string) (error, map[string]string) {
+
+	tagged := make(map[string]string)
+	values := strings.Split(input, ",")
+
+	for _, value := range values {
+		// Should have two entries
+		split := strings.SplitN(value, "=", 2)
+		if len(split) != 2 || split[0] == "" {
+			return errors.New("Malformed tag=value entry: " + value), nil
+		}
+		key := split[0]
+		value := trimQuote(split[1])
+		tagged[key] = value
+	}
+	return nil, tagged
+
+}
@@ -0,0 +1,275 @@
+package keyserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+/*
+ExpiryPublisher serves the expiry information for a key over HTTP.
+
+A signature made for a leaf stops verifying once the leaf begins, so a leaf is
+disclosed Delay after it begins; the delay leaves room for clock skew between
+signer and verifier. The document only changes when another leaf is
+disclosed, so it is computed once per leaf and served with a matching
+Last-Modified and ETag.
+*/
+type ExpiryPublisher struct {
+	HIBE  *hibs.GSHIBE
+	Tree  *utils.TimeTree
+	KeyID string        // generation of HIBE, empty for keys without one
+	Start time.Time     // earliest time to disclose, rounded down to its year
+	Delay time.Duration // how long after a leaf begins it is disclosed
+	Now   func() time.Time
+
+	mu       sync.Mutex
+	lastLeaf time.Time // start of the newest leaf in document
+	document []byte    // the encoded utils.ExpiryDocument
+}
+
+func (e *ExpiryPublisher) now() time.Time {
+	if e.Now != nil {
+		return e.Now()
+	}
+	return time.Now()
+}
+
+// The start of the newest leaf that may be disclosed at now
+func (e *ExpiryPublisher) newestLeaf(now time.Time) time.Time {
+	// Leaves beginning strictly before now - Delay are disclosed
+	day, leaf := e.Tree.Leaf(now.Add(-e.Delay).Add(-time.Nanosecond))
+	return e.Tree.LeafStart(day, leaf)
+}
+
+// Builds the expiry information for every leaf beginning before expired
+func (e *ExpiryPublisher) Document(expired time.Time) utils.ExpiryDocument {
+	doc := utils.ExpiryDocument{
+		Version: utils.ExpiryVersion,
+		KeyID:   e.KeyID,
+		Tree:    e.Tree.String(),
+		Expired: expired.UTC(),
+		Nodes:   make([]utils.NodeSecret, 0),
+	}
+
+	for _, path := range e.Tree.Cover(e.Start, expired) {
+		doc.Nodes = append(doc.Nodes, utils.NodeSecret{
+			Path:      path,
+			Secret:    e.HIBE.ExportNodePrivate(path),
+			Ancestors: e.HIBE.ExportAncestorParams(path),
+		})
+	}
+
+	return doc
+}
+
+// The encoded document for the newest leaf, built only when that leaf changes
+func (e *ExpiryPublisher) encoded(newest time.Time) (error, []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.document == nil || !newest.Equal(e.lastLeaf) {
+		// Everything up to and including the newest leaf
+		doc := e.Document(newest.Add(e.Tree.Epoch))
+
+		encoded, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err, nil
+		}
+
+		e.document = encoded
+		e.lastLeaf = newest
+	}
+
+	return nil, e.document
+}
+
+func (e *ExpiryPublisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := e.now()
+	newest := e.newestLeaf(now)
+
+	err, document := e.encoded(newest)
+	if err != nil {
+		http.Error(w, "could not build expiry information", http.StatusInternalServerError)
+		return
+	}
+
+	// The document changed when its newest leaf was disclosed, and will change
+	// again when the next one is
+	modified := newest.Add(e.Delay)
+	next := modified.Add(e.Tree.Epoch)
+	etag := `"` + strconv.Itoa(utils.ExpiryVersion) + "-" + withKeyID(e.KeyID, e.Tree.String()) + "-" + strconv.FormatInt(newest.Unix(), 10) + `"`
+
+	maxAge := int(next.Sub(now) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("ETag", etag)
+	header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	header.Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	w.Write(document)
+}
+
+// Whether the client's cached copy, described by its conditional headers, is
+// still current. If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := strings.Join(r.Header.Values("If-None-Match"), ","); match != "" {
+		return matchesETag(match, etag)
+	}
+
+	if since := r.Header.Get("If-Modified-Since"); since != "" {
+		t, err := http.ParseTime(since)
+		return err == nil && !modified.After(t)
+	}
+
+	return false
+}
+
+/*
+Whether an If-None-Match list of entity tags, or "*", names etag. The
+comparison is weak, as RFC 9110 section 13.1.2 asks: W/ is ignored on both.
+Tags are quoted and may themselves hold commas, so the list is split between
+them rather than at every comma.
+*/
+func matchesETag(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+
+		switch {
+		case list == "":
+			return false
+		case list[0] == '*':
+			return true
+		case strings.HasPrefix(list, "W/"):
+			list = list[len("W/"):]
+		}
+
+		if !strings.HasPrefix(list, `"`) {
+			// Malformed, nothing after it can be trusted
+			return false
+		}
+
+		end := strings.Index(list[1:], `"`)
+		if end < 0 {
+			return false
+		}
+
+		if list[:end+2] == etag {
+			return true
+		}
+		list = list[end+2:]
+	}
+
+	return false
+}
+
+/*
+ExpiryServer publishes the expiry information of the keys a Server signs
+with, following them when they are reloaded: each domain's at
+/expire/<domain>, and at /expire the lone domain's, or H's without Signers.
+That is the generation signed with now; ?k=<key ID> asks for another that is
+still published. Delegated keys are not published, the master's host does
+that.
+*/
+type ExpiryServer struct {
+	Server *Server
+	Delay  time.Duration
+
+	mu         sync.Mutex
+	publishers map[string]*ExpiryPublisher // by domain and key ID, for the HIBE each holds
+}
+
+// The keys whose expiry information is at /expire/<domain>?k=<keyID>, or nil
+func (s *Server) expirySigner(domain, keyID string) *Signer {
+	s.keys.RLock()
+	defer s.keys.RUnlock()
+
+	var signer *Signer
+
+	if len(s.Signers) == 0 {
+		if domain != "" || H == nil {
+			return nil
+		}
+		signer = globalSigner()
+	} else {
+		signer = s.Signers[domain]
+		if domain == "" && len(s.Signers) == 1 {
+			for _, lone := range s.Signers {
+				signer = lone
+			}
+		}
+	}
+
+	if signer == nil {
+		return nil
+	}
+
+	if keyID == "" {
+		signer = signer.at(time.Now())
+	} else {
+		signer = signer.generation(keyID)
+	}
+
+	if signer == nil || signer.Delegated {
+		return nil
+	}
+	return signer
+}
+
+// The publisher for signer, a new one once its keys are reloaded
+func (e *ExpiryServer) publisher(domain string, signer *Signer) *ExpiryPublisher {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.publishers == nil {
+		e.publishers = make(map[string]*ExpiryPublisher)
+	}
+
+	key := domain + "/" + signer.KeyID
+	p, ok := e.publishers[key]
+	if !ok || p.HIBE != signer.HIBE {
+		p = &ExpiryPublisher{HIBE: signer.HIBE, Tree: signer.Tree, KeyID: signer.KeyID, Start: signer.KeyStart, Delay: e.Delay}
+		e.publishers[key] = p
+	}
+
+	return p
+}
+
+func (e *ExpiryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/expire"), "/"))
+
+	signer := e.Server.expirySigner(domain, r.URL.Query().Get("k"))
+	if signer == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	e.publisher(domain, signer).ServeHTTP(w, r)
+}
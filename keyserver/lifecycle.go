@@ -0,0 +1,106 @@
+package keyserver
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Returned for requests that arrive once Shutdown has begun
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// Counts the requests being answered, and refuses new ones once draining
+type requestTracker struct {
+	mu       sync.Mutex
+	inflight int
+	draining bool
+	drained  chan struct{} // closed when the last request ends while draining
+}
+
+func (r *requestTracker) begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.draining {
+		return ErrShuttingDown
+	}
+
+	r.inflight++
+	return nil
+}
+
+func (r *requestTracker) end() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inflight--
+	if r.inflight == 0 && r.drained != nil {
+		close(r.drained)
+		r.drained = nil
+	}
+}
+
+// Stops taking requests, and returns a channel closed once those under way
+// have ended
+func (r *requestTracker) drain() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.draining = true
+
+	done := make(chan struct{})
+	if r.inflight == 0 {
+		close(done)
+	} else {
+		r.drained = done
+	}
+
+	return done
+}
+
+/*
+Shutdown refuses new requests with ErrShuttingDown and waits for those under
+way to be answered, or for ctx to be done, whose error it then returns.
+Connections are the caller's to close, after it returns.
+*/
+func (s *Server) Shutdown(ctx context.Context) error {
+	select {
+	case <-s.requests.drain():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Replaces the keys signed with. Requests under way finish with the keys they
+// began with. A domain that keeps its rate limit keeps its bucket, with what
+// it has already used.
+func (s *Server) SetSigners(signers map[string]*Signer) {
+	s.keys.Lock()
+	defer s.keys.Unlock()
+
+	for domain, signer := range signers {
+		if old, ok := s.Signers[domain]; ok && old.Limit != nil && signer.Limit != nil &&
+			old.Limit.Rate == signer.Limit.Rate && old.Limit.Burst == signer.Limit.Burst {
+			signer.Limit = old.Limit
+		}
+	}
+
+	s.Signers = signers
+}
+
+// Loads the keys in keyDir into H and Tree, as LoadHIBE does, for a Server
+// without Signers that is already serving. The keys signed with are kept if
+// the new ones cannot be loaded.
+func (s *Server) ReloadHIBE(keyDir string) error {
+	err, signer := LoadSigner(keyDir)
+	if err != nil {
+		return err
+	}
+
+	s.keys.Lock()
+	defer s.keys.Unlock()
+
+	setGlobals(signer)
+	return nil
+}
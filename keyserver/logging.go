@@ -0,0 +1,40 @@
+package keyserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+)
+
+// Where the keyserver logs, as structured records. Every record about a
+// request carries its request_id.
+var Logger = slog.Default()
+
+// Longest request ID accepted from a client, longer ones are replaced
+const maxRequestID = 64
+
+// The ID of a request: given, if a client sent a usable one, otherwise a new
+// random one
+func requestID(given string) string {
+	if given != "" && len(given) <= maxRequestID {
+		usable := true
+		for _, c := range given {
+			if c <= ' ' || c > '~' {
+				usable = false
+				break
+			}
+		}
+		if usable {
+			return given
+		}
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The logger for the request with id
+func requestLogger(id string) *slog.Logger {
+	return Logger.With("request_id", id)
+}
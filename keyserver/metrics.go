@@ -0,0 +1,276 @@
+package keyserver
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histograms' buckets, in seconds
+var latencyBuckets = [...]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Most senders' records whose failures are counted apart, the rest are
+// counted together under "other" so a flood of bogus names stays small
+const maxFailingDomains = 1000
+
+// Counters by label set, each rendered as it is exposed, like result="success"
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (c *counterVec) add(labels string, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	c.values[labels] += n
+}
+
+// Counts one more for a label set, unless that would make more than limit
+// label sets, in which case overflow is counted instead. A limit of 0 is no
+// limit.
+func (c *counterVec) inc(labels string, limit int, overflow string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]uint64)
+	}
+	if _, ok := c.values[labels]; !ok && limit > 0 && len(c.values) >= limit {
+		labels = overflow
+	}
+	c.values[labels]++
+}
+
+func (c *counterVec) get(labels string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labels]
+}
+
+// The label sets and their counts, sorted by label set
+func (c *counterVec) snapshot() ([]string, []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	labels := make([]string, 0, len(c.values))
+	for l := range c.values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	counts := make([]uint64, len(labels))
+	for i, l := range labels {
+		counts[i] = c.values[l]
+	}
+	return labels, counts
+}
+
+// Durations counted into latencyBuckets
+type histogram struct {
+	mu     sync.Mutex
+	counts [len(latencyBuckets)]uint64 // per bucket of latencyBuckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Observes the time since start, for defer
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+// What the keyserver counts while it works
+type keyserverMetrics struct {
+	signs       counterVec // by result
+	verifies    counterVec // by result
+	failures    counterVec // failed lookups by the sender's DNS and error code
+	cache       counterVec // DNS cache lookups by result
+	signTime    histogram
+	verifyTime  histogram
+	pairingTime histogram
+}
+
+// Counts for every Server in the process, as keyforge-server runs only one
+var metrics keyserverMetrics
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Renders a label set, escaping its values for the text exposition format
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(pairs[i] + `="` + labelEscaper.Replace(pairs[i+1]) + `"`)
+	}
+	return b.String()
+}
+
+// The result a signing is counted under: "success", the reply's ErrorCode,
+// "unknown-domain", "unknown-key", "no-leaf-key", "shutting-down",
+// "audit-failed" or "error"
+func signResult(err error, reply *SigReply) string {
+	switch {
+	case err == nil && reply.Success:
+		return "success"
+	case reply.ErrorCode != ErrorNone:
+		return string(reply.ErrorCode)
+	case err == ErrUnknownDomain:
+		return "unknown-domain"
+	case err == ErrUnknownKey:
+		return "unknown-key"
+	case err == ErrNoLeafKey:
+		return "no-leaf-key"
+	case err == ErrShuttingDown:
+		return "shutting-down"
+	case err == ErrAudit:
+		return "audit-failed"
+	}
+	return "error"
+}
+
+func (m *keyserverMetrics) signed(err error, reply *SigReply) {
+	m.signs.add(labels("result", signResult(err, reply)), 1)
+}
+
+// Counts a finished verification: "success", "verify-failed" for a bad
+// signature, or its ErrorCode when it could not be checked. Failed lookups
+// are also counted by the sender's records, to tell which peer broke.
+func (m *keyserverMetrics) verified(args *VerifyArgs, reply *VerifyReply) {
+	result := string(reply.ErrorCode)
+	switch {
+	case reply.Answer:
+		result = "success"
+	case reply.ErrorCode == ErrorNone:
+		result = "verify-failed"
+	}
+	m.verifies.add(labels("result", result), 1)
+
+	switch reply.ErrorCode {
+	case ErrorNoRecord, ErrorMalformedRecord, ErrorTruncatedChain, ErrorTimeout, ErrorServerFailure:
+		m.failures.inc(labels("dns", strings.ToLower(args.DNS), "code", result), maxFailingDomains,
+			labels("dns", "other", "code", result))
+	}
+}
+
+/*
+MetricsHandler serves what a Server has done, in the Prometheus text format:
+
+	keyforge_sign_total{result}			signings by result, see signResult
+	keyforge_verify_total{result}			verifications by result
+	keyforge_verify_lookup_failures_total{dns,code}	failed lookups by sender's records
+	keyforge_dns_cache_lookups_total{result}	hit, negative-hit, shared or miss
+	keyforge_rate_limit_hits_total{domain}		signings refused by a domain's limit
+	keyforge_client_rate_limit_hits_total{client}	signings refused by a client's limit
+	keyforge_sign_duration_seconds			time to answer Sign and SignBatch
+	keyforge_verify_duration_seconds		time to answer Verify and VerifyBatch
+	keyforge_pairing_duration_seconds		time spent checking signatures
+
+It holds nothing secret, so it asks for no authentication.
+*/
+type MetricsHandler struct {
+	Server *Server
+	Auth   *Authenticator // for the clients' rate limits, may be nil
+}
+
+func writeCounters(w *bufio.Writer, name, help string, c *counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	labelSets, counts := c.snapshot()
+	for i, l := range labelSets {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, l, counts[i])
+	}
+}
+
+func writeHistogram(w *bufio.Writer, name, help string, h *histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// The rate limit hits of the server's domains and auth's clients, read from
+// their buckets as they are now
+func (m *MetricsHandler) rateLimitHits() (domains, clients *counterVec) {
+	domains, clients = &counterVec{}, &counterVec{}
+
+	m.Server.keys.RLock()
+	for domain, signer := range m.Server.Signers {
+		if signer.Limit != nil {
+			domains.add(labels("domain", domain), signer.Limit.Hits())
+		}
+	}
+	m.Server.keys.RUnlock()
+
+	if m.Auth != nil {
+		for _, c := range m.Auth.Clients {
+			if c.Limit != nil {
+				clients.add(labels("client", c.Name), c.Limit.Hits())
+			}
+		}
+	}
+
+	return
+}
+
+func (m *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	domains, clients := m.rateLimitHits()
+
+	writeCounters(out, "keyforge_sign_total", "Signings by result.", &metrics.signs)
+	writeCounters(out, "keyforge_verify_total", "Verifications by result.", &metrics.verifies)
+	writeCounters(out, "keyforge_verify_lookup_failures_total", "Failed lookups of senders' records by their DNS name and error code.", &metrics.failures)
+	writeCounters(out, "keyforge_dns_cache_lookups_total", "DNS cache lookups by result.", &metrics.cache)
+	writeCounters(out, "keyforge_rate_limit_hits_total", "Signings refused by a sender domain's rate limit.", domains)
+	writeCounters(out, "keyforge_client_rate_limit_hits_total", "Signings refused by a client's rate limit.", clients)
+	writeHistogram(out, "keyforge_sign_duration_seconds", "Time to answer Sign and SignBatch requests.", &metrics.signTime)
+	writeHistogram(out, "keyforge_verify_duration_seconds", "Time to answer Verify and VerifyBatch requests.", &metrics.verifyTime)
+	writeHistogram(out, "keyforge_pairing_duration_seconds", "Time spent checking signatures with pairings.", &metrics.pairingTime)
+}
@@ -0,0 +1,30 @@
+package keyserver
+
+import (
+	"net"
+	"syscall"
+)
+
+// The uid and gid of the process at the other end of conn, from SO_PEERCRED
+func peerCredentials(conn *net.UnixConn) (err error, uid, gid uint32) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err, 0, 0
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if err != nil {
+		return err, 0, 0
+	}
+	if credErr != nil {
+		return credErr, 0, 0
+	}
+
+	return nil, cred.Uid, cred.Gid
+}
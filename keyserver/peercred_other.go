@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package keyserver
+
+import (
+	"errors"
+	"net"
+)
+
+// Peer credentials are only read on Linux, so no unix socket client is
+// recognised elsewhere
+func peerCredentials(conn *net.UnixConn) (err error, uid, gid uint32) {
+	return errors.New("peer credentials are not supported on this platform"), 0, 0
+}
@@ -0,0 +1,87 @@
+package keyserver
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+TokenBucket limits how often something may happen: Rate times a second on
+average, and up to Burst times at once after a quiet spell. A nil
+*TokenBucket allows everything.
+*/
+type TokenBucket struct {
+	Rate  float64
+	Burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	hits   uint64 // times Take refused, read atomically
+
+	// The current time, time.Now if nil
+	Now func() time.Time
+}
+
+// A bucket for rate a second, starting full. burst defaults to rate, rounded
+// up. Nil, allowing everything, if rate is not positive.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+
+	return &TokenBucket{Rate: rate, Burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *TokenBucket) now() time.Time {
+	if b.Now != nil {
+		return b.Now()
+	}
+	return time.Now()
+}
+
+// Takes n tokens if there are that many, and reports whether it did
+func (b *TokenBucket) Take(n int) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Refill for the time since the last take
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.Burst, b.tokens+now.Sub(b.last).Seconds()*b.Rate)
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		atomic.AddUint64(&b.hits, 1)
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+// How many times the limit was hit
+func (b *TokenBucket) Hits() uint64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&b.hits)
+}
+
+// Refuses a signing for going over the limit of what
+func setRateLimited(reply *SigReply, what string) {
+	reply.Success = false
+	reply.ErrorCode = ErrorRateLimited
+	reply.Error = "rate limit reached for " + what
+}
@@ -0,0 +1,277 @@
+package keyserver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// How long a single query to a pinned nameserver may take
+	ResolverTimeout = 5 * time.Second
+)
+
+// A Resolver answers the TXT queries used to collect KeyForge public
+// parameters. The DNS cache talks only to this interface, so verification can
+// be pointed at the system resolver, a pinned nameserver, or an in-memory zone.
+//
+// LookupTXT returns the records along with how long they may be cached.
+type Resolver interface {
+	LookupTXT(name string) (error, []string, time.Duration)
+}
+
+// Uses whatever resolver the host is configured with (/etc/resolv.conf etc.)
+// The system resolver doesn't expose TTLs, so records are cached for
+// DefaultCacheTTL.
+type SystemResolver struct{}
+
+func (r *SystemResolver) LookupTXT(name string) (error, []string, time.Duration) {
+	txt, err := net.LookupTXT(name)
+	return err, txt, DefaultCacheTTL
+}
+
+// Sends every query to a single recursive or authoritative nameserver. Queries
+// are made directly so the record TTLs are available to the cache.
+type NameserverResolver struct {
+	Network string // "udp" or "tcp"
+	Address string // host:port of the nameserver
+	Timeout time.Duration
+}
+
+func NewNameserverResolver(network, address string) *NameserverResolver {
+	return &NameserverResolver{Network: network, Address: address, Timeout: ResolverTimeout}
+}
+
+// Whether response answers query: the same ID, and the same question
+func answers(response, query *dnsmessage.Message) bool {
+	if response.ID != query.ID || len(response.Questions) != 1 {
+		return false
+	}
+
+	q, r := query.Questions[0], response.Questions[0]
+	return r.Type == q.Type && r.Class == q.Class && strings.EqualFold(r.Name.String(), q.Name.String())
+}
+
+// Sends query over network and returns the response to it. Over UDP anyone
+// may send a datagram, so those that do not answer query are discarded until
+// one does or the timeout passes.
+func (r *NameserverResolver) exchange(network string, query *dnsmessage.Message) (error, *dnsmessage.Message) {
+	packed, err := query.Pack()
+	if err != nil {
+		return err, nil
+	}
+
+	conn, err := net.DialTimeout(network, r.Address, r.Timeout)
+	if err != nil {
+		return err, nil
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+
+	var response dnsmessage.Message
+
+	if network == "udp" {
+		if _, err := conn.Write(packed); err != nil {
+			return err, nil
+		}
+
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return err, nil
+			}
+
+			if response.Unpack(buf[:n]) == nil && answers(&response, query) {
+				return nil, &response
+			}
+		}
+	}
+
+	// Over TCP every message is prefixed with its length
+	framed := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(framed, uint16(len(packed)))
+	copy(framed[2:], packed)
+
+	if _, err := conn.Write(framed); err != nil {
+		return err, nil
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return err, nil
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err, nil
+	}
+
+	if err := response.Unpack(buf); err != nil {
+		return errors.New("malformed response: " + err.Error()), nil
+	}
+
+	if !answers(&response, query) {
+		return errors.New("response does not answer the query"), nil
+	}
+
+	return nil, &response
+}
+
+func (r *NameserverResolver) LookupTXT(name string) (error, []string, time.Duration) {
+	qname, err := dnsmessage.NewName(canonicalName(name) + ".")
+	if err != nil {
+		return err, nil, 0
+	}
+
+	// Unpredictable, so answers cannot be forged without seeing the query
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err, nil, 0
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	network := r.Network
+	var response *dnsmessage.Message
+
+	for {
+		err, response = r.exchange(network, &query)
+		if err != nil {
+			dnsErr := net.DNSError{Err: err.Error(), Name: name, Server: r.Address}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				dnsErr.IsTimeout = true
+				dnsErr.IsTemporary = true
+			}
+			return &dnsErr, nil, 0
+		}
+
+		if response.Truncated && network == "udp" {
+			// Too big for a datagram, ask again over TCP
+			network = "tcp"
+			continue
+		}
+
+		break
+	}
+
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return &net.DNSError{Err: "no such host", Name: name, Server: r.Address, IsNotFound: true}, nil, 0
+	default:
+		return &net.DNSError{Err: "server misbehaving: " + response.RCode.String(), Name: name, Server: r.Address, IsTemporary: true}, nil, 0
+	}
+
+	txt := make([]string, 0)
+	ttl := MaxCacheTTL
+
+	for _, answer := range response.Answers {
+		body, ok := answer.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			continue
+		}
+
+		// Multiple character-strings in one record form a single value
+		txt = append(txt, strings.Join(body.TXT, ""))
+
+		if answerTTL := time.Duration(answer.Header.TTL) * time.Second; answerTTL < ttl {
+			ttl = answerTTL
+		}
+	}
+
+	if len(txt) == 0 {
+		// The name exists but has no TXT records
+		return &net.DNSError{Err: "no such host", Name: name, Server: r.Address, IsNotFound: true}, nil, 0
+	}
+
+	return nil, txt, ttl
+}
+
+// An in-memory zone of TXT records, keyed by owner name
+type StaticResolver struct {
+	sync.RWMutex
+	TTL     time.Duration // reported for every record
+	records map[string][]string
+}
+
+func NewStaticResolver() *StaticResolver {
+	var r StaticResolver
+	r.TTL = DefaultCacheTTL
+	r.records = make(map[string][]string)
+	return &r
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Adds a TXT record to the zone, replacing any existing record set for name
+func (r *StaticResolver) Set(name string, txt ...string) {
+	r.Lock()
+	defer r.Unlock()
+	r.records[canonicalName(name)] = txt
+}
+
+// Removes the record set for name from the zone
+func (r *StaticResolver) Delete(name string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.records, canonicalName(name))
+}
+
+func (r *StaticResolver) LookupTXT(name string) (error, []string, time.Duration) {
+	r.RLock()
+	defer r.RUnlock()
+
+	txt, ok := r.records[canonicalName(name)]
+	if !ok {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}, nil, 0
+	}
+
+	return nil, append([]string(nil), txt...), r.TTL
+}
+
+// Builds a resolver from its configuration string:
+//
+//	""                 the system resolver
+//	"udp://host:port"  a pinned nameserver over UDP
+//	"tcp://host:port"  a pinned nameserver over TCP
+//	"host:port"        shorthand for udp://host:port
+func NewResolver(spec string) (error, Resolver) {
+	if spec == "" || spec == "system" {
+		return nil, &SystemResolver{}
+	}
+
+	network := "udp"
+	address := spec
+
+	if i := strings.Index(spec, "://"); i >= 0 {
+		network = spec[:i]
+		address = spec[i+len("://"):]
+	}
+
+	if network != "udp" && network != "tcp" {
+		return errors.New("Unsupported resolver network: " + network), nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		// No port given, assume the standard DNS port
+		address = net.JoinHostPort(address, "53")
+	}
+
+	return nil, NewNameserverResolver(network, address)
+}
@@ -0,0 +1,846 @@
+/*
+Package keyserver signs and verifies KeyForge signatures. keyforge-server
+serves it over JSON-RPC, and keyforge-milter calls it in-process.
+*/
+package keyserver
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keyforgery/KeyForge/crypto/hibs"
+	"github.com/keyforgery/KeyForge/sigheader"
+	"github.com/keyforgery/KeyForge/utils"
+)
+
+// How long after a leaf begins its secret is published as expired, unless
+// configured otherwise
+const ExpiryDelay = utils.DefaultExpiryDelay
+
+var (
+	// Returned by Sign when no Signer is for the sender's domain
+	ErrUnknownDomain = errors.New("no signing key for the sender's domain")
+	// Returned by Sign when the delegated keys held do not cover the leaf
+	ErrNoLeafKey = errors.New("no signing key covers the current leaf")
+	// Returned by Sign when the signature could not be recorded in the audit log
+	ErrAudit = errors.New("cannot record the signature in the audit log")
+	// Returned by Sign when the sender's keys have no generation with the key ID asked for
+	ErrUnknownKey = errors.New("no signing key with the key ID asked for")
+)
+
+// Name of the file in a key directory holding the base record, as written by
+// keyforge-generate
+const publicFileName = "_KeyForge"
+
+// Global HIBS for this server, used when it has no Signers
+var H *hibs.GSHIBE
+
+// Shape of the time tree H signs with
+var Tree *utils.TimeTree
+
+// Start of the earliest year H has published records for
+var KeyStart time.Time
+
+// Whether H holds only delegated keys rather than the master secret
+var Delegated bool
+
+// Key ID of H's generation, empty for keys without one
+var KeyID string
+
+// Every generation of keys LoadHIBE found, newest first, to move on to as
+// each becomes active. H is the one that was active when they were loaded.
+var Generations []*Signer
+
+// The keys one domain signs with, and how they were published
+type Signer struct {
+	Domain     string
+	Selector   string
+	HIBE       *hibs.GSHIBE
+	Tree       *utils.TimeTree
+	KeyStart   time.Time    // Start of the earliest year published records cover
+	Delegated  bool         // Whether HIBE holds only delegated keys
+	Limit      *TokenBucket // How often senders in Domain may be signed for, nil for always
+	KeyID      string       // Generation of HIBE, see utils.Generation; empty for keys without one
+	ActiveFrom time.Time    // When signing with HIBE began, or begins
+
+	// Every generation of the domain's keys that is published, newest first.
+	// Each is a Signer for its generation alone.
+	Generations []*Signer
+}
+
+// The name the signer's records are published under, <selector>.<domain>, or
+// <key ID>.<selector>.<domain> for keys with one
+func (k *Signer) DNS() string {
+	return withKeyID(k.KeyID, k.Selector+"."+k.Domain)
+}
+
+func withKeyID(keyID, dns string) string {
+	if keyID == "" {
+		return dns
+	}
+	return keyID + "." + dns
+}
+
+// The keys of k's generation with keyID, for the same domain, or nil
+func (k *Signer) generation(keyID string) *Signer {
+	if len(k.Generations) == 0 && k.KeyID == keyID {
+		return k
+	}
+
+	for _, g := range k.Generations {
+		if g.KeyID == keyID {
+			return k.as(g)
+		}
+	}
+	return nil
+}
+
+// The keys of k's newest generation active at now. Until any is, that is the
+// oldest.
+func (k *Signer) at(now time.Time) *Signer {
+	if len(k.Generations) == 0 {
+		return k
+	}
+
+	for _, g := range k.Generations {
+		if !now.Before(g.ActiveFrom) {
+			return k.as(g)
+		}
+	}
+	return k.as(k.Generations[len(k.Generations)-1])
+}
+
+// The generation g as k's domain signs with it
+func (k *Signer) as(g *Signer) *Signer {
+	if g.HIBE == k.HIBE {
+		return k
+	}
+
+	signer := *k
+	signer.HIBE = g.HIBE
+	signer.Tree = g.Tree
+	signer.KeyStart = g.KeyStart
+	signer.Delegated = g.Delegated
+	signer.KeyID = g.KeyID
+	signer.ActiveFrom = g.ActiveFrom
+	return &signer
+}
+
+type Server struct {
+	DNS string
+
+	// Keys by the lower case domain they sign for. Without any, H and Tree
+	// sign everything, for DNS.
+	Signers map[string]*Signer
+
+	// Cache of DNS results for various selector domains
+	Cache     DNSCache
+	cacheOnce sync.Once
+
+	// Guards Signers, and H and the globals with it, once keys are reloaded
+	// while serving
+	keys sync.RWMutex
+
+	// Requests being answered, so Shutdown can wait for them
+	requests requestTracker
+
+	// Where every signature issued is recorded, nil for nowhere
+	Audit *AuditLog
+}
+
+type SigArgs struct {
+	Sha256               string // A sha256 sum of the message to be signed
+	ReceiverEmailAddress string // The full email address of the receiver
+	SenderEmailAddress   string // The full email address of the sender, whose domain picks the key
+	RequestID            string // Identifies the request in logs, one is made up if empty
+	KeyID                string // The generation of the domain's keys to sign with, the active one if empty
+}
+
+type SigReply struct {
+	Error     string    // Why signing failed, when it was refused or in replies to SignBatch
+	ErrorCode ErrorCode // The same, when it is one of the codes for signing
+	Signature string    // a b64 encoded signature, then the sub-day Q values, comma separated
+	DNS       string    // Where the records are, [<key ID>.]<selector>.<domain>
+	Domain    string    // d= of the signature, empty without Signers
+	Selector  string    // s= of the signature, empty without Signers
+	KeyID     string    // k= of the signature, empty for keys without one
+	Expiry    string    // A string that includes the Y/M/D/M block
+	Success   bool
+	RequestID string // The request's, as it was logged
+
+	// The same signature in parts, as the KeyForge-Signature header carries it
+	TreeVersion int      // The tree schema Path follows
+	Path        []string // The leaf signed for
+	Sig         string   // The b64 encoded signature point
+	QValues     []string // The b64 encoded Q values of the sub-day levels
+
+	// The same again as a KeyForge-Signature header, but for the c=, h= and
+	// bh= of the message, which the caller fills in
+	Header *sigheader.Signature
+}
+
+// Machine readable reason for a failed verification, so a milter can choose
+// between a temporary failure and a rejection, or for a refused signing
+type ErrorCode string
+
+const (
+	ErrorNone               ErrorCode = ""
+	ErrorNoRecord           ErrorCode = "no-record"           // NXDOMAIN, or no parameters published for the node
+	ErrorMalformedRecord    ErrorCode = "malformed-record"    // published records could not be parsed
+	ErrorTruncatedChain     ErrorCode = "truncated-chain"     // a split node ended before its EOM marker
+	ErrorTimeout            ErrorCode = "timeout"             // the resolver did not answer in time
+	ErrorServerFailure      ErrorCode = "server-failure"      // SERVFAIL or another resolver error
+	ErrorMalformedSignature ErrorCode = "malformed-signature" // the signature or expiry could not be parsed
+	ErrorExpired            ErrorCode = "expired"             // the signature's key has expired
+
+	// For signing
+	ErrorRateLimited ErrorCode = "rate-limited" // the client or sender domain signed too often
+	ErrorForbidden   ErrorCode = "forbidden"    // the client may not sign for the sender
+)
+
+type VerifyReply struct {
+	RequestID    string // The request's, as it was logged
+	Answer       bool
+	Success      bool
+	IsExpired    bool
+	VerifyFailed bool
+	ErrorCode    ErrorCode
+	ErrorMessage string
+}
+
+type VerifyArgs struct {
+	Sha256             string // A sha256 sum of the message to be verified
+	SenderEmailAddress string // The email address of the receiver
+	DNS                string // The DNS we should use to look up params (specified in the header)
+	Signature          string // The sig
+	Expiry             string // The time at which the key expires
+	RequestID          string // Identifies the request in logs, one is made up if empty
+
+	// When Path is set, Signature is the signature point alone and Expiry is
+	// not used: the leaf and its Q values are given directly
+	TreeVersion int // The tree schema Path follows, if known
+	Path        []string
+	QValues     []string
+
+	// A KeyForge-Signature header value. When set, DNS, Signature,
+	// TreeVersion, Path and QValues are read from it instead.
+	Header string
+}
+
+// Fills in args from its Header, if it has one
+func (args *VerifyArgs) readHeader() error {
+	if args.Header == "" {
+		return nil
+	}
+
+	err, sig := sigheader.Parse(args.Header)
+	if err != nil {
+		return err
+	}
+
+	args.DNS = sig.DNS()
+	args.Signature = sig.Sig
+	args.Expiry = ""
+	args.TreeVersion = sig.TreeVersion
+	args.Path = sig.Path
+	args.QValues = sig.QValues
+	return nil
+}
+
+func setError(reply *VerifyReply, code ErrorCode) {
+	reply.VerifyFailed = true
+	reply.ErrorCode = code
+}
+
+func (s *Server) Verify(args VerifyArgs, reply *VerifyReply) error {
+	args.RequestID = requestID(args.RequestID)
+	reply.RequestID = args.RequestID
+
+	if err := s.requests.begin(); err != nil {
+		return err
+	}
+	defer s.requests.end()
+	defer metrics.verifyTime.since(time.Now())
+
+	if pending := s.prepareVerify(&args, reply, nil); pending != nil {
+		start := time.Now()
+		reply.Success = true
+		reply.Answer = pending.hibe.Verify(*pending.sig, args.Sha256, pending.path)
+		metrics.pairingTime.since(start)
+		pending.log(reply.Answer)
+	}
+
+	metrics.verified(&args, reply)
+	return nil
+}
+
+// A signature ready to be checked
+type pendingVerify struct {
+	hibe   *hibs.GSHIBE // the sender's public parameters
+	sig    *hibs.GSSig
+	path   []string
+	hash   string
+	logger *slog.Logger
+}
+
+func (p *pendingVerify) log(answer bool) {
+	if answer {
+		p.logger.Info("verified", "sha256", p.hash)
+	} else {
+		p.logger.Info("signature does not verify", "sha256", p.hash)
+	}
+}
+
+func (p *pendingVerify) item() hibs.BatchItem {
+	return hibs.BatchItem{Sig: *p.sig, Message: p.hash, ID: p.path}
+}
+
+// Gathers everything needed to check the signature in args, filling args in
+// from its Header. If that fails, or the signature has expired, reply says why
+// and nil is returned. Lookups go through batch when it is not nil.
+func (s *Server) prepareVerify(args *VerifyArgs, reply *VerifyReply, batch *verifyBatch) *pendingVerify {
+	if err := args.readHeader(); err != nil {
+		setError(reply, ErrorMalformedSignature)
+		reply.ErrorMessage = err.Error()
+		requestLogger(args.RequestID).Info("malformed signature header", "error", err)
+		return nil
+	}
+
+	logger := requestLogger(args.RequestID).With("dns", args.DNS)
+
+	now := time.Now().UTC()
+
+	s.cacheOnce.Do(func() {
+		if s.Cache == nil {
+			s.Cache = NewDNSCache(nil, 0)
+		}
+	})
+
+	// The sender's tree shape is published alongside their public key
+	err, tree := batch.tree(s.Cache, args.DNS)
+	if err != nil {
+		code := ErrorServerFailure
+		if lookupErr, ok := err.(*LookupError); ok {
+			code = lookupErr.Code
+		}
+		setError(reply, code)
+		reply.ErrorMessage = "Could not resolve DNS for " + args.DNS
+		logger.Warn("cannot look up the sender's tree", "code", code, "error", err)
+		return nil
+	}
+
+	var path []string
+	var sigPoint string
+	var sigQValues []string
+
+	if args.TreeVersion != 0 && args.TreeVersion != tree.Version {
+		// The path cannot be read against the sender's tree
+		setError(reply, ErrorMalformedSignature)
+		logger.Info("signature for another tree version", "version", args.TreeVersion, "tree", tree.Version)
+		return nil
+	}
+
+	if len(args.Path) > 0 {
+		// The leaf and Q values are given separately
+		path = args.Path
+		sigPoint = args.Signature
+		sigQValues = args.QValues
+	} else if err, legacyPath := parseExpiry(tree, args.Expiry); err != nil {
+		setError(reply, ErrorMalformedSignature)
+		logger.Info("malformed expiry", "error", err)
+		return nil
+	} else {
+		// The signature carries the Q values of every sub-day level
+		sigParts := strings.Split(args.Signature, ",")
+		path = legacyPath
+		sigPoint = sigParts[0]
+		sigQValues = sigParts[1:]
+	}
+
+	err, fullExpiry, _ := tree.Span(path)
+	if err != nil || len(path) != tree.Depth() || len(sigQValues) != tree.SubLevels() {
+		setError(reply, ErrorMalformedSignature)
+		logger.Info("malformed signature path", "path", path)
+		return nil
+	}
+
+	// Determine if expiry is < the current time
+	if now.After(fullExpiry) {
+		logger.Info("signature expired", "expiry", fullExpiry, "path", path)
+
+		// this is expired, no reason to fully verify
+		setError(reply, ErrorExpired)
+		reply.IsExpired = true
+		reply.VerifyFailed = true
+		reply.ErrorMessage = "Key expired"
+		return nil
+	}
+
+	logger.Debug("path parsed", "path", path)
+
+	err, mpk, public := batch.public(s.Cache, args.DNS, path[:3])
+
+	if err != nil {
+		// failure, cannot get details from dns
+		code := ErrorServerFailure
+		if lookupErr, ok := err.(*LookupError); ok {
+			code = lookupErr.Code
+		}
+		setError(reply, code)
+		reply.ErrorMessage = "Could not resolve DNS for " + args.DNS
+		logger.Warn("cannot look up the sender's public parameters", "code", code, "error", err)
+		return nil
+	}
+
+	// Copied, as public belongs to the cache
+	qvalues := append(append([]string(nil), public...), sigQValues...)
+
+	err, sig := hibs.GSSigFromPublic(sigPoint, qvalues)
+	if err != nil {
+		// Failure, cannot get details from dns
+		setError(reply, ErrorMalformedSignature)
+		logger.Info("malformed signature", "error", err)
+		return nil
+	}
+
+	err, h := batch.hibe(mpk)
+
+	if err != nil {
+		// failure, cannot get details from dns
+		setError(reply, ErrorMalformedRecord)
+		reply.ErrorMessage = "Public key at " + args.DNS + " could not be parsed"
+		logger.Warn("malformed public key", "error", err)
+		return nil
+	}
+
+	return &pendingVerify{hibe: h, sig: sig, path: path, hash: args.Sha256, logger: logger}
+}
+
+// Parses the <day in UnixDate>,<leaf> expiry sent before signatures named
+// their leaf directly, into the leaf's path
+func parseExpiry(tree *utils.TimeTree, expiry string) (error, []string) {
+	timeAndChunk := strings.Split(expiry, ",")
+	if len(timeAndChunk) != 2 {
+		return errors.New("Malformed expiry " + expiry), nil
+	}
+
+	expiryDay, err := time.Parse(time.UnixDate, timeAndChunk[0])
+	if err != nil {
+		return err, nil
+	}
+
+	chunk, err := strconv.Atoi(timeAndChunk[1])
+	if err != nil {
+		return err, nil
+	}
+
+	if chunk < 0 || chunk >= tree.LeavesPerDay() {
+		return errors.New("Leaf out of range in " + expiry), nil
+	}
+
+	return nil, tree.Path(expiryDay, chunk)
+}
+
+// The domain of an email address, lower case
+func emailDomain(address string) string {
+	address = strings.TrimSpace(strings.Trim(strings.TrimSpace(address), "<>"))
+	return strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+}
+
+// The keys H and the globals with it are, with no domain
+func globalSigner() *Signer {
+	return &Signer{HIBE: H, Tree: Tree, KeyStart: KeyStart, Delegated: Delegated, KeyID: KeyID, Generations: Generations}
+}
+
+// Picks the keys to sign mail from sender with: the newest generation of
+// its domain's that is active. Without Signers, that is H and Tree, with no
+// domain.
+func (s *Server) SignerFor(sender string) (error, *Signer) {
+	s.keys.RLock()
+	defer s.keys.RUnlock()
+
+	if len(s.Signers) == 0 {
+		return nil, globalSigner().at(time.Now())
+	}
+
+	domain := emailDomain(sender)
+	if signer, ok := s.Signers[domain]; ok {
+		return nil, signer.at(time.Now())
+	}
+
+	return ErrUnknownDomain, nil
+}
+
+// The keys to sign args with: those SignerFor picks, or their generation
+// with args' KeyID if it names one
+func (s *Server) signerForArgs(args *SigArgs) (error, *Signer) {
+	err, signer := s.SignerFor(args.SenderEmailAddress)
+	if err != nil || args.KeyID == "" || signer.KeyID == args.KeyID {
+		return err, signer
+	}
+
+	if signer = signer.generation(args.KeyID); signer == nil {
+		return ErrUnknownKey, nil
+	}
+	return nil, signer
+}
+
+// The leaf signatures made now are for, with its secrets
+type signingLeaf struct {
+	day    time.Time
+	chunk  int
+	path   []string
+	entity *hibs.Entity
+}
+
+// Picks the leaf of k's tree to sign for at now: the one containing now plus
+// an epoch, so signatures stay valid for at least that long
+func (k *Signer) leaf(now time.Time) (error, *signingLeaf) {
+	expiry := now.Add(k.Tree.Epoch)
+
+	// Let's truncate the time
+	day, chunk := k.Tree.Leaf(expiry)
+
+	path := k.Tree.Path(day, chunk)
+
+	if !k.HIBE.Holds(path) {
+		// Signing with delegated keys, and none covers this leaf
+		Logger.Error("no delegated key covers the leaf", "domain", k.Domain, "path", strings.Join(path, "/"),
+			"from", k.Tree.LeafStart(day, chunk))
+		return ErrNoLeafKey, nil
+	}
+
+	return nil, &signingLeaf{day, chunk, path, k.HIBE.ExtractPath(path)}
+}
+
+// Signs args' hash with leaf's secrets into reply, once it is in the audit
+// log. client asked for it, it is empty when signing in-process.
+func (s *Server) signLeaf(signer *Signer, leaf *signingLeaf, args *SigArgs, client string, reply *SigReply) error {
+	signature, qvalues := signer.HIBE.SignWith(args.Sha256, leaf.entity).Export(signer.Tree.SubLevels())
+
+	dns := withKeyID(signer.KeyID, s.DNS)
+	if signer.Domain != "" {
+		dns = signer.DNS()
+	}
+
+	if s.Audit != nil {
+		err := s.Audit.Record(AuditRecord{
+			Time:      time.Now().UTC(),
+			RequestID: args.RequestID,
+			Client:    client,
+			Sha256:    args.Sha256,
+			Domain:    emailDomain(args.SenderEmailAddress),
+			DNS:       dns,
+			Path:      leaf.path,
+		})
+		if err != nil {
+			// Nothing is signed without a record of it
+			requestLogger(args.RequestID).Error("cannot write the audit log", "error", err)
+			return ErrAudit
+		}
+	}
+
+	reply.Signature = signature + "," + strings.Join(qvalues, ",")
+	reply.Success = true
+	reply.Expiry = leaf.day.Format(time.UnixDate) + "," + strconv.Itoa(leaf.chunk)
+	reply.TreeVersion = signer.Tree.Version
+	reply.Path = leaf.path
+	reply.Sig = signature
+	reply.QValues = qvalues
+	reply.KeyID = signer.KeyID
+
+	reply.DNS = dns
+	if signer.Domain != "" {
+		reply.Domain = signer.Domain
+		reply.Selector = signer.Selector
+	}
+
+	// Without Signers, DNS is <selector>.<domain>
+	domain, selector := signer.Domain, signer.Selector
+	if domain == "" {
+		if i := strings.Index(s.DNS, "."); i >= 0 {
+			selector, domain = s.DNS[:i], s.DNS[i+1:]
+		}
+	}
+
+	reply.Header = &sigheader.Signature{
+		Version:     sigheader.Version,
+		Algorithm:   sigheader.Algorithm,
+		Domain:      domain,
+		Selector:    selector,
+		KeyID:       signer.KeyID,
+		TreeVersion: signer.Tree.Version,
+		Path:        leaf.path,
+		BodyLength:  -1,
+		QValues:     qvalues,
+		Sig:         signature,
+	}
+
+	requestLogger(args.RequestID).Info("signed", "client", client, "sha256", args.Sha256,
+		"dns", dns, "path", strings.Join(leaf.path, "/"))
+	return nil
+}
+
+func (s *Server) Sign(args *SigArgs, reply *SigReply) error {
+	return s.sign(args, reply, "")
+}
+
+// Signs for client, see signLeaf
+func (s *Server) sign(args *SigArgs, reply *SigReply, client string) (err error) {
+	/*
+		1. Pick the keys for the sender's domain
+		2. Figure out the time at which this thing should expire (now + one epoch)
+		3. Sign the thing using our hibs and the leaf of the tree for that time
+
+	*/
+	args.RequestID = requestID(args.RequestID)
+	reply.RequestID = args.RequestID
+	logger := requestLogger(args.RequestID)
+
+	defer func() {
+		metrics.signed(err, reply)
+		if err != nil {
+			logger.Warn("cannot sign", "client", client, "sender", args.SenderEmailAddress, "error", err)
+		}
+	}()
+
+	if err := s.requests.begin(); err != nil {
+		return err
+	}
+	defer s.requests.end()
+	defer metrics.signTime.since(time.Now())
+
+	err, signer := s.signerForArgs(args)
+	if err != nil {
+		return err
+	}
+
+	if !signer.Limit.Take(1) {
+		logger.Warn("rate limit reached", "domain", signer.Domain)
+		setRateLimited(reply, "sender domain "+signer.Domain)
+		return nil
+	}
+
+	err, leaf := signer.leaf(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return s.signLeaf(signer, leaf, args, client, reply)
+}
+
+// Loads the keys in keyDir as written by keyforge-generate: the master secret
+// if it is there, otherwise the delegated keys. Sets H and Tree.
+func LoadHIBE(keyDir string) *hibs.GSHIBE {
+	err, signer := LoadSigner(keyDir)
+	if err != nil {
+		panic(err)
+	}
+
+	setGlobals(signer)
+	return H
+}
+
+// Makes signer's keys H and the globals with it
+func setGlobals(signer *Signer) {
+	H = signer.HIBE
+	Tree = signer.Tree
+	KeyStart = signer.KeyStart
+	Delegated = signer.Delegated
+	KeyID = signer.KeyID
+	Generations = signer.Generations
+}
+
+// Loads the keys of every configured signer, by lower case domain
+func LoadSigners(configs []utils.SignerConfig) (error, map[string]*Signer) {
+	signers := make(map[string]*Signer)
+
+	for _, config := range configs {
+		domain := strings.ToLower(config.Domain)
+		if domain == "" {
+			return errors.New("signer for " + config.KeyDirectory + " has no domain"), nil
+		}
+
+		if _, ok := signers[domain]; ok {
+			return errors.New("more than one signer for " + domain), nil
+		}
+
+		err, signer := LoadSigner(config.KeyDirectory)
+		if err != nil {
+			return errors.New(domain + ": " + err.Error()), nil
+		}
+
+		signer.Domain = domain
+		signer.Selector = config.Selector
+		if signer.Selector == "" {
+			signer.Selector = utils.DefaultSelector
+		}
+
+		signer.Limit = NewTokenBucket(config.Rate, config.Burst)
+
+		signers[domain] = signer
+	}
+
+	return nil, signers
+}
+
+/*
+LoadSigner loads the keys in keyDir, without a domain or selector. Each
+generation keyforge-generate wrote is in its own directory, k1/, k2/ and so
+on, laid out as keys without a key ID are in keyDir itself. The Signer
+returned is the newest generation active now, with every one of them in
+Generations.
+*/
+func LoadSigner(keyDir string) (error, *Signer) {
+	generations := make([]*Signer, 0)
+
+	if _, err := os.Stat(filepath.Join(keyDir, publicFileName)); err == nil {
+		err, legacy := loadGeneration(keyDir, "")
+		if err != nil {
+			return err, nil
+		}
+		generations = append(generations, legacy)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(keyDir, "k*"))
+	if err != nil {
+		return err, nil
+	}
+
+	for _, dir := range dirs {
+		keyID := filepath.Base(dir)
+		if err, _ := utils.ParseKeyID(keyID); err != nil {
+			// Not a generation, such as one renamed when retired
+			continue
+		}
+
+		err, generation := loadGeneration(dir, keyID)
+		if err != nil {
+			return errors.New(keyID + ": " + err.Error()), nil
+		}
+		generations = append(generations, generation)
+	}
+
+	if len(generations) == 0 {
+		return errors.New("no keys in " + keyDir), nil
+	}
+
+	// Newest first, those without a key ID being the oldest
+	sort.Slice(generations, func(i, j int) bool {
+		_, a := utils.ParseKeyID(generations[i].KeyID)
+		_, b := utils.ParseKeyID(generations[j].KeyID)
+		return a > b
+	})
+
+	return nil, (&Signer{Generations: generations}).at(time.Now())
+}
+
+// Loads one generation of keys from dir, whose files are named for keyID
+func loadGeneration(dir, keyID string) (error, *Signer) {
+	privateFile := filepath.Join(dir, "private", "private")
+	publicFile := filepath.Join(dir, withKeyID(keyID, publicFileName))
+	delegatedDir := filepath.Join(dir, "delegated")
+
+	var local hibs.GSHIBE
+
+	// read pk file
+	// split pk file on ',' delims, first element is our encoded pk
+	pk, err := ioutil.ReadFile(publicFile)
+	if err != nil {
+		return err, nil
+	}
+
+	err, pubkeyMap := makeTagValueMap(strings.TrimSuffix(string(pk), "EOM"))
+	if err != nil {
+		return err, nil
+	}
+
+	encodedPK := pubkeyMap["public"]
+	if err := local.SetupPublicFromString(encodedPK); err != nil {
+		return err, nil
+	}
+
+	err, tree := utils.ParseTimeTree(pubkeyMap["tree"])
+	if err != nil {
+		return err, nil
+	}
+
+	signer := Signer{HIBE: &local, Tree: tree, KeyID: keyID}
+
+	if keyID != "" {
+		err, generation := utils.ReadGeneration(filepath.Join(dir, utils.GenerationFile))
+		if err != nil {
+			return err, nil
+		}
+		if generation.KeyID != keyID {
+			return errors.New("generation file is for " + generation.KeyID), nil
+		}
+		signer.ActiveFrom = generation.ActiveFrom
+	}
+
+	// read sk file, or failing that the delegated keys
+	if sk, err := ioutil.ReadFile(privateFile); err == nil {
+		if err := local.SetupPrivateFromString(string(sk)); err != nil {
+			return err, nil
+		}
+	} else if err := loadDelegated(&local, tree, delegatedDir); err != nil {
+		if os.IsNotExist(err) {
+			err = errors.New("neither " + privateFile + " nor any delegated keys in " + delegatedDir + " exist")
+		}
+		return err, nil
+	} else {
+		signer.Delegated = true
+	}
+
+	// Where the records began, not the years they cover now
+	if signer.KeyStart = utils.RecordStart(pubkeyMap); signer.KeyStart.IsZero() {
+		signer.KeyStart = time.Now().UTC()
+	}
+
+	return nil, &signer
+}
+
+// Imports every delegated key in dir into h
+func loadDelegated(h *hibs.GSHIBE, tree *utils.TimeTree, dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		return os.ErrNotExist
+	}
+
+	for _, file := range files {
+		err, key := utils.ReadDelegatedKey(file)
+		if err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+
+		if key.Tree != tree.String() {
+			return errors.New(file + ": delegated for tree " + key.Tree + ", but the key uses " + tree.String())
+		}
+
+		err, ancestors := hibs.QValuesFromStrings(key.Node.Ancestors)
+		if err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+
+		if err := h.ImportNode(key.Node.Path, key.Node.Secret, ancestors); err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+
+		Logger.Info("signing with delegated key", "path", strings.Join(key.Node.Path, "/"),
+			"not_before", key.NotBefore, "not_after", key.NotAfter)
+	}
+
+	return nil
+}
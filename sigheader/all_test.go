@@ -0,0 +1,210 @@
+package sigheader
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/keyforgery/KeyForge/canonical"
+)
+
+func testSignature() *Signature {
+	return &Signature{
+		Version:          Version,
+		Algorithm:        Algorithm,
+		Canonicalization: canonical.Canonicalization{Header: canonical.Relaxed, Body: canonical.Simple},
+		Domain:           "example.com",
+		Selector:         "_KeyForge",
+		TreeVersion:      1,
+		Path:             []string{"2020", "03", "02", "45"},
+		Headers:          []string{"from", "to", "subject", "from", "subject"},
+		BodyHash:         "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		BodyLength:       -1,
+		QValues:          []string{strings.Repeat("QVFR", 40)},
+		Sig:              strings.Repeat("c2ln", 60),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	sig := testSignature()
+
+	for _, value := range []string{sig.String(), sig.Fold()} {
+		err, parsed := Parse(value)
+		if err != nil {
+			t.Log("Failed to parse", value, err)
+			t.Fail()
+			continue
+		}
+		if !reflect.DeepEqual(parsed, sig) {
+			t.Logf("%q parsed as %+v", value, parsed)
+			t.Fail()
+		}
+	}
+
+	sig.BodyLength = 120
+	sig.QValues = nil
+	if err, parsed := Parse(sig.Fold()); err != nil || !reflect.DeepEqual(parsed, sig) {
+		t.Log("Signature with l= and no Q values did not round trip", err, parsed)
+		t.Fail()
+	}
+}
+
+func TestFold(t *testing.T) {
+	sig := testSignature()
+	folded := sig.Fold()
+
+	lines := strings.Split(folded, "\r\n")
+	if len(lines) < 5 {
+		t.Log("Long signature was not folded", folded)
+		t.Fail()
+	}
+
+	// The first line follows the header name
+	lines[0] = HeaderName + ":" + lines[0]
+	for _, line := range lines {
+		if len(line) > lineLength {
+			t.Logf("Folded line %q is too long", line)
+			t.Fail()
+		}
+	}
+
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "\t") {
+			t.Logf("Continuation line %q does not begin with whitespace", line)
+			t.Fail()
+		}
+	}
+
+	if !strings.HasSuffix(strings.Replace(folded, "\r\n\t", "", -1), "b="+sig.Sig) {
+		t.Log("b= is not last", folded)
+		t.Fail()
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	sig := testSignature()
+	unsigned := sig.Unsigned()
+
+	for _, tag := range []string{" p=;", " q=;", " b="} {
+		if !strings.Contains(unsigned, tag) {
+			t.Log("Missing empty", tag, "in", unsigned)
+			t.Fail()
+		}
+	}
+
+	if !strings.HasSuffix(unsigned, "b=") || !strings.Contains(unsigned, "bh="+sig.BodyHash) {
+		t.Log("Unexpected unsigned header", unsigned)
+		t.Fail()
+	}
+
+	// The same for any leaf and signature
+	other := testSignature()
+	other.Path[3] = "46"
+	other.Sig = "b3RoZXI="
+	if other.Unsigned() != unsigned {
+		t.Log("Unsigned header depends on the signature")
+		t.Fail()
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	valid := testSignature().String()
+
+	bad := map[string]string{
+		"duplicate tag":   valid + "; d=example.org",
+		"missing tag":     strings.Replace(valid, " s=_KeyForge;", "", 1),
+		"unsigned From":   strings.Replace(valid, "from:to:subject:from:subject", "to:subject", 1),
+		"bad version":     strings.Replace(valid, "v=1", "v=2", 1),
+		"bad algorithm":   strings.Replace(valid, "a="+Algorithm, "a=rsa-sha256", 1),
+		"bad path":        strings.Replace(valid, "p=2020.03", "p=2020.march", 1),
+		"bad c=":          strings.Replace(valid, "c=relaxed/simple", "c=loose", 1),
+		"bad l=":          valid + "; l=-5",
+		"empty signature": strings.TrimSuffix(valid, testSignature().Sig),
+		"no tag name":     valid + "; =x",
+		"no value":        valid + "; z",
+	}
+
+	for reason, value := range bad {
+		if err, _ := Parse(value); err == nil {
+			t.Log("Parsed header with", reason, value)
+			t.Fail()
+		}
+	}
+
+	// Unknown tags are ignored, a trailing ';' and folding whitespace allowed
+	lenient := strings.Replace(valid, "; b=", "; x_extra=1;\r\n\tb=", 1) + ";"
+	lenient = strings.Replace(lenient, "bh=47DEQ", "bh=47 DEQ", 1)
+	if err, parsed := Parse(lenient); err != nil || !reflect.DeepEqual(parsed, testSignature()) {
+		t.Log("Failed to parse", lenient, err)
+		t.Fail()
+	}
+}
+
+func TestDomainAndSelector(t *testing.T) {
+	for _, test := range []struct {
+		domain, selector string
+		valid            bool
+	}{
+		{"example.com", "_KeyForge", true},
+		{"Mail.Example.COM", "mail._KeyForge", true},
+		{"evil.com.attacker", "s1", true}, // well formed, if not the From's domain
+		{"a..b", "_KeyForge", false},
+		{".example.com", "_KeyForge", false},
+		{"example.com.", "_KeyForge", false},
+		{"-example.com", "_KeyForge", false},
+		{"exa_mple.com", "_KeyForge", false},
+		{"example.com/x", "_KeyForge", false},
+		{strings.Repeat("a", 64) + ".com", "_KeyForge", false},
+		{"example.com", "a/b", false},
+		{"example.com", "../_KeyForge", false},
+		{"example.com", "_Key_Forge", false},
+		{"example.com", "mail._KeyForge.", false},
+		{"example.com", "__KeyForge", false},
+		{"example.com", "", false},
+	} {
+		value := strings.Replace(testSignature().String(), "d=example.com", "d="+test.domain, 1)
+		value = strings.Replace(value, "s=_KeyForge", "s="+test.selector, 1)
+
+		err, sig := Parse(value)
+		if (err == nil) != test.valid {
+			t.Log("Parsing d="+test.domain, "s="+test.selector, "gave", err)
+			t.Fail()
+		} else if test.valid && sig.DNS() != test.selector+"."+strings.ToLower(test.domain) {
+			t.Log("Records for d="+test.domain, "s="+test.selector, "looked up at", sig.DNS())
+			t.Fail()
+		}
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	sig := testSignature()
+	if sig.DNS() != "_KeyForge.example.com" || strings.Contains(sig.String(), "k=") {
+		t.Log("Signature without a key ID names one", sig.DNS(), sig.String())
+		t.Fail()
+	}
+
+	sig.KeyID = "k2"
+	if sig.DNS() != "k2._KeyForge.example.com" {
+		t.Log("Records of key k2 looked up at", sig.DNS())
+		t.Fail()
+	}
+
+	if err, parsed := Parse(sig.Fold()); err != nil || !reflect.DeepEqual(parsed, sig) {
+		t.Log("Signature with k= did not round trip", err, parsed)
+		t.Fail()
+	}
+
+	// The key ID is signed
+	if !strings.Contains(sig.Unsigned(), " k=k2;") {
+		t.Log("k= missing from the unsigned header", sig.Unsigned())
+		t.Fail()
+	}
+
+	for _, bad := range []string{"", "k.2", "-k2", "k_2"} {
+		value := strings.Replace(sig.String(), "k=k2", "k="+bad, 1)
+		if err, _ := Parse(value); err == nil {
+			t.Log("Parsed header with key ID", bad)
+			t.Fail()
+		}
+	}
+}
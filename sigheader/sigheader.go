@@ -0,0 +1,369 @@
+/*
+Package sigheader defines the KeyForge-Signature header: a DKIM-style tag
+list (RFC 6376 section 3.2) naming everything a recipient needs to verify a
+message.
+
+	KeyForge-Signature: v=1; a=hibs-gs-sha256; c=relaxed/relaxed;
+		d=example.com; s=_KeyForge; k=k2; t=1; p=2020.03.02.45;
+		h=from:to:subject:date; bh=<b64 body hash>;
+		q=<b64 Q value>; b=<b64 signature point>
+
+v	version of this format, always 1
+a	signature algorithm
+c	header/body canonicalization, default simple/simple
+d	signing domain
+s	selector; the records are at <s>.<d>
+k	optional key ID of the master key; the records are then at <k>.<s>.<d>
+t	version of the time tree schema the path follows
+p	path of the leaf signed for, IDs separated by '.'
+h	signed headers, in the order they were hashed
+bh	b64 hash of the canonical body
+l	optional number of canonical body octets hashed
+q	b64 Q values of the leaf's sub-day levels, separated by ':'
+b	b64 signature point
+
+A signature is made for a leaf, and its Q values are only known once it has
+been made, so p=, q= and b= are left out of what is signed: the header is
+hashed as Unsigned gives it, whatever its folding. The signature point is
+only valid for the leaf's key, so p= and q= need no further protection.
+*/
+package sigheader
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/keyforgery/KeyForge/canonical"
+)
+
+const (
+	// The header carrying the signature
+	HeaderName = "KeyForge-Signature"
+
+	// Version of the header format
+	Version = 1
+
+	// Gentry-Silverberg HIBS over a sha256 digest
+	Algorithm = "hibs-gs-sha256"
+
+	// Longest line a folded header is broken into
+	lineLength = 78
+)
+
+type Signature struct {
+	Version          int
+	Algorithm        string
+	Canonicalization canonical.Canonicalization
+	Domain           string
+	Selector         string
+	KeyID            string // empty for keys without one
+	TreeVersion      int
+	Path             []string
+	Headers          []string
+	BodyHash         string
+	BodyLength       int64 // -1 when the whole body is signed
+	QValues          []string
+	Sig              string
+}
+
+// The name the signer's records are published under
+func (s *Signature) DNS() string {
+	if s.KeyID != "" {
+		return s.KeyID + "." + s.Selector + "." + s.Domain
+	}
+	return s.Selector + "." + s.Domain
+}
+
+type tag struct {
+	name  string
+	value string
+	b64   bool // may be broken anywhere when folding
+}
+
+func (s *Signature) tags() []tag {
+	tags := []tag{
+		{"v", strconv.Itoa(s.Version), false},
+		{"a", s.Algorithm, false},
+		{"c", s.Canonicalization.String(), false},
+		{"d", s.Domain, false},
+		{"s", s.Selector, false},
+	}
+
+	if s.KeyID != "" {
+		tags = append(tags, tag{"k", s.KeyID, false})
+	}
+
+	tags = append(tags,
+		tag{"t", strconv.Itoa(s.TreeVersion), false},
+		tag{"p", strings.Join(s.Path, "."), false},
+		tag{"h", strings.Join(s.Headers, ":"), false},
+		tag{"bh", s.BodyHash, true})
+
+	if s.BodyLength >= 0 {
+		tags = append(tags, tag{"l", strconv.FormatInt(s.BodyLength, 10), false})
+	}
+
+	return append(tags,
+		tag{"q", strings.Join(s.QValues, ":"), true},
+		tag{"b", s.Sig, true})
+}
+
+// The header value on a single line, with a leading space
+func (s *Signature) String() string {
+	parts := make([]string, 0)
+	for _, t := range s.tags() {
+		parts = append(parts, t.name+"="+t.value)
+	}
+	return " " + strings.Join(parts, "; ")
+}
+
+// Fold returns the header value, leading space included, broken into lines
+// of at most 78 characters with CRLF and a tab. Lines are broken between tags,
+// and inside b64 values that would not otherwise fit.
+func (s *Signature) Fold() string {
+	var b strings.Builder
+	b.WriteString(" ")
+	column := len(HeaderName) + 2
+
+	newLine := func() {
+		b.WriteString("\r\n\t")
+		column = 1
+	}
+
+	for i, t := range s.tags() {
+		text := t.name + "="
+		if i > 0 {
+			b.WriteString(";")
+			column++
+			text = " " + text
+		}
+
+		whole := text + t.value
+		if column+len(whole)+1 > lineLength && column > 1 {
+			if !t.b64 || column+len(text)+1 > lineLength {
+				newLine()
+				text = strings.TrimPrefix(text, " ")
+				whole = text + t.value
+			}
+		}
+
+		if !t.b64 || column+len(whole)+1 <= lineLength {
+			b.WriteString(whole)
+			column += len(whole)
+			continue
+		}
+
+		// Fill the rest of the line, and as many more as it takes
+		b.WriteString(text)
+		column += len(text)
+
+		value := t.value
+		for len(value) > 0 {
+			room := lineLength - 1 - column
+			if room <= 0 {
+				newLine()
+				continue
+			}
+			if room > len(value) {
+				room = len(value)
+			}
+			b.WriteString(value[:room])
+			column += room
+			value = value[room:]
+		}
+	}
+
+	return b.String()
+}
+
+// Removes folding whitespace
+func unfold(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "", " ", "", "\t", "").Replace(s)
+}
+
+// Splits a tag list into its tags, in order
+func parseTagList(value string) (error, []tag) {
+	tags := make([]tag, 0)
+	seen := make(map[string]bool)
+
+	for _, spec := range strings.Split(value, ";") {
+		if strings.TrimSpace(unfold(spec)) == "" {
+			// A trailing ';' is allowed
+			continue
+		}
+
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("Malformed tag " + strings.TrimSpace(spec)), nil
+		}
+
+		name := unfold(kv[0])
+		if name == "" || !isTagName(name) {
+			return errors.New("Malformed tag name " + strings.TrimSpace(kv[0])), nil
+		}
+
+		if seen[name] {
+			return errors.New("Duplicate tag " + name), nil
+		}
+		seen[name] = true
+
+		tags = append(tags, tag{name, strings.Trim(kv[1], " \t\r\n"), false})
+	}
+
+	return nil, tags
+}
+
+func isTagName(name string) bool {
+	for i, c := range name {
+		alpha := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !alpha && (i == 0 || c != '_' && (c < '0' || c > '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether s may be used as a DNS label
+func isLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether s is a domain name of labels, each allowed a leading '_' when
+// underscore is set, as selectors like _KeyForge have
+func isName(s string, underscore bool) bool {
+	if len(s) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(s, ".") {
+		if underscore {
+			label = strings.TrimPrefix(label, "_")
+		}
+		if !isLabel(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a header value, strictly: every required tag must be present and
+// well formed. Unknown tags are ignored, as DKIM requires.
+func Parse(value string) (error, *Signature) {
+	err, tags := parseTagList(value)
+	if err != nil {
+		return err, nil
+	}
+
+	values := make(map[string]string)
+	for _, t := range tags {
+		values[t.name] = t.value
+	}
+
+	for _, required := range []string{"v", "a", "d", "s", "t", "p", "h", "bh", "q", "b"} {
+		if _, ok := values[required]; !ok {
+			return errors.New("Missing tag " + required), nil
+		}
+	}
+
+	s := Signature{BodyLength: -1}
+
+	if s.Version, err = strconv.Atoi(values["v"]); err != nil || s.Version != Version {
+		return errors.New("Unsupported version " + values["v"]), nil
+	}
+
+	if s.Algorithm = values["a"]; s.Algorithm != Algorithm {
+		return errors.New("Unsupported algorithm " + s.Algorithm), nil
+	}
+
+	if err, s.Canonicalization = canonical.ParseCanonicalization(values["c"]); err != nil {
+		return err, nil
+	}
+
+	// Both end up in the name looked up
+	if s.Domain = strings.ToLower(values["d"]); !isName(s.Domain, false) {
+		return errors.New("Malformed domain " + values["d"]), nil
+	}
+
+	if s.Selector = values["s"]; !isName(s.Selector, true) {
+		return errors.New("Malformed selector " + values["s"]), nil
+	}
+
+	if k, ok := values["k"]; ok {
+		if s.KeyID = unfold(k); !isLabel(s.KeyID) {
+			return errors.New("Malformed key ID " + k), nil
+		}
+	}
+
+	if s.TreeVersion, err = strconv.Atoi(values["t"]); err != nil || s.TreeVersion < 1 {
+		return errors.New("Malformed tree version " + values["t"]), nil
+	}
+
+	s.Path = strings.Split(unfold(values["p"]), ".")
+	for _, id := range s.Path {
+		if _, err := strconv.Atoi(id); err != nil {
+			return errors.New("Malformed path " + values["p"]), nil
+		}
+	}
+
+	for _, h := range strings.Split(values["h"], ":") {
+		if h = strings.ToLower(strings.TrimSpace(unfold(h))); h == "" {
+			return errors.New("Malformed header list " + values["h"]), nil
+		}
+		s.Headers = append(s.Headers, h)
+	}
+
+	// The From header must always be signed
+	signsFrom := false
+	for _, h := range s.Headers {
+		signsFrom = signsFrom || h == "from"
+	}
+	if !signsFrom {
+		return errors.New("From is not signed"), nil
+	}
+
+	if s.BodyHash = unfold(values["bh"]); s.BodyHash == "" {
+		return errors.New("Empty body hash"), nil
+	}
+
+	if l, ok := values["l"]; ok {
+		if s.BodyLength, err = strconv.ParseInt(unfold(l), 10, 64); err != nil || s.BodyLength < 0 {
+			return errors.New("Malformed body length " + l), nil
+		}
+	}
+
+	// Trees without levels below a day have no Q values
+	if q := unfold(values["q"]); q != "" {
+		for _, value := range strings.Split(q, ":") {
+			if value == "" {
+				return errors.New("Malformed Q values " + values["q"]), nil
+			}
+			s.QValues = append(s.QValues, value)
+		}
+	}
+
+	if s.Sig = unfold(values["b"]); s.Sig == "" {
+		return errors.New("Empty signature"), nil
+	}
+
+	return nil, &s
+}
+
+// The header value as it is hashed: s with p=, q= and b= empty, on a single
+// line
+func (s *Signature) Unsigned() string {
+	unsigned := *s
+	unsigned.Path = nil
+	unsigned.QValues = nil
+	unsigned.Sig = ""
+	return unsigned.String()
+}
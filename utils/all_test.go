@@ -0,0 +1,300 @@
+package utils
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeTreeEncoding(t *testing.T) {
+	err, tree := NewTimeTree(5*time.Minute, []int{24, 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.String() != "1/300/24.12" {
+		t.Log("Unexpected encoding", tree.String())
+		t.Fail()
+	}
+
+	err, parsed := ParseTimeTree(tree.String())
+	if err != nil || parsed.Epoch != tree.Epoch || len(parsed.Branching) != 2 {
+		t.Log("Round trip failed", err, parsed)
+		t.Fail()
+	}
+
+	// Keys published without a schema use the original 15 minute chunks
+	err, parsed = ParseTimeTree("")
+	if err != nil || parsed.String() != DefaultTree.String() {
+		t.Log("Unexpected default", err, parsed)
+		t.Fail()
+	}
+}
+
+func TestTimeTreeValidation(t *testing.T) {
+	bad := []string{"2/900/96", "1/900/95", "1/7/12342", "1/900/", "1/0/1", "1/900"}
+
+	for _, encoded := range bad {
+		if err, _ := ParseTimeTree(encoded); err == nil {
+			t.Log("Accepted invalid tree", encoded)
+			t.Fail()
+		}
+	}
+}
+
+func TestTimeTreePath(t *testing.T) {
+	when := time.Date(2020, time.January, 31, 23, 47, 0, 0, time.UTC)
+
+	// The default tree gives the same paths as FomatPath always has
+	day, leaf := DefaultTree.Leaf(when)
+	path := DefaultTree.Path(day, leaf)
+	expected := FomatPath(2020, 1, 31, 95)
+
+	for i := range expected {
+		if path[i] != expected[i] {
+			t.Log("Unexpected path", path)
+			t.Fail()
+		}
+	}
+
+	// Hourly nodes with 5 minute leaves: 23:47 is hour 23, leaf 9
+	_, tree := NewTimeTree(5*time.Minute, []int{24, 12})
+	day, leaf = tree.Leaf(when)
+	path = tree.Path(day, leaf)
+
+	if len(path) != tree.Depth() || path[3] != "23" || path[4] != "09" {
+		t.Log("Unexpected path", path)
+		t.Fail()
+	}
+
+	if !tree.LeafStart(day, leaf).Equal(time.Date(2020, time.January, 31, 23, 45, 0, 0, time.UTC)) {
+		t.Log("Unexpected leaf start", tree.LeafStart(day, leaf))
+		t.Fail()
+	}
+}
+
+func TestTimeTreeCover(t *testing.T) {
+	from := time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := time.Date(2020, time.March, 15, 10, 7, 0, 0, time.UTC)
+
+	cover := DefaultTree.Cover(from, cutoff)
+
+	// 2019, January and February, the 1st to 14th of March, then the 15
+	// minute chunks of the 15th that began before 10:07, i.e. 00 through 40
+	if len(cover) != 1+2+14+41 {
+		t.Fatal("Unexpected cover size", len(cover), cover)
+	}
+
+	if len(cover[0]) != 1 || cover[0][0] != "2019" {
+		t.Log("Unexpected first node", cover[0])
+		t.Fail()
+	}
+
+	last := cover[len(cover)-1]
+	if len(last) != 4 || last[2] != "15" || last[3] != "40" {
+		t.Log("Unexpected last node", last)
+		t.Fail()
+	}
+
+	// With hourly nodes, whole hours are covered by a single node
+	_, tree := NewTimeTree(5*time.Minute, []int{24, 12})
+	cover = tree.Cover(cutoff, cutoff)
+
+	hours := 0
+	for _, path := range cover {
+		if len(path) == 4 {
+			hours++
+		}
+	}
+
+	// Hours 00 to 09, then 10:00 and 10:05 as leaves
+	if hours != 10 || len(cover[len(cover)-1]) != 5 || cover[len(cover)-1][4] != "01" {
+		t.Log("Unexpected cover", cover)
+		t.Fail()
+	}
+
+	// Nothing has begun before the first leaf
+	if cover := DefaultTree.Cover(cutoff, time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)); len(cover) != 0 {
+		t.Log("Covered leaves that have not begun", cover)
+		t.Fail()
+	}
+}
+
+func TestTimeTreeSpan(t *testing.T) {
+	_, tree := NewTimeTree(5*time.Minute, []int{24, 12})
+
+	cases := []struct {
+		path       []string
+		start, end time.Time
+	}{
+		{[]string{"2020", "02"}, time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{[]string{"2020", "12", "31"}, time.Date(2020, time.December, 31, 0, 0, 0, 0, time.UTC), time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{[]string{"2020", "01", "31", "23", "09"}, time.Date(2020, time.January, 31, 23, 45, 0, 0, time.UTC), time.Date(2020, time.January, 31, 23, 50, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		err, start, end := tree.Span(c.path)
+		if err != nil || !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Log("Unexpected span of", c.path, err, start, end)
+			t.Fail()
+		}
+	}
+
+	for _, bad := range [][]string{{"2020", "13"}, {"2021", "02", "29"}, {"2020", "01", "01", "24"}, {"year"}} {
+		if err, _, _ := tree.Span(bad); err == nil {
+			t.Log("Span of", bad, "was accepted")
+			t.Fail()
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	loc := filepath.Join(dir, "config.json")
+
+	write := func(contents string) {
+		if err := ioutil.WriteFile(loc, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	load := func(args ...string) (error, *Configuration) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterFlags(fs)
+		if err := fs.Parse(append([]string{"-c", loc}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(flags)
+	}
+
+	// Written before Version, with only some fields
+	write(`{"KeyDir": "/keys", "HTTPAddress": ":9000", "DNSBackoff": "2s"}`)
+
+	err, config := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Version != 1 || config.KeyDirectory != "/keys" || config.HTTPAddress != ":9000" ||
+		config.DNSBackoff.Duration != 2*time.Second || config.DNSAttempts != DefaultDNSAttempts ||
+		config.RecordTTL != DefaultRecordTTL || config.KFPipe != DefaultKFSock {
+		t.Log("Unexpected config", config)
+		t.Fail()
+	}
+
+	// The environment overrides the file, and flags the environment
+	t.Setenv("KEYFORGE_HTTP_ADDRESS", ":9001")
+	t.Setenv("KEYFORGE_DNS_ATTEMPTS", "2")
+	t.Setenv("KEYFORGE_BRANCHING", "24, 4")
+	t.Setenv("KEYFORGE_EPOCH", "15m")
+
+	err, config = load("-http", ":9002", "-d", "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.HTTPAddress != ":9002" || config.KeyDirectory != "/other" || config.DNSAttempts != 2 ||
+		len(config.Branching) != 2 || config.Branching[1] != 4 {
+		t.Log("Overrides not applied", config)
+		t.Fail()
+	}
+
+	t.Setenv("KEYFORGE_DNS_ATTEMPTS", "many")
+	if err, _ := load(); err == nil || !strings.Contains(err.Error(), "KEYFORGE_DNS_ATTEMPTS") {
+		t.Log("Malformed environment accepted", err)
+		t.Fail()
+	}
+	t.Setenv("KEYFORGE_DNS_ATTEMPTS", "2")
+
+	for _, bad := range []string{
+		`{"KeyDirectory": "/keys"}`,
+		`{"Version": 2}`,
+		`{"DNSBackoff": 10}`,
+		`{"LogLevel": "loud"}`,
+		`{"TLSCert": "cert.pem"}`,
+		`{"Signers": [{"Domain": "example.com", "KeyDir": "/a"}, {"Domain": "EXAMPLE.com", "KeyDir": "/b"}]}`,
+		`{"Clients": [{"Name": "nobody"}]}`,
+		`{"Horizon": "720h", "RenewBefore": "720h"}`,
+	} {
+		write(bad)
+		if err, _ := load(); err == nil {
+			t.Log("Accepted", bad)
+			t.Fail()
+		}
+	}
+
+	// Asked for, so it must be there
+	loc = filepath.Join(dir, "missing.json")
+	if err, _ := load(); err == nil {
+		t.Log("Missing config accepted")
+		t.Fail()
+	}
+
+	// Without flags, $KEYFORGE_CONFIG asks for it too
+	t.Setenv(ConfigEnv, loc)
+	if err, _ := LoadConfig(nil); err == nil {
+		t.Log("Missing config accepted from the environment")
+		t.Fail()
+	}
+
+	// What is written reads back the same
+	written := DefaultConfiguration()
+	written.AuditLog = "/var/log/keyforge-audit.log"
+	if err := WriteConfig(loc, written); err != nil {
+		t.Fatal(err)
+	}
+
+	err, read := ReadConfig(loc)
+	if err != nil || read.AuditLog != written.AuditLog || read.ShutdownTimeout != written.ShutdownTimeout {
+		t.Log("Written config read back differently", err, read)
+		t.Fail()
+	}
+}
+
+func TestRecordStart(t *testing.T) {
+	for _, test := range []struct {
+		tags  map[string]string
+		start time.Time
+	}{
+		{map[string]string{"start": "2019-12-20", "2020": "x"}, time.Date(2019, time.December, 20, 0, 0, 0, 0, time.UTC)},
+		{map[string]string{"2021": "x", "2020": "x", "public": "x"}, time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{map[string]string{"start": "soon", "2021": "x"}, time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{map[string]string{"public": "x", "20201": "x"}, time.Time{}},
+	} {
+		if start := RecordStart(test.tags); !start.Equal(test.start) {
+			t.Log("Records", test.tags, "start", start, "rather than", test.start)
+			t.Fail()
+		}
+	}
+}
+
+func TestSelectorFor(t *testing.T) {
+	config := DefaultConfiguration()
+	config.Selector = ""
+
+	if selector := config.SelectorFor("/keys"); selector != DefaultSelector {
+		t.Log("Selector without any configured is", selector)
+		t.Fail()
+	}
+
+	config.Selector = "main"
+	config.Signers = []SignerConfig{
+		{Domain: "example.com", Selector: "mail", KeyDirectory: "/keys/example.com"},
+		{Domain: "example.org", KeyDirectory: "/keys/example.org/"},
+	}
+
+	for keyDir, want := range map[string]string{
+		"/keys/example.com":  "mail",
+		"/keys/example.org":  DefaultSelector,
+		"/keys/example.net":  "main",
+		"/keys/example.com/": "mail",
+	} {
+		if selector := config.SelectorFor(keyDir); selector != want {
+			t.Log("Keys in", keyDir, "published under", selector, "rather than", want)
+			t.Fail()
+		}
+	}
+}
@@ -2,101 +2,540 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Version of the configuration schema written by this code. Files without a
+// Version predate it, and are read as version 1.
+const ConfigVersion = 1
+
+/*
+Configuration is what the KeyForge commands are configured with, read from a
+JSON file by LoadConfig. Fields left out of the file keep their defaults, see
+DefaultConfiguration; each field with an env tag may then be overridden by
+that environment variable, and some by the flags of ConfigFlags.
+*/
 type Configuration struct {
-	KeyDirectory  string `json:"KeyDir"`
-	MilterMTAPipe string `json:"MilterPipeLocation"` // Where milter <-> MTA pipe exists
-	KFPipe        string `json:"KeyForgePipeFile"`   // Where KF server <-> milter pipe exists
+	Version int `json:"Version"` // ConfigVersion
+
+	KeyDirectory  string `json:"KeyDir" env:"KEYFORGE_KEY_DIR"`
+	MilterMTAPipe string `json:"MilterPipeLocation" env:"KEYFORGE_MILTER_PIPE"` // Where milter <-> MTA pipe exists
+	KFPipe        string `json:"KeyForgePipeFile" env:"KEYFORGE_PIPE"`          // Where KF server <-> milter pipe exists
+	DNSResolver   string `json:"DNSResolver" env:"KEYFORGE_DNS_RESOLVER"`       // Resolver for verification, e.g. udp://127.0.0.1:53, empty for the system resolver
+	DNSCacheSize  int    `json:"DNSCacheSize" env:"KEYFORGE_DNS_CACHE_SIZE"`    // Number of DNS tree nodes to cache, 0 for the default
+	Domain        string `json:"Domain" env:"KEYFORGE_DOMAIN"`                  // Domain mail is signed for, d= in the signature
+	Selector      string `json:"Selector" env:"KEYFORGE_SELECTOR"`              // Label under Domain the records live at, default _KeyForge
+	HTTPAddress   string `json:"HTTPAddress" env:"KEYFORGE_HTTP_ADDRESS"`       // Where keyforge-server serves its HTTP API, default :8081
+
+	// Every domain signed for, each with its own keys. Overrides Domain,
+	// Selector and KeyDir.
+	Signers []SignerConfig `json:"Signers"`
+
+	// Who may use keyforge-server. Without any, only the user it runs as may,
+	// and only over its unix socket.
+	Clients []ClientConfig `json:"Clients"`
+
+	// Serve HTTPAddress over TLS with this certificate and key
+	TLSCert string `json:"TLSCert" env:"KEYFORGE_TLS_CERT"`
+	TLSKey  string `json:"TLSKey" env:"KEYFORGE_TLS_KEY"`
+	// Accept client certificates signed by these CAs, see ClientConfig
+	TLSClientCA string `json:"TLSClientCA" env:"KEYFORGE_TLS_CLIENT_CA"`
+
+	LogLevel string `json:"LogLevel" env:"KEYFORGE_LOG_LEVEL"` // debug, info, warn or error, default info
+	AuditLog string `json:"AuditLog" env:"KEYFORGE_AUDIT_LOG"` // File every signature issued is recorded in, none if empty
+
+	DNSAttempts     int      `json:"DNSAttempts" env:"KEYFORGE_DNS_ATTEMPTS"`         // Tries at each DNS lookup before giving up, default 4
+	DNSBackoff      Duration `json:"DNSBackoff" env:"KEYFORGE_DNS_BACKOFF"`           // Wait between those tries, default 10s
+	ExpiryDelay     Duration `json:"ExpiryDelay" env:"KEYFORGE_EXPIRY_DELAY"`         // How long after a leaf begins its secret is published, default 5m
+	ShutdownTimeout Duration `json:"ShutdownTimeout" env:"KEYFORGE_SHUTDOWN_TIMEOUT"` // How long shutting down waits for requests under way, default 30s
+
+	// The keys keyforge-generate makes
+	Epoch      Duration `json:"Epoch" env:"KEYFORGE_EPOCH"`            // How long each signing key lasts, default 15m
+	Branching  []int    `json:"Branching" env:"KEYFORGE_BRANCHING"`    // Children per sub-day tree level, default a single level
+	RecordTTL  int      `json:"RecordTTL" env:"KEYFORGE_RECORD_TTL"`   // TTL of the records, in seconds, default 3600
+	ZoneOrigin string   `json:"ZoneOrigin" env:"KEYFORGE_ZONE_ORIGIN"` // Domain the records are named under, relative names if empty
+
+	// How keyforge-generate -maintain keeps records published ahead
+	Horizon        Duration `json:"Horizon" env:"KEYFORGE_HORIZON"`                // How far ahead records are published, default 365 days
+	RenewBefore    Duration `json:"RenewBefore" env:"KEYFORGE_RENEW_BEFORE"`       // Publish further once the records end within this, default 30 days
+	MaintainEvery  Duration `json:"MaintainEvery" env:"KEYFORGE_MAINTAIN_EVERY"`   // How often to check, default 1h
+	PublishCommand string   `json:"PublishCommand" env:"KEYFORGE_PUBLISH_COMMAND"` // Run with sh -c once the zone file changed, e.g. keyforge-publish, none if empty
+}
+
+// A client of keyforge-server, and what it may do. It is recognised by any of
+// its uids or gids on the unix socket, and by its token or certificate over
+// HTTP.
+type ClientConfig struct {
+	Name        string   `json:"Name"`        // for logs
+	UIDs        []uint32 `json:"UIDs"`        // unix socket peers running as any of these users
+	GIDs        []uint32 `json:"GIDs"`        // or in any of these groups
+	Token       string   `json:"Token"`       // sent as Authorization: Bearer <token>
+	CertSubject string   `json:"CertSubject"` // common name of its TLS client certificate
+	Domains     []string `json:"Domains"`     // sender domains it may sign for, any if empty
+	Rate        float64  `json:"Rate"`        // signatures a second it may ask for, unlimited if 0
+	Burst       int      `json:"Burst"`       // signatures it may ask for at once, default Rate
+}
+
+// One domain signed for
+type SignerConfig struct {
+	Domain       string  `json:"Domain"`
+	Selector     string  `json:"Selector"` // default _KeyForge
+	KeyDirectory string  `json:"KeyDir"`   // as written by keyforge-generate
+	Rate         float64 `json:"Rate"`     // signatures a second for senders in Domain, by all clients, unlimited if 0
+	Burst        int     `json:"Burst"`    // signatures at once, default Rate
+}
+
+// A time.Duration, written in the config as a string like "10s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string like \"10s\", not " + string(b))
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = parsed
+	return nil
+}
+
+// The domains to sign for: Signers, or else the single Domain. Empty when
+// neither is configured.
+func (c *Configuration) SignerConfigs() []SignerConfig {
+	if len(c.Signers) > 0 {
+		return c.Signers
+	}
+
+	if c.Domain == "" {
+		return nil
+	}
+
+	return []SignerConfig{{Domain: c.Domain, Selector: c.Selector, KeyDirectory: c.KeyDirectory}}
+}
+
+// The selector the records of the keys in keyDir are published under: that of
+// the signer whose keys they are, or else Selector
+func (c *Configuration) SelectorFor(keyDir string) string {
+	selector := c.Selector
+	for _, signer := range c.Signers {
+		if filepath.Clean(signer.KeyDirectory) == filepath.Clean(keyDir) {
+			selector = signer.Selector
+		}
+	}
+
+	if selector == "" {
+		return DefaultSelector
+	}
+	return selector
 }
 
 const (
-	DefaultConfigLoc  = "~/.KeyForge/config.json"
-	DefaultMilterSock = "/tmp/milter.sock"
-	DefaultKFSock     = "/tmp/kf.sock"
-	DefaultKeyDir     = "~/.KeyForge/"
-	DefaultDNS        = "_KeyForge.example.com"
-	ConfigHelp        = "Specifies the configfile location"
-	KeyDirHelp        = "Specifies the directory for public and private keyfiles"
-	MilterHelp        = "Specifies the location of the Milter <-> MTA pipe"
-	KFSockHelp        = "Specifies the location of the KeyForge <-> milter pipe"
-	KFDNSHelp         = "Specifies the DNS of our local server"
+	DefaultConfigLoc   = "~/.KeyForge/config.json"
+	DefaultMilterSock  = "/tmp/milter.sock"
+	DefaultKFSock      = "/tmp/kf.sock"
+	DefaultKeyDir      = "~/.KeyForge/"
+	DefaultDNS         = "_KeyForge.example.com"
+	DefaultSelector    = "_KeyForge"
+	DefaultHTTPAddr    = ":8081"
+	DefaultLogLevel    = "info"
+	DefaultDNSAttempts = 4
+	DefaultDNSBackoff  = 10 * time.Second
+	DefaultExpiryDelay = 5 * time.Minute
+	DefaultShutdown    = 30 * time.Second
+	DefaultRecordTTL   = 3600
+	DefaultHorizon     = 365 * 24 * time.Hour
+	DefaultRenewBefore = 30 * 24 * time.Hour
+	DefaultMaintain    = time.Hour
+	ConfigHelp         = "Specifies the configfile location"
+	KeyDirHelp         = "Specifies the directory for public and private keyfiles"
+	MilterHelp         = "Specifies the location of the Milter <-> MTA pipe"
+	KFSockHelp         = "Specifies the location of the KeyForge <-> milter pipe"
+	KFDNSHelp          = "Specifies the DNS of our local server"
+	HTTPHelp           = "Specifies where keyforge-server serves HTTP"
+	LogLevelHelp       = "Specifies the level logged at: debug, info, warn or error"
+
+	// Names the config file when no -c flag is given
+	ConfigEnv = "KEYFORGE_CONFIG"
 )
 
+// The configuration before any file, environment or flag is read
+func DefaultConfiguration() *Configuration {
+	return &Configuration{
+		Version:         ConfigVersion,
+		KeyDirectory:    DefaultKeyDir,
+		MilterMTAPipe:   DefaultMilterSock,
+		KFPipe:          DefaultKFSock,
+		Selector:        DefaultSelector,
+		HTTPAddress:     DefaultHTTPAddr,
+		LogLevel:        DefaultLogLevel,
+		DNSAttempts:     DefaultDNSAttempts,
+		DNSBackoff:      Duration{DefaultDNSBackoff},
+		ExpiryDelay:     Duration{DefaultExpiryDelay},
+		ShutdownTimeout: Duration{DefaultShutdown},
+		Epoch:           Duration{DefaultTree.Epoch},
+		RecordTTL:       DefaultRecordTTL,
+		Horizon:         Duration{DefaultHorizon},
+		RenewBefore:     Duration{DefaultRenewBefore},
+		MaintainEvery:   Duration{DefaultMaintain},
+	}
+}
+
 func check(e error) {
 	if e != nil {
 		panic(e)
 	}
 }
 
-func ConfigFlags() (configLoc, milterSock, kfSock, keyDir string) {
-	milterSock = *flag.String("m", DefaultMilterSock, MilterHelp)
-	configLoc = *flag.String("c", DefaultConfigLoc, ConfigHelp)
-	kfSock = *flag.String("k", DefaultKFSock, KFSockHelp)
-	keyDir = *flag.String("d", DefaultKeyDir, KeyDirHelp)
+// Replaces a leading ~/ in p with the user's home directory
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+
+	usr, err := user.Current()
+	check(err)
+	return path.Join(usr.HomeDir, p[2:])
+}
+
+/*
+Flags are the flags the KeyForge commands share. Those given on the command
+line override the config file and the environment:
+
+	-c	the config file, default $KEYFORGE_CONFIG or ~/.KeyForge/config.json
+	-d	KeyDir
+	-m	MilterPipeLocation
+	-k	KeyForgePipeFile
+	-http	HTTPAddress
+	-log	LogLevel
+*/
+type Flags struct {
+	ConfigLoc   string
+	KeyDir      string
+	MilterPipe  string
+	KFPipe      string
+	HTTPAddress string
+	LogLevel    string
+
+	// Whether the config file may be missing even when asked for, as it is
+	// for keyforge-generate, which writes it
+	MayBeMissing bool
+
+	fs *flag.FlagSet
+}
+
+// Defines the shared flags on fs, to be read by LoadConfig once fs is parsed
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := Flags{fs: fs}
+	fs.StringVar(&f.ConfigLoc, "c", DefaultConfigLoc, ConfigHelp)
+	fs.StringVar(&f.KeyDir, "d", DefaultKeyDir, KeyDirHelp)
+	fs.StringVar(&f.MilterPipe, "m", DefaultMilterSock, MilterHelp)
+	fs.StringVar(&f.KFPipe, "k", DefaultKFSock, KFSockHelp)
+	fs.StringVar(&f.HTTPAddress, "http", DefaultHTTPAddr, HTTPHelp)
+	fs.StringVar(&f.LogLevel, "log", DefaultLogLevel, LogLevelHelp)
+	return &f
+}
+
+// Defines the shared flags on the command line and parses it. A command's own
+// flags must be defined before.
+func ConfigFlags() *Flags {
+	f := RegisterFlags(flag.CommandLine)
 	flag.Parse()
+	return f
+}
+
+// Whether the flag was on the command line
+func (f *Flags) given(name string) bool {
+	given := false
+	if f != nil && f.fs != nil {
+		f.fs.Visit(func(fl *flag.Flag) {
+			if fl.Name == name {
+				given = true
+			}
+		})
+	}
+	return given
+}
+
+// The config file to read: -c, $KEYFORGE_CONFIG, or the default. Whether it
+// was asked for, rather than defaulted to.
+func (f *Flags) configFile() (string, bool) {
+	if f.given("c") {
+		return expandHome(f.ConfigLoc), true
+	}
+	if loc, ok := os.LookupEnv(ConfigEnv); ok && loc != "" {
+		return expandHome(loc), true
+	}
+	return expandHome(DefaultConfigLoc), false
+}
+
+// Where LoadConfig reads the config file from
+func (f *Flags) ConfigFile() string {
+	loc, _ := f.configFile()
+	return loc
+}
+
+func (f *Flags) apply(c *Configuration) {
+	if f == nil {
+		return
+	}
 
-	if keyDir == DefaultKeyDir {
-		usr, err := user.Current()
-		check(err)
-		keyDir = path.Join(usr.HomeDir, ".KeyForge/")
+	for name, field := range map[string]struct {
+		value string
+		to    *string
+	}{
+		"d":    {f.KeyDir, &c.KeyDirectory},
+		"m":    {f.MilterPipe, &c.MilterMTAPipe},
+		"k":    {f.KFPipe, &c.KFPipe},
+		"http": {f.HTTPAddress, &c.HTTPAddress},
+		"log":  {f.LogLevel, &c.LogLevel},
+	} {
+		if f.given(name) {
+			*field.to = field.value
+		}
 	}
+}
+
+// Sets each field with an env tag whose variable lookup finds
+func (c *Configuration) applyEnv(lookup func(string) (string, bool)) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch field := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			*field = value
+		case *int:
+			*field, err = strconv.Atoi(value)
+		case *Duration:
+			field.Duration, err = time.ParseDuration(value)
+		case *[]int:
+			*field = nil
+			for _, part := range strings.Split(value, ",") {
+				n, convErr := strconv.Atoi(strings.TrimSpace(part))
+				if convErr != nil {
+					err = convErr
+					break
+				}
+				*field = append(*field, n)
+			}
+		default:
+			err = fmt.Errorf("cannot be set from the environment")
+		}
 
-	if configLoc == DefaultConfigLoc {
-		usr, err := user.Current()
-		check(err)
-		configLoc = path.Join(usr.HomeDir, ".KeyForge/")
-		configLoc = path.Join(configLoc, "config.json")
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
 	}
 
-	return
+	return nil
 }
 
-func SetupConfig(ConfigLoc, KeyDir, MilterPipe, KFPipe string) (error, *Configuration) {
-	// Sets up the overall config at a particular location
+func (c *Configuration) expandPaths() {
+	for _, p := range []*string{&c.KeyDirectory, &c.MilterMTAPipe, &c.KFPipe, &c.AuditLog, &c.TLSCert, &c.TLSKey, &c.TLSClientCA} {
+		*p = expandHome(*p)
+	}
+
+	for i := range c.Signers {
+		c.Signers[i].KeyDirectory = expandHome(c.Signers[i].KeyDirectory)
+	}
+}
+
+// Checks the configuration for values the commands cannot work with,
+// reporting all of them
+func (c *Configuration) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Version > ConfigVersion {
+		fail("Version %d is newer than this KeyForge understands, %d", c.Version, ConfigVersion)
+	}
+
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("LogLevel must be debug, info, warn or error, not %q", c.LogLevel)
+	}
 
-	Config := Configuration{KeyDir, MilterPipe, KFPipe}
+	if c.DNSCacheSize < 0 {
+		fail("DNSCacheSize must not be negative")
+	}
+	if c.DNSAttempts < 1 {
+		fail("DNSAttempts must be at least 1")
+	}
+	if c.DNSBackoff.Duration < 0 || c.ExpiryDelay.Duration < 0 || c.ShutdownTimeout.Duration < 0 {
+		fail("DNSBackoff, ExpiryDelay and ShutdownTimeout must not be negative")
+	}
+	if c.RecordTTL < 0 {
+		fail("RecordTTL must not be negative")
+	}
+	if c.Horizon.Duration < 24*time.Hour {
+		fail("Horizon must be at least a day")
+	}
+	if c.RenewBefore.Duration < 0 || c.RenewBefore.Duration >= c.Horizon.Duration {
+		fail("RenewBefore must be at least 0 and less than Horizon")
+	}
+	if c.MaintainEvery.Duration <= 0 {
+		fail("MaintainEvery must be positive")
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		fail("TLSCert and TLSKey must be given together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		fail("TLSClientCA needs TLSCert and TLSKey")
+	}
+
+	if err, _ := NewTimeTree(c.Epoch.Duration, c.Branching); err != nil {
+		fail("Epoch and Branching: %v", err)
+	}
 
-	b, err := json.MarshalIndent(Config, "", "  ")
+	domains := make(map[string]bool)
+	for i, s := range c.Signers {
+		domain := strings.ToLower(s.Domain)
+		switch {
+		case domain == "":
+			fail("Signers[%d] has no Domain", i)
+		case domains[domain]:
+			fail("more than one signer for %s", domain)
+		}
+		domains[domain] = true
 
+		if s.KeyDirectory == "" {
+			fail("signer for %s has no KeyDir", s.Domain)
+		}
+		if s.Rate < 0 || s.Burst < 0 {
+			fail("signer for %s has a negative Rate or Burst", s.Domain)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, cl := range c.Clients {
+		switch {
+		case cl.Name == "":
+			fail("Clients[%d] has no Name", i)
+		case names[cl.Name]:
+			fail("more than one client named %s", cl.Name)
+		}
+		names[cl.Name] = true
+
+		if len(cl.UIDs) == 0 && len(cl.GIDs) == 0 && cl.Token == "" && cl.CertSubject == "" {
+			fail("client %s has no UIDs, GIDs, Token or CertSubject to be recognised by", cl.Name)
+		}
+		if cl.Rate < 0 || cl.Burst < 0 {
+			fail("client %s has a negative Rate or Burst", cl.Name)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+LoadConfig reads the configuration: the defaults, then the config file, then
+the environment, then the flags given on the command line, and validates it.
+A missing config file is only an error if it was asked for with -c or
+$KEYFORGE_CONFIG, and flags' MayBeMissing is not set. flags may be nil.
+*/
+func LoadConfig(flags *Flags) (error, *Configuration) {
+	loc, asked := flags.configFile()
+
+	err, config := ReadConfig(loc)
+	if os.IsNotExist(err) && (!asked || flags != nil && flags.MayBeMissing) {
+		err, config = nil, DefaultConfiguration()
+	}
 	if err != nil {
-		// Unable to parse for some reason, should never happen
 		return err, nil
 	}
 
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return err, nil
+	}
+	flags.apply(config)
+
+	config.expandPaths()
+
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("%s: %v", loc, err), nil
+	}
+
+	return nil, config
+}
+
+// Writes config to ConfigLoc, creating its directory
+func WriteConfig(ConfigLoc string, config *Configuration) error {
+	b, err := json.MarshalIndent(config, "", "  ")
+
+	if err != nil {
+		// Unable to parse for some reason, should never happen
+		return err
+	}
+
 	if _, err2 := os.Stat(ConfigLoc); os.IsNotExist(err2) {
 		dir, _ := filepath.Split(ConfigLoc)
-		os.MkdirAll(dir, os.ModePerm)
+		os.MkdirAll(dir, 0700)
 	}
 
-	err2 := ioutil.WriteFile(ConfigLoc, b, 0644)
-
-	return err2, &Config
+	return ioutil.WriteFile(ConfigLoc, b, 0600)
 }
 
+// Reads the config file at ConfigLoc over the defaults. Unknown fields are
+// refused, as they are most likely misspelt.
 func ReadConfig(ConfigLoc string) (error, *Configuration) {
-	// Reads the overall config from a particular location
-
 	file, err := os.Open(ConfigLoc)
 
 	if err != nil {
-		return nil, nil
+		return err, nil
 	}
 
 	defer file.Close()
 	decoder := json.NewDecoder(file)
-	Config := Configuration{}
-	err = decoder.Decode(&Config)
+	decoder.DisallowUnknownFields()
+
+	Config := DefaultConfiguration()
+	Config.Version = 0
+	err = decoder.Decode(Config)
 
 	if err != nil {
-		return nil, nil
+		return fmt.Errorf("%s: %v", ConfigLoc, err), nil
+	}
+
+	if Config.Version == 0 {
+		// Written before the schema had versions
+		Config.Version = 1
 	}
 
-	return nil, &Config
+	return nil, Config
 }
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// Version of the delegated key format
+const DelegationVersion = 1
+
+/*
+DelegatedKey is the secret of one node of a key's tree, handed to a signing
+host in place of the master secret. The host can sign for every leaf between
+NotBefore and NotAfter and nothing else, so a compromised host cannot sign
+into the future beyond its delegation.
+*/
+type DelegatedKey struct {
+	Version   int        `json:"version"`
+	Tree      string     `json:"tree"`      // TimeTree encoding
+	NotBefore time.Time  `json:"notBefore"` // first leaf covered begins
+	NotAfter  time.Time  `json:"notAfter"`  // last leaf covered ends
+	Node      NodeSecret `json:"node"`
+}
+
+// Reads a delegated key written by keyforge-generate
+func ReadDelegatedKey(filename string) (error, *DelegatedKey) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err, nil
+	}
+
+	var key DelegatedKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return err, nil
+	}
+
+	if key.Version != DelegationVersion {
+		return errors.New("Unsupported delegated key version " + strconv.Itoa(key.Version)), nil
+	}
+
+	return nil, &key
+}
@@ -0,0 +1,50 @@
+package utils
+
+import "time"
+
+// Version of the expiry document format
+const ExpiryVersion = 1
+
+// The secret of one node of the tree, and where it sits
+type NodeSecret struct {
+	Path      []string `json:"path"`
+	Secret    string   `json:"secret"`    // hibs.ExportNodePrivate of the node
+	Ancestors []string `json:"ancestors"` // b64 Q values of the nodes above it, root first
+}
+
+/*
+ExpiryDocument is the expiry information for a key: the secrets of the
+smallest set of nodes covering every leaf of the tree whose signatures have
+expired. With it anyone can sign for those leaves, which is what makes old
+signatures deniable.
+*/
+type ExpiryDocument struct {
+	Version int          `json:"version"`
+	KeyID   string       `json:"keyID,omitempty"` // generation of the key, see Generation
+	Tree    string       `json:"tree"`            // TimeTree encoding
+	Expired time.Time    `json:"expired"`         // every leaf beginning before this is covered
+	Nodes   []NodeSecret `json:"nodes"`
+}
+
+// The node covering path, if any
+func (d *ExpiryDocument) Covering(path []string) *NodeSecret {
+	for i, node := range d.Nodes {
+		if len(node.Path) > len(path) {
+			continue
+		}
+
+		covers := true
+		for j, ID := range node.Path {
+			if path[j] != ID {
+				covers = false
+				break
+			}
+		}
+
+		if covers {
+			return &d.Nodes[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the generation file format
+const GenerationVersion = 1
+
+// Name of the file describing a generation, in its directory
+const GenerationFile = "generation.json"
+
+/*
+Generation describes one master key of a domain's. Each is published under
+its own key ID, <id>.<selector>.<domain>, so a successor can be published
+alongside the key it replaces and signing moves to it at ActiveFrom, once its
+records have reached resolvers. Signatures name the key ID they were made
+with, so those made before the rollover keep verifying.
+
+Keys written before generations existed have no key ID, and are published at
+<selector>.<domain> as before.
+*/
+type Generation struct {
+	Version    int       `json:"version"`
+	KeyID      string    `json:"keyID"`      // k1, k2, ...
+	Created    time.Time `json:"created"`    // when keyforge-generate wrote it
+	ActiveFrom time.Time `json:"activeFrom"` // when signing with it begins
+}
+
+/*
+StartTag names, in a base record, the first day its key published records for,
+as StartFormat. Records are rewritten from shortly before the day they are
+rewritten on, dropping the years before, but expiry information must still be
+disclosed from the first day, so the tag is carried over.
+*/
+const (
+	StartTag    = "start"
+	StartFormat = "2006-01-02"
+)
+
+// The first day the base record with tags published records for: its
+// StartTag, or for records written before there was one, the start of its
+// earliest year. Zero if it names neither.
+func RecordStart(tags map[string]string) time.Time {
+	if start, err := time.Parse(StartFormat, tags[StartTag]); err == nil {
+		return start
+	}
+
+	var start time.Time
+	for tag := range tags {
+		year, err := strconv.Atoi(tag)
+		if err != nil || len(tag) != 4 {
+			continue
+		}
+
+		if yearStart := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC); start.IsZero() || yearStart.Before(start) {
+			start = yearStart
+		}
+	}
+
+	return start
+}
+
+// The key ID of the n-th generation, k<n>
+func FormatKeyID(n int) string {
+	return "k" + strconv.Itoa(n)
+}
+
+// The number of a key ID written by FormatKeyID
+func ParseKeyID(id string) (error, int) {
+	n, err := strconv.Atoi(strings.TrimPrefix(id, "k"))
+	if !strings.HasPrefix(id, "k") || err != nil || n < 1 || FormatKeyID(n) != id {
+		return errors.New("Malformed key ID " + id), 0
+	}
+	return nil, n
+}
+
+// Reads a generation file written by keyforge-generate
+func ReadGeneration(filename string) (error, *Generation) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err, nil
+	}
+
+	var g Generation
+	if err := json.Unmarshal(data, &g); err != nil {
+		return err, nil
+	}
+
+	if g.Version != GenerationVersion {
+		return errors.New("Unsupported generation version " + strconv.Itoa(g.Version)), nil
+	}
+
+	if err, _ := ParseKeyID(g.KeyID); err != nil {
+		return err, nil
+	}
+
+	return nil, &g
+}
+
+func WriteGeneration(filename string, g *Generation) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
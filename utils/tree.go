@@ -0,0 +1,319 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Version of the tree schema encoding
+	TreeVersion = 1
+
+	oneDay = 24 * time.Hour
+)
+
+/*
+TimeTree describes how time maps onto the HIBS tree.
+
+The top of the tree is always the calendar: year, month and day, which is what
+gets published in DNS. Below the day are one or more sub-day levels, each
+splitting its parent into Branching[i] children, down to leaves that are Epoch
+long. For example:
+
+	15 minute leaves, one level:          Epoch 15m, Branching [96]
+	5 minute leaves, under hourly nodes:  Epoch 5m,  Branching [24, 12]
+	one leaf per day:                     Epoch 24h, Branching [1]
+
+The Q values of the sub-day levels travel with each signature, so the shape
+below the day can change without changing what is published in DNS.
+*/
+type TimeTree struct {
+	Version   int
+	Epoch     time.Duration // how long each leaf lasts
+	Branching []int         // children per node for each sub-day level
+}
+
+// The shape used before the schema was configurable: 15 minute chunks
+var DefaultTree = TimeTree{TreeVersion, 15 * time.Minute, []int{96}}
+
+// Creates a tree with leaves epoch long. If no branching is given the day is
+// split into leaves with a single level.
+func NewTimeTree(epoch time.Duration, branching []int) (error, *TimeTree) {
+	if len(branching) == 0 && epoch > 0 {
+		branching = []int{int(oneDay / epoch)}
+	}
+
+	t := TimeTree{TreeVersion, epoch, branching}
+	if err := t.Validate(); err != nil {
+		return err, nil
+	}
+
+	return nil, &t
+}
+
+func (t *TimeTree) Validate() error {
+	if t.Version != TreeVersion {
+		return errors.New("Unsupported tree schema version " + strconv.Itoa(t.Version))
+	}
+
+	if t.Epoch <= 0 || oneDay%t.Epoch != 0 {
+		return errors.New("Epoch must evenly divide a day, not " + t.Epoch.String())
+	}
+
+	if len(t.Branching) == 0 {
+		return errors.New("Tree needs at least one sub-day level")
+	}
+
+	leaves := 1
+	for _, b := range t.Branching {
+		if b < 1 {
+			return errors.New("Branching must be positive")
+		}
+		leaves *= b
+	}
+
+	if time.Duration(leaves)*t.Epoch != oneDay {
+		return errors.New("Branching " + t.String() + " does not cover exactly one day")
+	}
+
+	return nil
+}
+
+// Encodes the tree as <version>/<epoch seconds>/<branching, dot separated>,
+// e.g. 1/900/96. This is what is published next to the public key.
+func (t *TimeTree) String() string {
+	levels := make([]string, len(t.Branching))
+	for i, b := range t.Branching {
+		levels[i] = strconv.Itoa(b)
+	}
+
+	return strconv.Itoa(t.Version) + "/" +
+		strconv.Itoa(int(t.Epoch/time.Second)) + "/" +
+		strings.Join(levels, ".")
+}
+
+// Parses the output of String. An empty string is the default tree, which
+// keys generated before the schema existed use implicitly.
+func ParseTimeTree(encoded string) (error, *TimeTree) {
+	if encoded == "" {
+		t := DefaultTree
+		return nil, &t
+	}
+
+	parts := strings.Split(encoded, "/")
+	if len(parts) != 3 {
+		return errors.New("Malformed tree schema: " + encoded), nil
+	}
+
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return errors.New("Malformed tree schema version: " + encoded), nil
+	}
+
+	seconds, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return errors.New("Malformed tree schema epoch: " + encoded), nil
+	}
+
+	branching := make([]int, 0)
+	for _, level := range strings.Split(parts[2], ".") {
+		b, err := strconv.Atoi(level)
+		if err != nil {
+			return errors.New("Malformed tree schema branching: " + encoded), nil
+		}
+		branching = append(branching, b)
+	}
+
+	t := TimeTree{version, time.Duration(seconds) * time.Second, branching}
+	if err := t.Validate(); err != nil {
+		return err, nil
+	}
+
+	return nil, &t
+}
+
+// Number of IDs in a path from the root to a leaf
+func (t *TimeTree) Depth() int {
+	return 3 + len(t.Branching)
+}
+
+// Number of sub-day levels, whose Q values are sent with each signature
+func (t *TimeTree) SubLevels() int {
+	return len(t.Branching)
+}
+
+func (t *TimeTree) LeavesPerDay() int {
+	return int(oneDay / t.Epoch)
+}
+
+// The day (midnight UTC) and index of the leaf containing when
+func (t *TimeTree) Leaf(when time.Time) (day time.Time, leaf int) {
+	when = when.UTC()
+	day = when.Truncate(oneDay)
+	leaf = int(when.Sub(day) / t.Epoch)
+	return
+}
+
+// When a leaf begins
+func (t *TimeTree) LeafStart(day time.Time, leaf int) time.Time {
+	return day.Add(time.Duration(leaf) * t.Epoch)
+}
+
+// The sub-day IDs of a leaf, most significant first
+func (t *TimeTree) subPath(leaf int) []string {
+	path := make([]string, len(t.Branching))
+
+	for i := len(t.Branching) - 1; i >= 0; i-- {
+		path[i] = FormatDig(leaf % t.Branching[i])
+		leaf /= t.Branching[i]
+	}
+
+	return path
+}
+
+// The full path of IDs from the root to a leaf, e.g. [2020 01 31 95]
+func (t *TimeTree) Path(day time.Time, leaf int) []string {
+	cyear, cmonth, cday := day.Date()
+
+	path := []string{
+		FormatYear(cyear),
+		FormatDig(int(cmonth)),
+		FormatDig(cday)}
+
+	return append(path, t.subPath(leaf)...)
+}
+
+// How long a node at sub-day level i lasts
+func (t *TimeTree) span(level int) time.Duration {
+	span := t.Epoch
+	for _, b := range t.Branching[level+1:] {
+		span *= time.Duration(b)
+	}
+	return span
+}
+
+// A node of the tree, the leaves under it begin in [start, end)
+type coverNode struct {
+	path  []string
+	start time.Time
+	end   time.Time
+}
+
+/*
+Cover returns the smallest set of node paths whose subtrees hold exactly the
+leaves that began at or after from and before cutoff. Disclosing the secrets of
+these nodes makes every such leaf forgeable, and nothing later.
+
+from is rounded down to the start of its year, since that is the coarsest node.
+*/
+func (t *TimeTree) Cover(from, cutoff time.Time) [][]string {
+	from = from.UTC()
+	cutoff = cutoff.UTC()
+
+	cover := make([][]string, 0)
+
+	var visit func(node coverNode)
+	visit = func(node coverNode) {
+		if !node.start.Before(cutoff) {
+			// Nothing under this node has begun
+			return
+		}
+
+		if node.end.Add(-t.Epoch).Before(cutoff) {
+			// Even the last leaf has begun, the node covers itself
+			cover = append(cover, node.path)
+			return
+		}
+
+		for _, child := range t.children(node) {
+			visit(child)
+		}
+	}
+
+	for year := from.Year(); year <= cutoff.Year(); year++ {
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		visit(coverNode{[]string{FormatYear(year)}, start, start.AddDate(1, 0, 0)})
+	}
+
+	return cover
+}
+
+// The nodes one level below node
+func (t *TimeTree) children(node coverNode) []coverNode {
+	children := make([]coverNode, 0)
+
+	child := func(id string, start, end time.Time) {
+		path := append(append([]string(nil), node.path...), id)
+		children = append(children, coverNode{path, start, end})
+	}
+
+	switch len(node.path) {
+	case 1:
+		// months of a year
+		for start := node.start; start.Before(node.end); start = start.AddDate(0, 1, 0) {
+			child(FormatDig(int(start.Month())), start, start.AddDate(0, 1, 0))
+		}
+	case 2:
+		// days of a month
+		for start := node.start; start.Before(node.end); start = start.AddDate(0, 0, 1) {
+			child(FormatDig(start.Day()), start, start.AddDate(0, 0, 1))
+		}
+	default:
+		// sub-day levels
+		level := len(node.path) - 3
+		span := t.span(level)
+		for i := 0; i < t.Branching[level]; i++ {
+			start := node.start.Add(time.Duration(i) * span)
+			child(FormatDig(i), start, start.Add(span))
+		}
+	}
+
+	return children
+}
+
+// The times the leaves under the node at path begin in, [start, end)
+func (t *TimeTree) Span(path []string) (err error, start, end time.Time) {
+	if len(path) == 0 || len(path) > t.Depth() {
+		return errors.New("Path " + strings.Join(path, "/") + " is not in the tree"), start, end
+	}
+
+	ids := make([]int, len(path))
+	for i, id := range path {
+		if ids[i], err = strconv.Atoi(id); err != nil {
+			return errors.New("Malformed path " + strings.Join(path, "/")), start, end
+		}
+	}
+
+	start = time.Date(ids[0], time.January, 1, 0, 0, 0, 0, time.UTC)
+	end = start.AddDate(1, 0, 0)
+
+	if len(ids) > 1 {
+		if ids[1] < 1 || ids[1] > 12 {
+			return errors.New("Malformed month in " + strings.Join(path, "/")), start, end
+		}
+		start = start.AddDate(0, ids[1]-1, 0)
+		end = start.AddDate(0, 1, 0)
+	}
+
+	if len(ids) > 2 {
+		day := start.AddDate(0, 0, ids[2]-1)
+		if ids[2] < 1 || day.Month() != start.Month() {
+			return errors.New("Malformed day in " + strings.Join(path, "/")), start, end
+		}
+		start = day
+		end = start.AddDate(0, 0, 1)
+	}
+
+	for level := 0; level+3 < len(ids); level++ {
+		id := ids[level+3]
+		if id < 0 || id >= t.Branching[level] {
+			return errors.New("Malformed sub-day ID in " + strings.Join(path, "/")), start, end
+		}
+		start = start.Add(time.Duration(id) * t.span(level))
+		end = start.Add(t.span(level))
+	}
+
+	return nil, start, end
+}